@@ -203,6 +203,8 @@ func (smt *SysMgrTask) init(r router.Router, n string, role ServantRole) {
 	smt.exitChanMap = make(map[string]chan bool)
 	//output_intf or send chans
 	smt.rot.AttachSendChan(router.StrID("/Sys/Command"), smt.sysCmdChan, smt.childBindChan)
+	//heartbeats to peer servant should not be delayed behind other msgs
+	smt.rot.SetPriority(router.StrID("/Sys/Ctrl/Heartbeat"), router.PriorityHigh)
 	smt.rot.AttachSendChan(router.StrID("/Sys/Ctrl/Heartbeat", router.ScopeRemote), smt.htbtSendChan)
 	//input_intf or recv chans
 	smt.rot.AttachRecvChan(router.StrID("/Sys/Ctrl/Heartbeat", router.ScopeRemote), smt.htbtRecvChan)
@@ -0,0 +1,364 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+/*
+ routerctl connects to a running router (such as routerd) with json marshaling,
+ to inspect it and to publish or subscribe msgs:
+
+    routerctl [flags] list             list ids published and subscribed by router
+    routerctl [flags] sub id           print msgs of id as json, one per line
+    routerctl [flags] pub id [json...] publish json values, read from stdin if none given
+    routerctl [flags] tail             print log and fault records of router
+
+ see doc/README_routerctl.txt for flags and examples.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"code.google.com/p/go-router/trunk/router"
+)
+
+var (
+	addr   = flag.String("addr", "tcp:localhost:8800", "address of router, tcp:host:port or unix:path")
+	idType = flag.String("id", "StrID", "id type of router: IntID, StrID, PathID or MsgID")
+	wait   = flag.Duration("wait", time.Second, "time to wait for ids of router")
+	count  = flag.Int("n", 0, "exit after n msgs or records, 0 for no limit")
+	flow   = flag.String("flow", "", "flow control policy of router: Window, XOnOff, Credit or Rate, empty for none")
+	rate   = flag.Float64("rate", 0, "msgs/sec of Rate flow control")
+	burst  = flag.Int("burst", 0, "burst of Rate flow control")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: routerctl [flags] list | sub id | pub id [json...] | tail")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "list" && len(args) == 0:
+	case cmd == "sub" && len(args) == 1:
+	case cmd == "pub" && len(args) >= 1:
+	case cmd == "tail" && len(args) == 0:
+	default:
+		usage()
+	}
+
+	seed, err := seedId(*idType)
+	if err != nil {
+		fail(err)
+	}
+	var id router.Id
+	if len(args) > 0 {
+		if id, err = parseId(seed, args[0]); err != nil {
+			fail(err)
+		}
+	}
+	rot := router.New(seed, router.DefDataChanBufSize, router.BroadcastPolicy)
+	defer rot.Close()
+	var connArgs []interface{}
+	fc, err := flowControlPolicy(*flow)
+	if err != nil {
+		fail(err)
+	}
+	if fc != nil {
+		//flow control must be the same as router's, or conn is refused as router type mismatch
+		connArgs = append(connArgs, fc)
+	}
+	switch cmd {
+	case "sub", "pub":
+		//chans of interface{} exchange msgs of any type with router
+		connArgs = append(connArgs, router.MatchAnyType)
+	case "tail":
+		//records are forwarded only if router exports them too
+		connArgs = append(connArgs, router.ExportRecords)
+	}
+	proxy, err := connect(rot, *addr, connArgs...)
+	if err != nil {
+		fail(err)
+	}
+	defer proxy.Close()
+
+	switch cmd {
+	case "list":
+		//pubs and subs of router come right after connected
+		time.Sleep(*wait)
+		list(proxy)
+	case "sub":
+		err = sub(rot, id)
+	case "pub":
+		err = pub(rot, id, args[1:])
+	case "tail":
+		err = tail(rot)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func connect(rot router.Router, addr string, args ...interface{}) (router.Proxy, error) {
+	i := strings.Index(addr, ":")
+	if i < 0 {
+		return nil, errors.New("invalid address: " + addr)
+	}
+	conn, err := net.Dial(addr[:i], addr[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := rot.ConnectRemote(conn, router.JsonMarshaling, args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+//flow control policies, named as FlowControl.Policy settings of routerd
+func flowControlPolicy(name string) (router.FlowControlPolicy, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case "window":
+		return router.WindowFlowController, nil
+	case "xonoff":
+		return router.XOnOffFlowController, nil
+	case "credit":
+		return router.CreditFlowController, nil
+	case "rate":
+		return router.NewRateFlowController(*rate, *burst), nil
+	}
+	return nil, errors.New("invalid flow control policy: " + name)
+}
+
+func list(proxy router.Proxy) {
+	show := func(kind string, info []*router.ChanInfo) {
+		var lines []string
+		for _, ci := range info {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s", kind, idName(ci.Id), typeName(ci)))
+		}
+		sort.Strings(lines)
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+	}
+	show("pub", proxy.PeerPubInfo())
+	show("sub", proxy.PeerSubInfo())
+}
+
+//sub prints msgs of id; msgs are recved as generic values, any chan type at router matches
+func sub(rot router.Router, id router.Id) error {
+	ch := make(chan interface{}, router.DefDataChanBufSize)
+	if _, err := rot.AttachRecvChan(id, ch); err != nil {
+		return err
+	}
+	stop := interrupted()
+	for n := 0; *count <= 0 || n < *count; n++ {
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+//pub sends json values to id after router's recvers of id are bound
+func pub(rot router.Router, id router.Id, vals []string) error {
+	ch := make(chan interface{})
+	bc := make(chan *router.BindEvent, 1)
+	if _, err := rot.AttachSendChan(id, ch, bc); err != nil {
+		return err
+	}
+	select {
+	case <-bc:
+	case <-time.After(*wait):
+		return errors.New(fmt.Sprintf("no subscriber of %s at router", idName(id)))
+	}
+	var dec *json.Decoder
+	if len(vals) == 0 {
+		dec = json.NewDecoder(os.Stdin)
+	} else {
+		dec = json.NewDecoder(strings.NewReader(strings.Join(vals, " ")))
+	}
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		ch <- v
+	}
+	//closing send chan makes the msgs before it flushed to router
+	close(ch)
+	time.Sleep(*wait)
+	return nil
+}
+
+//tail prints log and fault records of router, only routers with names generate them
+func tail(rot router.Router) error {
+	logs := make(chan *router.LogRecord, router.DefLogBufSize)
+	faults := make(chan *router.FaultRecord, router.DefCmdChanBufSize)
+	if _, err := rot.AttachRecvChan(rot.NewSysID(router.RouterLogId, router.ScopeGlobal), logs); err != nil {
+		return err
+	}
+	if _, err := rot.AttachRecvChan(rot.NewSysID(router.RouterFaultId, router.ScopeGlobal), faults); err != nil {
+		return err
+	}
+	stop := interrupted()
+	for n := 0; *count <= 0 || n < *count; n++ {
+		select {
+		case lr, ok := <-logs:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("%s %s [%v] %v\n", stamp(lr.Timestamp), lr.Source, lr.Pri, lr.Info)
+		case fr, ok := <-faults:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("%s %s [FAULT] %v\n", stamp(fr.Timestamp), fr.Source, fr.Info)
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+func interrupted() chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+func stamp(ns int64) string {
+	return time.Unix(0, ns).Format("15:04:05.000")
+}
+
+func seedId(name string) (router.Id, error) {
+	switch strings.ToLower(name) {
+	case "intid":
+		return router.IntID(), nil
+	case "strid":
+		return router.StrID(), nil
+	case "pathid":
+		return router.PathID(), nil
+	case "msgid":
+		return router.MsgID(), nil
+	}
+	return nil, errors.New("invalid id type: " + name)
+}
+
+//parseId makes an id of seed's type from its value, such as 10, news, /sport/news
+//or 2_5 (family_tag of MsgID)
+func parseId(seed router.Id, val string) (id router.Id, err error) {
+	switch seed.(type) {
+	case *router.IntId:
+		var i int
+		if i, err = strconv.Atoi(val); err == nil {
+			id = router.IntID(i)
+		}
+	case *router.StrId:
+		id = router.StrID(val)
+	case *router.PathId:
+		id = router.PathID(val)
+	case *router.MsgId:
+		f := strings.SplitN(val, "_", 2)
+		if len(f) == 2 {
+			var fam, tag int
+			if fam, err = strconv.Atoi(f[0]); err == nil {
+				if tag, err = strconv.Atoi(f[1]); err == nil {
+					id = router.MsgID(fam, tag)
+				}
+			}
+		}
+	}
+	if id == nil && err == nil {
+		err = errors.New("invalid id: " + val)
+	}
+	return
+}
+
+var sysIdNames = map[int]string{router.RouterLogId: "RouterLogId", router.RouterFaultId: "RouterFaultId"}
+
+func idName(id router.Id) string {
+	if name, ok := sysIdNames[id.SysIdIndex()]; ok {
+		return name
+	}
+	return fmt.Sprint(id.Key())
+}
+
+//typeName shows the elem type of chan, such as string or *router.LogRecord
+func typeName(ci *router.ChanInfo) string {
+	if ci.ElemType == nil {
+		if ci.ChanType != nil {
+			return ci.ChanType.Elem().String()
+		}
+		return "?"
+	}
+	//type encoding at peer: pkgpath.name.kind
+	full := ci.ElemType.FullName
+	i := strings.LastIndex(full, ".")
+	if i < 0 {
+		return full
+	}
+	kind := full[i+1:]
+	j := strings.LastIndex(full[:i], ".")
+	if j < 0 {
+		return full
+	}
+	pkg, name := full[:j], full[j+1:i]
+	if k := strings.LastIndex(pkg, "/"); k >= 0 {
+		pkg = pkg[k+1:]
+	}
+	if len(pkg) > 0 {
+		name = pkg + "." + name
+	}
+	switch kind {
+	case "ptr":
+		return "*" + name
+	case "slice":
+		return "[]" + name
+	case "interface":
+		if len(name) == 0 {
+			return "interface{}"
+		}
+	}
+	return name
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "routerctl:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,223 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"code.google.com/p/go-router/trunk/router"
+)
+
+//Config of routerd, loaded from a json file; names are case insensitive
+type Config struct {
+	Name          string        //router name, router internal log is on if set
+	ConsoleLog    bool          //show router internal log in console
+	IdType        string        //IntID, StrID, PathID or MsgID
+	Dispatch      string        //Broadcast, KeepLatestBroadcast, RoundRobin or Random
+	BufSize       int           //buffer size of router chans, negative for async router
+	Listen        []Listen      //addresses accepting client conns
+	Marshaling    string        //Gob or Json
+	FlowControl   FlowControl   //flow control of client conns
+	Broker        Broker        //limits of broker
+	Rules         *router.Rules //filters and translators of client conns
+	RulesFile     string        //json or yaml file of Rules, used if Rules is not set
+	ExportRecords bool          //exchange log and fault records with clients which ask for them too
+	MatchAnyType  bool          //match chans of interface{} of clients which ask for it too, with chans of any type
+	Admin         string        //http address serving admin page at /router/ and metrics at /metrics
+}
+
+type Listen struct {
+	Network string //tcp or unix
+	Addr    string
+}
+
+type FlowControl struct {
+	Policy string  //empty for none, Window, XOnOff, Credit or Rate
+	Rate   float64 //msgs/sec of Rate policy
+	Burst  int
+}
+
+type Broker struct {
+	MaxClients int
+	Limits     router.ClientLimits
+	Types      []string //elem types of msgs forwarded between clients, such as string, int, []byte
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		IdType:       "StrID",
+		Dispatch:     "Broadcast",
+		BufSize:      router.DefDataChanBufSize,
+		Listen:       []Listen{Listen{"tcp", ":8800"}},
+		Marshaling:   "Json",
+		Broker:       Broker{Types: []string{"string"}},
+		MatchAnyType: true,
+	}
+}
+
+func loadConfig(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := defaultConfig()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("config file %s: %v", file, err))
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) seedId() (router.Id, error) {
+	switch strings.ToLower(cfg.IdType) {
+	case "intid":
+		return router.IntID(), nil
+	case "strid":
+		return router.StrID(), nil
+	case "pathid":
+		return router.PathID(), nil
+	case "msgid":
+		return router.MsgID(), nil
+	}
+	return nil, errors.New("invalid IdType: " + cfg.IdType)
+}
+
+func (cfg *Config) dispatchPolicy() (router.DispatchPolicy, error) {
+	switch strings.ToLower(cfg.Dispatch) {
+	case "broadcast":
+		return router.BroadcastPolicy, nil
+	case "keeplatestbroadcast":
+		return router.KeepLatestBroadcastPolicy, nil
+	case "roundrobin":
+		return router.RoundRobinPolicy, nil
+	case "random":
+		return router.RandomPolicy, nil
+	}
+	return nil, errors.New("invalid Dispatch: " + cfg.Dispatch)
+}
+
+func (cfg *Config) marshalingPolicy() (router.MarshalingPolicy, error) {
+	switch strings.ToLower(cfg.Marshaling) {
+	case "gob":
+		return router.GobMarshaling, nil
+	case "json":
+		return router.JsonMarshaling, nil
+	}
+	return nil, errors.New("invalid Marshaling: " + cfg.Marshaling)
+}
+
+func (cfg *Config) flowControlPolicy() (router.FlowControlPolicy, error) {
+	switch strings.ToLower(cfg.FlowControl.Policy) {
+	case "":
+		return nil, nil
+	case "window":
+		return router.WindowFlowController, nil
+	case "xonoff":
+		return router.XOnOffFlowController, nil
+	case "credit":
+		return router.CreditFlowController, nil
+	case "rate":
+		return router.NewRateFlowController(cfg.FlowControl.Rate, cfg.FlowControl.Burst), nil
+	}
+	return nil, errors.New("invalid FlowControl policy: " + cfg.FlowControl.Policy)
+}
+
+//chan types of msgs which can be forwarded without local chans
+var brokerTypes = map[string]reflect.Type{
+	"bool":    reflect.TypeOf(make(chan bool)),
+	"int":     reflect.TypeOf(make(chan int)),
+	"int32":   reflect.TypeOf(make(chan int32)),
+	"int64":   reflect.TypeOf(make(chan int64)),
+	"uint":    reflect.TypeOf(make(chan uint)),
+	"uint32":  reflect.TypeOf(make(chan uint32)),
+	"uint64":  reflect.TypeOf(make(chan uint64)),
+	"float32": reflect.TypeOf(make(chan float32)),
+	"float64": reflect.TypeOf(make(chan float64)),
+	"string":  reflect.TypeOf(make(chan string)),
+	"[]byte":  reflect.TypeOf(make(chan []byte)),
+}
+
+func (cfg *Config) brokerMode() (router.BrokerMode, error) {
+	bm := router.BrokerMode{MaxClients: cfg.Broker.MaxClients, Limits: cfg.Broker.Limits}
+	for _, name := range cfg.Broker.Types {
+		t, ok := brokerTypes[name]
+		if !ok {
+			return bm, errors.New("invalid Broker type: " + name)
+		}
+		bm.Types = append(bm.Types, t)
+	}
+	return bm, nil
+}
+
+//newRouter creates the router in broker mode
+func (cfg *Config) newRouter() (router.Router, error) {
+	seed, err := cfg.seedId()
+	if err != nil {
+		return nil, err
+	}
+	disp, err := cfg.dispatchPolicy()
+	if err != nil {
+		return nil, err
+	}
+	bm, err := cfg.brokerMode()
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{bm}
+	if len(cfg.Name) > 0 {
+		args = append(args, cfg.Name)
+	}
+	if cfg.ConsoleLog {
+		args = append(args, router.ScopeLocal)
+	}
+	r := router.New(seed, cfg.BufSize, disp, args...)
+	if r == nil {
+		return nil, errors.New("failed to create router")
+	}
+	return r, nil
+}
+
+//connArgs are the optional args of router.ServeBroker()
+func (cfg *Config) connArgs() (args []interface{}, err error) {
+	fc, err := cfg.flowControlPolicy()
+	if err != nil {
+		return
+	}
+	if fc != nil {
+		args = append(args, fc)
+	}
+	if cfg.ExportRecords {
+		args = append(args, router.ExportRecords)
+	}
+	if cfg.MatchAnyType {
+		args = append(args, router.MatchAnyType)
+	}
+	rules := cfg.Rules
+	if rules == nil && len(cfg.RulesFile) > 0 {
+		if rules, err = router.LoadRules(cfg.RulesFile); err != nil {
+			return
+		}
+	}
+	if rules == nil {
+		return
+	}
+	if err = rules.Check(); err != nil {
+		return
+	}
+	if f := rules.IdFilter(); f != nil {
+		args = append(args, f)
+	}
+	if t := rules.IdTranslator(); t != nil {
+		args = append(args, t)
+	}
+	return
+}
@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+/*
+ routerd runs a router in broker mode, forwarding pubs/subs and msgs between the
+ client routers connected to it over tcp or unix domain sockets:
+
+    routerd -config routerd.json
+
+ see doc/README_routerd.txt for the settings in config file.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"code.google.com/p/go-router/trunk/router"
+)
+
+func main() {
+	cfgFile := flag.String("config", "", "config file (json), default settings if not set")
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if len(*cfgFile) > 0 {
+		var err error
+		if cfg, err = loadConfig(*cfgFile); err != nil {
+			fail(err)
+		}
+	}
+	mar, err := cfg.marshalingPolicy()
+	if err != nil {
+		fail(err)
+	}
+	args, err := cfg.connArgs()
+	if err != nil {
+		fail(err)
+	}
+	rot, err := cfg.newRouter()
+	if err != nil {
+		fail(err)
+	}
+
+	//admin page and metrics
+	var admin *router.AdminHandler
+	if len(cfg.Admin) > 0 {
+		admin = router.NewAdminHandler(rot)
+		mux := http.NewServeMux()
+		mux.Handle("/router/", admin)
+		mux.Handle("/metrics", router.NewStatsHandler(rot))
+		al, err := net.Listen("tcp", cfg.Admin)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("admin:", al.Addr())
+		go func() {
+			if err := http.Serve(al, mux); err != nil {
+				fmt.Fprintln(os.Stderr, "routerd: admin:", err)
+			}
+		}()
+	}
+
+	//accept client conns
+	var listeners []net.Listener
+	for _, ln := range cfg.Listen {
+		if ln.Network == "unix" {
+			removeStaleSocket(ln.Addr)
+		}
+		l, err := net.Listen(ln.Network, ln.Addr)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("listen:", l.Addr().Network(), l.Addr())
+		listeners = append(listeners, l)
+		go func(l net.Listener) {
+			if err := router.ServeBroker(rot, l, mar, args...); err != nil {
+				fmt.Println(err)
+			}
+		}(l)
+	}
+
+	//run till interrupted
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	fmt.Println("routerd exit")
+	for _, l := range listeners {
+		l.Close()
+	}
+	if admin != nil {
+		admin.Close()
+	}
+	rot.Close()
+}
+
+//remove socket file left by a crashed routerd
+func removeStaleSocket(addr string) {
+	if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "routerd:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,291 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//default number of recent log and fault records kept by AdminHandler
+const DefAdminRecordSize = 100
+
+/*
+ AdminHandler is an http.Handler showing what a running router is connected to:
+ ids and their bindings, proxies with their filters, translators, flow control
+ and peer pub/sub info, and recent log and fault records. It serves a html page
+ by default, and json if requested with "?format=json" or "Accept: application/json", e.g.
+
+    admin := router.NewAdminHandler(rot)
+    http.Handle("/router/", admin)
+
+ AdminHandler attaches recv chans to RouterLogId and RouterFaultId to keep recent
+ log and fault records, so raised faults are recorded here instead of crashing
+ the process. Only routers (and proxies) with names generate log and fault records;
+ records of connected routers are not kept here.
+ The optional argument is the number of records to keep.
+*/
+type AdminHandler struct {
+	router    *routerImpl
+	logChan   chan *LogRecord
+	faultChan chan *FaultRecord
+	logs      *recordRing
+	faults    *recordRing
+}
+
+func NewAdminHandler(r Router, args ...interface{}) *AdminHandler {
+	size := DefAdminRecordSize
+	if len(args) > 0 {
+		if iv, ok := args[0].(int); ok && iv > 0 {
+			size = iv
+		}
+	}
+	h := &AdminHandler{router: r.(*routerImpl)}
+	h.logs = newRecordRing(size)
+	h.faults = newRecordRing(size)
+	h.logChan = make(chan *LogRecord, DefLogBufSize)
+	h.faultChan = make(chan *FaultRecord, DefCmdChanBufSize)
+	bc := make(chan *BindEvent, 1) //keep chans open when senders detach
+	if _, err := r.AttachRecvChan(r.NewSysID(RouterLogId, ScopeLocal), h.logChan, bc); err == nil {
+		go func() {
+			for lr := range h.logChan {
+				h.logs.add(lr)
+			}
+		}()
+	}
+	if _, err := r.AttachRecvChan(r.NewSysID(RouterFaultId, ScopeLocal), h.faultChan, bc); err == nil {
+		go func() {
+			for fr := range h.faultChan {
+				h.faults.add(fr)
+			}
+		}()
+	}
+	return h
+}
+
+//detach log and fault chans from router
+func (h *AdminHandler) Close() {
+	h.router.DetachChan(h.router.NewSysID(RouterLogId, ScopeLocal), h.logChan)
+	h.router.DetachChan(h.router.NewSysID(RouterFaultId, ScopeLocal), h.faultChan)
+}
+
+//a fixed size buffer keeping the latest records
+type recordRing struct {
+	sync.Mutex
+	records []interface{}
+	next    int
+	full    bool
+}
+
+func newRecordRing(size int) *recordRing {
+	return &recordRing{records: make([]interface{}, size)}
+}
+
+func (rr *recordRing) add(r interface{}) {
+	rr.Lock()
+	defer rr.Unlock()
+	rr.records[rr.next] = r
+	rr.next = (rr.next + 1) % len(rr.records)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+//return records, oldest first
+func (rr *recordRing) list() []interface{} {
+	rr.Lock()
+	defer rr.Unlock()
+	if !rr.full {
+		return append([]interface{}{}, rr.records[:rr.next]...)
+	}
+	return append(append([]interface{}{}, rr.records[rr.next:]...), rr.records[:rr.next]...)
+}
+
+//views of router state for json and html
+type adminView struct {
+	Router  string
+	Async   bool
+	Time    time.Time
+	Routes  []*adminRouteView
+	Proxies []*adminProxyView
+	Logs    []*adminRecordView
+	Faults  []*adminRecordView
+}
+
+type adminRouteView struct {
+	Id      string
+	Type    string
+	BufSize int //internal buffering for recv chans
+	Senders []*adminChanView
+	Recvers []*adminChanView
+}
+
+type adminChanView struct {
+	Id       string
+	Dir      string
+	Scope    int
+	Member   int
+	Dispatch string `json:",omitempty"`
+	Cap      int
+	Len      int
+	Proxy    string   `json:",omitempty"`
+	Peers    []string //ids of bound peers, with proxy names for remote peers
+}
+
+type adminProxyView struct {
+	Name        string
+	ConnType    string
+	Connected   bool
+	Filter      string `json:",omitempty"`
+	Translator  string `json:",omitempty"`
+	LocalPub    []string
+	LocalSub    []string
+	PeerPub     []string
+	PeerSub     []string
+	BytesIn     uint64
+	BytesOut    uint64
+	HandshakeNs int64
+}
+
+type adminRecordView struct {
+	Time   time.Time
+	Source string
+	Pri    string `json:",omitempty"`
+	Info   string
+}
+
+func chanInfoStrings(info []*ChanInfo) []string {
+	ss := make([]string, len(info))
+	for i, ci := range info {
+		ss[i] = fmt.Sprintf("%v %v", ci.Id, ci.ChanType)
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+func (h *AdminHandler) view() *adminView {
+	r := h.router
+	v := &adminView{Router: r.name, Async: r.async, Time: time.Now()}
+	chanView := func(ci *RoutedChanInfo) *adminChanView {
+		cv := &adminChanView{Id: ci.Id.String(), Dir: dirString(ci.Dir), Scope: ci.Id.Scope(), Member: ci.Id.Member(),
+			Dispatch: ci.Dispatch, Cap: ci.Cap, Len: ci.Len, Proxy: ci.Proxy}
+		for _, p := range ci.Peers {
+			if len(p.Proxy) > 0 {
+				cv.Peers = append(cv.Peers, fmt.Sprintf("%v@%s", p.Id, p.Proxy))
+			} else {
+				cv.Peers = append(cv.Peers, p.Id.String())
+			}
+		}
+		return cv
+	}
+	for _, ri := range r.Routes(func(id Id) bool { return true }) {
+		rv := &adminRouteView{Id: fmt.Sprintf("%v", ri.Id.Key()), Type: fmt.Sprintf("%v", ri.ChanType), BufSize: r.recvChanBufSize(ri.Id)}
+		for _, ci := range ri.Senders {
+			rv.Senders = append(rv.Senders, chanView(ci))
+		}
+		for _, ci := range ri.Recvers {
+			rv.Recvers = append(rv.Recvers, chanView(ci))
+		}
+		v.Routes = append(v.Routes, rv)
+	}
+	stats := r.Stats()
+	for i, p := range r.proxyList() {
+		pv := &adminProxyView{Name: proxyName(i, p), ConnType: p.connType(),
+			Filter: typeName(p.filter), Translator: typeName(p.translator)}
+		p.proxyLock.Lock()
+		pv.Connected = p.connReady && !p.Closed
+		p.proxyLock.Unlock()
+		if pv.Connected {
+			pv.LocalPub = chanInfoStrings(p.LocalPubInfo())
+			pv.LocalSub = chanInfoStrings(p.LocalSubInfo())
+		}
+		pv.PeerPub = chanInfoStrings(p.PeerPubInfo())
+		pv.PeerSub = chanInfoStrings(p.PeerSubInfo())
+		for _, ps := range stats.Proxies {
+			if ps.Name == pv.Name {
+				pv.BytesIn, pv.BytesOut, pv.HandshakeNs = ps.BytesIn, ps.BytesOut, int64(ps.HandshakeDuration)
+			}
+		}
+		v.Proxies = append(v.Proxies, pv)
+	}
+	for _, rec := range h.logs.list() {
+		lr := rec.(*LogRecord)
+		v.Logs = append(v.Logs, &adminRecordView{time.Unix(0, lr.Timestamp), lr.Source, lr.Pri.String(), fmt.Sprint(lr.Info)})
+	}
+	for _, rec := range h.faults.list() {
+		fr := rec.(*FaultRecord)
+		v.Faults = append(v.Faults, &adminRecordView{time.Unix(0, fr.Timestamp), fr.Source, "", fmt.Sprint(fr.Info)})
+	}
+	return v
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v := h.view()
+	if req.FormValue("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(w, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html><head><title>router {{.Router}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+</style></head>
+<body>
+<h1>router {{.Router}}</h1>
+<p>{{.Time}}{{if .Async}}, async{{end}} - <a href="?format=json">json</a></p>
+<h2>Ids</h2>
+<table>
+<tr><th>Id</th><th>Chan type</th><th>Buf size</th><th>Dir</th><th>Chan id</th><th>Dispatch</th><th>Len/Cap</th><th>Proxy</th><th>Bound peers</th></tr>
+{{range .Routes}}{{$r := .}}{{range .Senders}}
+<tr><td>{{$r.Id}}</td><td>{{$r.Type}}</td><td>{{$r.BufSize}}</td><td>{{.Dir}}</td><td>{{.Id}}</td><td>{{.Dispatch}}</td><td>{{.Len}}/{{.Cap}}</td><td>{{.Proxy}}</td><td>{{range .Peers}}{{.}}<br>{{end}}</td></tr>
+{{end}}{{range .Recvers}}
+<tr><td>{{$r.Id}}</td><td>{{$r.Type}}</td><td>{{$r.BufSize}}</td><td>{{.Dir}}</td><td>{{.Id}}</td><td></td><td>{{.Len}}/{{.Cap}}</td><td>{{.Proxy}}</td><td>{{range .Peers}}{{.}}<br>{{end}}</td></tr>
+{{end}}{{end}}
+</table>
+<h2>Proxies</h2>
+<table>
+<tr><th>Name</th><th>Conn type</th><th>Connected</th><th>Filter</th><th>Translator</th><th>Local pub</th><th>Local sub</th><th>Peer pub</th><th>Peer sub</th><th>Bytes in/out</th></tr>
+{{range .Proxies}}
+<tr><td>{{.Name}}</td><td>{{.ConnType}}</td><td>{{.Connected}}</td><td>{{.Filter}}</td><td>{{.Translator}}</td>
+<td>{{range .LocalPub}}{{.}}<br>{{end}}</td><td>{{range .LocalSub}}{{.}}<br>{{end}}</td>
+<td>{{range .PeerPub}}{{.}}<br>{{end}}</td><td>{{range .PeerSub}}{{.}}<br>{{end}}</td><td>{{.BytesIn}}/{{.BytesOut}}</td></tr>
+{{end}}
+</table>
+<h2>Recent faults</h2>
+<table>
+<tr><th>Time</th><th>Source</th><th>Info</th></tr>
+{{range .Faults}}<tr><td>{{.Time}}</td><td>{{.Source}}</td><td>{{.Info}}</td></tr>
+{{end}}
+</table>
+<h2>Recent logs</h2>
+<table>
+<tr><th>Time</th><th>Source</th><th>Priority</th><th>Info</th></tr>
+{{range .Logs}}<tr><td>{{.Time}}</td><td>{{.Source}}</td><td>{{.Pri}}</td><td>{{.Info}}</td></tr>
+{{end}}
+</table>
+</body></html>
+`))
@@ -0,0 +1,108 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ HighWaterMark bounds the memory used for msgs buffered at a router, passed as
+ an optional argument to New(). By default async routers buffer without limit
+ before recv chans and in stream connections to remote routers. With a high-water
+ mark, each such buffer holds at most HighWaterMark msgs; when it is full, senders
+ block (or TrySend fails) till half of the buffered msgs are forwarded. Buffers before
+ recv chans can handle overflow differently, by OverflowReaction.
+
+ Since blocked senders stop consuming msgs from their upstream hops, a slow consumer
+ is propagated upstream hop by hop, thru flow control acks or the transport of
+ stream connections, till the original sender blocks; instead of any router in
+ the middle buffering without bound. When a buffer reaches its high-water mark, an
+ error is logged and raised as a fault (if there are fault handlers), at every hop
+ where it happens.
+*/
+type HighWaterMark int
+
+/*
+ OverflowReaction: how async router handles msgs sent to a recv chan whose buffer
+ reaches HighWaterMark. Each overflow is reported as a fault on RouterFaultId and
+ counted in recver's IdStats.Overflows; dropped msgs are counted as Dropped too.
+ It is passed as an optional argument to router.New(); by default BlockOnOverflow.
+*/
+type OverflowReaction int
+
+const (
+	//block senders till buffered msgs drop to half of high-water mark; reported once when buffer fills up
+	BlockOnOverflow OverflowReaction = iota
+	//drop the new msg
+	DropNewestOnOverflow
+	//drop the oldest buffered msg to make room for the new one
+	DropOldestOnOverflow
+	//detach the slow recv chan from router; msgs already buffered are still delivered
+	DetachOnOverflow
+)
+
+func (o OverflowReaction) String() string {
+	switch o {
+	case BlockOnOverflow:
+		return "block"
+	case DropNewestOnOverflow:
+		return "drop newest"
+	case DropOldestOnOverflow:
+		return "drop oldest"
+	case DetachOnOverflow:
+		return "detach"
+	}
+	return "invalid overflow reaction"
+}
+
+//hook for asyncChans bounded by high-water mark, to report slow consumers
+func (s *routerImpl) slowConsumer(what string) func(bool) {
+	return func(full bool) {
+		if !full {
+			s.Log(LOG_INFO, "slow consumer caught up: "+what)
+			return
+		}
+		err := errors.New(errSlowConsumer + ": " + what)
+		s.LogError(err)
+		s.tryRaise(err)
+	}
+}
+
+//hooks for the bounded buffer of async router's recv chan, to report and react to overflows
+func (s *routerImpl) recvOverflow(routCh *RoutedChan) (full func(bool), overflow func()) {
+	what := "recver of " + routCh.Id.String()
+	slow := s.slowConsumer(what)
+	full = func(f bool) {
+		if f && s.onOverflow == BlockOnOverflow {
+			routCh.countOverflow()
+		}
+		slow(f)
+	}
+	var detach sync.Once
+	overflow = func() {
+		routCh.countDrop()
+		routCh.countOverflow()
+		err := errors.New(fmt.Sprintf("%s: %s, %v", errRecvOverflow, what, s.onOverflow))
+		s.LogError(err)
+		s.tryRaise(err)
+		if s.onOverflow == DetachOnOverflow {
+			//called with recver's buffer locked, detach in another goroutine
+			detach.Do(func() { go routCh.Detach() })
+		}
+	}
+	return
+}
+
+func (e *RoutedChan) countOverflow() {
+	if e.stats != nil {
+		atomic.AddUint64(&e.stats.overflows, 1)
+	}
+}
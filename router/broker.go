@@ -0,0 +1,406 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+ BrokerMode runs router as the hub of hub-and-spoke topology, passed as an optional
+ argument to New(). By default routers only export their local pubs/subs to connected
+ routers, so a client's publication reaches another client only if the hub attaches
+ chans to re-export it. In broker mode, every connected router is a client:
+    1. pubs/subs of each client are exported to all the other clients, together with
+       hub's local pubs/subs. Msgs from a client are forwarded to the other clients
+       subscribing to them, never back to itself.
+    2. at most MaxClients clients can connect, more connections fail.
+    3. each client is bound by Limits. Pubs/subs beyond MaxPubs/MaxSubs are not
+       forwarded and are reported as faults. Msgs beyond Rate block the connection
+       of client, so it is pushed back.
+ Clients are normal routers, connected to the broker only, or msgs could reach them
+ more than once. The hub needs the chan types of ids without local chans attached
+ to demarshal msgs from clients; they can be listed in Types.
+ ServeBroker() accepts client connections from a listener.
+*/
+type BrokerMode struct {
+	MaxClients int            //max number of connected clients, 0 for no limit
+	Limits     ClientLimits   //limits of each client
+	Types      []reflect.Type //chan types of msgs forwarded between clients
+}
+
+//ClientLimits bounds what a client can do thru broker, zero for no limit
+type ClientLimits struct {
+	MaxPubs int     //max number of ids published by client
+	MaxSubs int     //max number of ids subscribed by client
+	Rate    float64 //max msgs per second sent by client
+	Burst   int     //max msgs sent in a burst
+}
+
+//ServeBroker accepts client conns from l and connects them to router r in broker mode,
+//till l is closed. Optional args can be an IdFilter and an IdTranslator installed at
+//proxy of each client, others are passed to ConnectRemote(), such as FlowControlPolicy
+func ServeBroker(r Router, l net.Listener, mar MarshalingPolicy, args ...interface{}) error {
+	if rt, ok := r.(*routerImpl); !ok || rt.broker == nil {
+		return errors.New(errNotBroker)
+	}
+	var filter IdFilter
+	var translator IdTranslator
+	var connArgs []interface{}
+	for _, arg := range args {
+		f, isFilter := arg.(IdFilter)
+		t, isTranslator := arg.(IdTranslator)
+		if isFilter {
+			filter = f
+		}
+		if isTranslator {
+			translator = t
+		}
+		if !isFilter && !isTranslator {
+			connArgs = append(connArgs, arg)
+		}
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		//handshake in its own goroutine, so a slow client does not block others
+		go func() {
+			p := NewProxy(r, conn.RemoteAddr().String(), filter, translator)
+			if err := p.ConnectRemote(conn, mar, connArgs...); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+//kinds of broker changes
+const (
+	clientJoin = iota
+	clientLeave
+	clientChange //pubs/subs of clients or local chans changed
+)
+
+type brokerEvent struct {
+	kind  int
+	proxy *proxyImpl
+}
+
+//brokerTable keeps the clients of router in broker mode. All changes are handled
+//in order in a single goroutine, which exports pubs/subs of clients to each other.
+type brokerTable struct {
+	router  *routerImpl
+	mode    BrokerMode
+	clients []*proxyImpl
+	untyped map[interface{}]bool //ids of unknown chan type, reported once
+	//clients admitted at conn setup, protected by lock
+	admitted map[*proxyImpl]bool
+	//queue of changes
+	lock   sync.Mutex
+	cond   *sync.Cond
+	events []*brokerEvent
+	closed bool
+}
+
+func newBrokerTable(r *routerImpl, mode BrokerMode) *brokerTable {
+	b := &brokerTable{router: r, mode: mode}
+	b.untyped = make(map[interface{}]bool)
+	b.admitted = make(map[*proxyImpl]bool)
+	b.cond = sync.NewCond(&b.lock)
+	go b.run()
+	return b
+}
+
+func (b *brokerTable) post(ev *brokerEvent) {
+	b.lock.Lock()
+	if !b.closed {
+		b.events = append(b.events, ev)
+		b.cond.Signal()
+	}
+	b.lock.Unlock()
+}
+
+func (b *brokerTable) run() {
+	for {
+		b.lock.Lock()
+		for len(b.events) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.lock.Unlock()
+			return
+		}
+		events := b.events
+		b.events = nil
+		b.lock.Unlock()
+		for _, ev := range events {
+			switch ev.kind {
+			case clientJoin:
+				b.clients = append(b.clients, ev.proxy)
+			case clientLeave:
+				for i, p := range b.clients {
+					if p == ev.proxy {
+						b.clients = append(b.clients[:i], b.clients[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		//a batch of changes is synced at once
+		b.syncAll()
+	}
+}
+
+func (b *brokerTable) Close() {
+	b.lock.Lock()
+	b.closed = true
+	b.cond.Signal()
+	b.lock.Unlock()
+}
+
+//syncAll exports to each client the pubs/subs of hub and all the other clients
+func (b *brokerTable) syncAll() {
+	//log/fault ids of hub are exported to clients exchanging records
+	localPubs := b.router.idsForSend(recordOrExportedId)
+	localSubs := b.router.idsForRecv(recordOrExportedId)
+	var clients []*proxyImpl
+	var pubs, subs []map[interface{}]*ChanInfo
+	for _, p := range b.clients {
+		if p.isClosed() {
+			continue
+		}
+		pi, si := p.brokerImports()
+		clients = append(clients, p)
+		pubs = append(pubs, b.typed(p, pi))
+		subs = append(subs, b.typed(p, si))
+	}
+	//export pubs before subs, so forwarding chans are ready before msgs come
+	for i, p := range clients {
+		exported, _ := p.brokerExports()
+		b.export(p, PubId, UnPubId, others(localPubs, pubs, i), exported)
+	}
+	for i, p := range clients {
+		_, exported := p.brokerExports()
+		b.export(p, SubId, UnSubId, others(localSubs, subs, i), exported)
+	}
+}
+
+//export sends client the changes of pubs (or subs) it should see
+func (b *brokerTable) export(p *proxyImpl, idx, unIdx int, want, exported map[interface{}]*ChanInfo) {
+	var adds, dels []*ChanInfo
+	for k, info := range want {
+		if _, ok := exported[k]; !ok {
+			adds = append(adds, info)
+		}
+	}
+	for k, info := range exported {
+		if _, ok := want[k]; !ok {
+			dels = append(dels, info)
+		}
+	}
+	if len(adds) > 0 {
+		p.applyLocalCtrlMsg(&genericMsg{b.router.SysID(idx), &ChanInfoMsg{adds}})
+	}
+	if len(dels) > 0 {
+		p.applyLocalCtrlMsg(&genericMsg{b.router.SysID(unIdx), &ChanInfoMsg{dels}})
+	}
+}
+
+//typed resolves chan types of ids from client, which are needed to forward its msgs
+func (b *brokerTable) typed(p *proxyImpl, info []*ChanInfo) map[interface{}]*ChanInfo {
+	ids := make(map[interface{}]*ChanInfo)
+	for _, v := range info {
+		k := v.Id.Key()
+		chanType := b.router.relayChanType(v, b.mode.Types, p.matchAnyType)
+		if chanType == nil {
+			if !b.untyped[k] {
+				b.untyped[k] = true
+				b.router.LogError(errors.New(fmt.Sprintf("%s: %v", errBrokerChanType, v.Id)))
+			}
+			continue
+		}
+		delete(b.untyped, k)
+		ids[k] = &ChanInfo{Id: v.Id, ChanType: chanType, ElemType: v.ElemType}
+	}
+	return ids
+}
+
+//others merges local ids with ids of all clients except self
+func others(local map[interface{}]*ChanInfo, clients []map[interface{}]*ChanInfo, self int) map[interface{}]*ChanInfo {
+	ids := make(map[interface{}]*ChanInfo)
+	for k, v := range local {
+		ids[k] = v
+	}
+	for i, c := range clients {
+		if i == self {
+			continue
+		}
+		for k, v := range c {
+			if _, ok := ids[k]; !ok {
+				ids[k] = v
+			}
+		}
+	}
+	return ids
+}
+
+//check broker's max number of clients at conn setup and admit p; clients admitted
+//and not closed are counted, including those still in handshake
+func (s *routerImpl) checkBrokerClient(p *proxyImpl) error {
+	b := s.broker
+	if b == nil || b.mode.MaxClients <= 0 {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.admitted {
+		if c.isClosed() {
+			delete(b.admitted, c)
+		}
+	}
+	if len(b.admitted) >= b.mode.MaxClients {
+		return errors.New(fmt.Sprintf("%s: %d", errBrokerFull, b.mode.MaxClients))
+	}
+	b.admitted[p] = true
+	return nil
+}
+
+//clientLimit checks if broker client already has max app ids published (or subscribed)
+//in imported, so id is refused
+func (p *proxyImpl) clientLimit(idx int, imported map[interface{}]*ChanInfo, id Id) bool {
+	b := p.router.broker
+	if b == nil || id.SysIdIndex() >= 0 {
+		return false
+	}
+	max := b.mode.Limits.MaxPubs
+	if idx == SubId {
+		max = b.mode.Limits.MaxSubs
+	}
+	num := 0
+	for _, v := range imported {
+		if v.Id.SysIdIndex() < 0 {
+			num++
+		}
+	}
+	if max <= 0 || num < max {
+		return false
+	}
+	err := errors.New(fmt.Sprintf("%s: %s more than %d ids, %v refused", errClientLimit, sysIdxString[idx], max, id))
+	p.LogError(err)
+	p.tryRaise(err)
+	return true
+}
+
+func (p *proxyImpl) isClosed() bool {
+	p.proxyLock.Lock()
+	defer p.proxyLock.Unlock()
+	return p.Closed
+}
+
+//pubs/subs imported from client, with the type info sent by client;
+//log/fault ids of clients are not relayed
+func (p *proxyImpl) brokerImports() (pubs, subs []*ChanInfo) {
+	p.inwardLock.Lock()
+	for _, v := range p.importSendIds {
+		if v.Id.SysIdIndex() >= 0 {
+			continue
+		}
+		pubs = append(pubs, &ChanInfo{Id: v.Id, ChanType: v.ChanType, ElemType: v.ElemType})
+	}
+	p.inwardLock.Unlock()
+	p.outwardLock.Lock()
+	for _, v := range p.importRecvIds {
+		if v.Id.SysIdIndex() >= 0 {
+			continue
+		}
+		subs = append(subs, &ChanInfo{Id: v.Id, ChanType: v.ChanType, ElemType: v.ElemType})
+	}
+	p.outwardLock.Unlock()
+	return
+}
+
+//pubs/subs exported to client
+func (p *proxyImpl) brokerExports() (pubs, subs map[interface{}]*ChanInfo) {
+	pubs = make(map[interface{}]*ChanInfo)
+	subs = make(map[interface{}]*ChanInfo)
+	p.outwardLock.Lock()
+	for k, v := range p.exportSendIds {
+		pubs[k] = v
+	}
+	p.outwardLock.Unlock()
+	p.inwardLock.Lock()
+	for k, v := range p.exportRecvIds {
+		subs[k] = v
+	}
+	p.inwardLock.Unlock()
+	return
+}
+
+//clientBucket limits the rate of msgs from a broker client, shared by all its chans
+type clientBucket struct {
+	sync.Mutex
+	bucket tokenBucket
+}
+
+func newClientBucket(l ClientLimits) *clientBucket {
+	cb := new(clientBucket)
+	cb.bucket.set(l.Rate, normBurst(l.Burst))
+	return cb
+}
+
+func (cb *clientBucket) take() time.Duration {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.bucket.take()
+}
+
+func (cb *clientBucket) giveBack() {
+	cb.Lock()
+	cb.bucket.giveBack()
+	cb.Unlock()
+}
+
+//clientRateChan delivers msgs from a broker client, sends block while client is over its rate
+type clientRateChan struct {
+	Channel
+	limit *clientBucket
+}
+
+func (c *clientRateChan) Send(v reflect.Value) {
+	for {
+		wait := c.limit.take()
+		if wait == 0 {
+			break
+		}
+		if wait > maxRateWait {
+			wait = maxRateWait
+		}
+		time.Sleep(wait)
+	}
+	c.Channel.Send(v)
+}
+
+func (c *clientRateChan) TrySend(v reflect.Value) bool {
+	if c.limit.take() > 0 {
+		return false
+	}
+	if !c.Channel.TrySend(v) {
+		c.limit.giveBack()
+		return false
+	}
+	return true
+}
+
+func (c *clientRateChan) Interface() interface{} {
+	return c
+}
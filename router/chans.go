@@ -10,6 +10,7 @@ import (
 	"container/list"
 	"reflect"
 	"sync"
+	"time"
 )
 
 /* 
@@ -108,14 +109,94 @@ func (gch *genericMsgChan) TrySend(v reflect.Value) bool {
 
 /*
  asyncChan: a trivial async chan
- . unlimited internal buffering
- . senders never block
+ . unlimited internal buffering, or bounded by an optional high-water mark
+ . senders never block, unless buffered msgs reach the high-water mark
 */
 type asyncChan struct {
 	Channel
 	sync.Mutex
 	buffer *list.List //when buffer!=nil, background forwarding active
 	closed bool
+	//optional hook to drop stale msgs before forwarding, with the time (UnixNano) they are queued
+	expired func(v reflect.Value, queued int64) bool
+	//optional high-water mark: at most limit msgs are buffered, Send blocks and TrySend fails beyond it
+	limit   int
+	pending int //buffered msgs, including those being forwarded; counted only if limit > 0
+	cond    *sync.Cond
+	//optional hook called when buffered msgs reach limit (true), and drop to half of it (false)
+	full   func(bool)
+	isFull bool
+	//how to handle msgs sent beyond limit, and optional hook called for each msg dropped by it
+	onFull   OverflowReaction
+	overflow func()
+	//optional hook reporting panics of wrapped chan in forwarding goroutine
+	panicked func(r interface{})
+}
+
+//msgs buffered in asyncChan
+type queuedMsg struct {
+	v      reflect.Value
+	queued int64 //set only if asyncChan has expired hook
+}
+
+func (ac *asyncChan) queue(v reflect.Value) {
+	qm := queuedMsg{v: v}
+	if ac.expired != nil {
+		qm.queued = time.Now().UnixNano()
+	}
+	ac.buffer.PushBack(qm)
+	if ac.limit > 0 {
+		ac.pending++
+		if ac.pending >= ac.limit {
+			ac.setFull(true)
+		}
+	}
+}
+
+func (ac *asyncChan) setFull(full bool) {
+	if ac.isFull == full {
+		return
+	}
+	ac.isFull = full
+	if ac.full != nil {
+		ac.full(full)
+	}
+}
+
+//wait till buffered msgs below limit, or return false if would block
+func (ac *asyncChan) waitRoom(block bool) bool {
+	for ac.limit > 0 && ac.pending >= ac.limit && !ac.closed {
+		if !block {
+			return false
+		}
+		if ac.cond == nil {
+			ac.cond = sync.NewCond(&ac.Mutex)
+		}
+		ac.cond.Wait()
+	}
+	return true
+}
+
+func (ac *asyncChan) overflowed() {
+	if ac.overflow != nil {
+		ac.overflow()
+	}
+}
+
+//a buffered msg is forwarded or dropped, wake up blocked senders
+func (ac *asyncChan) forwarded() {
+	if ac.limit <= 0 {
+		return
+	}
+	ac.Lock()
+	ac.pending--
+	if ac.pending <= ac.limit/2 {
+		ac.setFull(false)
+	}
+	if ac.cond != nil {
+		ac.cond.Broadcast()
+	}
+	ac.Unlock()
 }
 
 func (ac *asyncChan) Close() {
@@ -125,6 +206,9 @@ func (ac *asyncChan) Close() {
 		return
 	}
 	ac.closed = true
+	if ac.cond != nil {
+		ac.cond.Broadcast()
+	}
 	if ac.buffer == nil { //no background forwarder running
 		ac.Channel.Close()
 	}
@@ -148,19 +232,47 @@ func (ac *asyncChan) Len() int {
 	return l + ac.buffer.Len()
 }
 
-//for async chan, Send() never block because of unlimited buffering
+//for async chan, Send() never block because of unlimited buffering, unless a high-water mark is set
 func (ac *asyncChan) Send(v reflect.Value) {
 	ac.Lock()
 	defer ac.Unlock()
+	ac.send(v, true)
+}
+
+func (ac *asyncChan) send(v reflect.Value, block bool) bool {
+	if ac.limit > 0 && ac.pending >= ac.limit && !ac.closed {
+		switch ac.onFull {
+		case DropNewestOnOverflow, DetachOnOverflow:
+			ac.overflowed()
+			return true
+		case DropOldestOnOverflow:
+			ac.overflowed()
+			e := ac.buffer.Front()
+			if e == nil {
+				//the only buffered msg is being forwarded, drop the new one instead
+				return true
+			}
+			ac.buffer.Remove(e)
+			ac.pending--
+			if ac.cond != nil {
+				ac.cond.Broadcast()
+			}
+		default:
+			if !ac.waitRoom(block) {
+				ac.setFull(true)
+				return false
+			}
+		}
+	}
 	if ac.closed {
-		return
+		return true
 	}
 	if ac.buffer == nil {
 		if ac.Channel.TrySend(v) {
-			return
+			return true
 		}
 		ac.buffer = new(list.List)
-		ac.buffer.PushBack(v)
+		ac.queue(v)
 		//spawn forwarder
 		go func() {
 			for {
@@ -174,22 +286,52 @@ func (ac *asyncChan) Send(v reflect.Value) {
 					ac.Unlock()
 					return
 				}
-				ac.buffer = new(list.List)
+				if ac.limit > 0 {
+					//take msgs one by one, so the oldest buffered can be dropped
+					l = new(list.List)
+					l.PushBack(ac.buffer.Remove(ac.buffer.Front()))
+				} else {
+					ac.buffer = new(list.List)
+				}
 				ac.Unlock()
 				for e := l.Front(); e != nil; e = l.Front() {
-					ac.Channel.Send(e.Value.(reflect.Value))
+					qm := e.Value.(queuedMsg)
+					if ac.expired == nil || !ac.expired(qm.v, qm.queued) {
+						ac.forward(qm.v)
+					}
 					l.Remove(e)
+					ac.forwarded()
 				}
 			}
 		}()
 	} else {
-		ac.buffer.PushBack(v)
+		ac.queue(v)
 	}
+	return true
 }
 
+//send buffered msg to wrapped chan, recovering its panics if panicked hook is set
+func (ac *asyncChan) forward(v reflect.Value) {
+	if ac.panicked != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				ac.panicked(r)
+			}
+		}()
+	}
+	ac.Channel.Send(v)
+}
+
+//TrySend fails only if buffered msgs reach high-water mark and BlockOnOverflow is used;
+//without a high-water mark it always succeeds, as Send never blocks
 func (ac *asyncChan) TrySend(v reflect.Value) bool {
-	ac.Send(v)
-	return true
+	if ac.limit <= 0 {
+		ac.Send(v)
+		return true
+	}
+	ac.Lock()
+	defer ac.Unlock()
+	return ac.send(v, false)
 }
 
 /*
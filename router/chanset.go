@@ -8,7 +8,6 @@ package router
 
 import (
 	"errors"
-	"fmt"
 	"reflect"
 	"sync"
 )
@@ -82,7 +81,7 @@ type recvChanSet struct {
 	*chanSet
 }
 
-func (rcs *recvChanSet) AddRecver(id Id, ch Channel, credit int) (err error) {
+func (rcs *recvChanSet) AddRecver(id Id, ch Channel, credit int, args ...interface{}) (err error) {
 	_, ok := rcs.chans[id.Key()]
 	if ok {
 		err = errors.New("router recvChanSet: AddRecver duplicated id")
@@ -90,24 +89,25 @@ func (rcs *recvChanSet) AddRecver(id Id, ch Channel, credit int) (err error) {
 	}
 	rt := rcs.router
 	rid, _ := id.Clone(rcs.scope, rcs.member)
-	rcs.router.Log(LOG_INFO, fmt.Sprintf("enter1 add recver for %v, credit %v, async %v, flow not null %v", rid, credit, rcs.router.async, rcs.proxy.flowController != nil))
+	rcs.router.Logf(LOG_INFO, "enter1 add recver for %v, credit %v, async %v, flow not null %v", rid, credit, rcs.router.async, rcs.proxy.flowController != nil)
 	rch := ch
-	if !rcs.router.async && rcs.proxy.flowController != nil {
-		rcs.router.Log(LOG_INFO, fmt.Sprintf("enter2 add recver for %v", rid))
+	//NO flow control for log/fault records forwarded to peer, same as sys chans at peer side
+	if rid.SysIdIndex() < 0 && !rcs.router.async && rcs.proxy.flowController != nil {
+		rcs.router.Logf(LOG_INFO, "enter2 add recver for %v", rid)
 		//attach flow control adapter to stream chan recver
-		rch, err = rcs.proxy.flowController.NewFlowSender(ch, credit)
+		rch, err = rcs.proxy.flowController.NewFlowSender(ch, credit, rcs.proxy)
 		if err != nil {
-			rcs.router.Log(LOG_INFO, fmt.Sprintf("fail to add flow sender: %v %v", rid, credit))
+			rcs.router.Logf(LOG_INFO, "fail to add flow sender: %v %v", rid, credit)
 			return
 		}
-		rcs.router.Log(LOG_INFO, fmt.Sprintf("add flow sender: %v %v", rid, credit))
+		rcs.router.Logf(LOG_INFO, "add flow sender: %v %v", rid, credit)
 	}
-	routCh, err := rt.AttachRecvChan(rid, rch.Interface())
+	routCh, err := rt.AttachRecvChan(rid, rch.Interface(), append(args, rcs.proxy)...)
 	if err != nil {
 		return
 	}
 	rcs.chans[rid.Key()] = routCh
-	rcs.router.Log(LOG_INFO, fmt.Sprintf("add recver for %v", rid))
+	rcs.router.LogId(LOG_INFO, rid, "add recver")
 	return
 }
 
@@ -129,30 +129,58 @@ func (scs *sendChanSet) AddSender(id Id, chanType reflect.Type) (err error) {
 		buflen = DefCmdChanBufSize
 	}
 	var sch Channel
-	sch = reflect.MakeChan(chanType, buflen)
 	if sid.SysIdIndex() >= 0 { 
 		//NO flow control for sys chans, make it unlimited buffered
 		//so that it will not block namespace change propogating goroutine
-		sch = &asyncChan{Channel:sch}
-		scs.router.Log(LOG_INFO, fmt.Sprintf("add async recver: %v", sid))
-	} else if !scs.router.async && scs.proxy.flowController != nil {
+		sch = &asyncChan{Channel: reflect.MakeChan(chanType, buflen)}
+		scs.router.Logf(LOG_INFO, "add async recver: %v", sid)
+	} else {
+		//app msgs from peer come bare or wrapped in envelopes
+		sch = newPeerChan(chanType, buflen)
+	}
+	if sid.SysIdIndex() < 0 && !scs.router.async && scs.proxy.flowController != nil {
 		//attach flow control adapters for stream send chans
 		sch, err = scs.proxy.flowController.NewFlowRecver(
 			sch,
 			func(n int) {
-				scs.proxy.peer.sendCtrlMsg(&genericMsg{rt.SysID(ReadyId), &ConnReadyMsg{[]*ChanReadyInfo{&ChanReadyInfo{sid, n}}}})
-			})
+				scs.proxy.peer.sendCtrlMsg(&genericMsg{rt.SysID(ReadyId), &ConnReadyMsg{[]*ChanReadyInfo{&ChanReadyInfo{Id: sid, Credit: n}}}})
+			},
+			func(acked, window int) {
+				scs.proxy.peer.sendCtrlMsg(&genericMsg{rt.SysID(ReadyId), &ConnReadyMsg{[]*ChanReadyInfo{&ChanReadyInfo{Id: sid, Credit: acked, Window: window}}}})
+			},
+			func(rate float64, burst int) {
+				scs.proxy.peer.sendCtrlMsg(&genericMsg{rt.SysID(ReadyId), &ConnReadyMsg{[]*ChanReadyInfo{&ChanReadyInfo{Id: sid, Rate: rate, Burst: burst}}}})
+			},
+			scs.proxy)
 		if err != nil {
 			return
 		}
-		scs.router.Log(LOG_INFO, fmt.Sprintf("add flow recver: %v", sid))
+		switch fr := sch.(type) {
+		case *xOnOffFlowRecver:
+			fr.Channel.(*asyncChan).expired = rt.queueExpiry(sid)
+		case *creditFlowRecver:
+			//expired msgs are consumed, so their credits are returned to sender
+			expired := rt.queueExpiry(sid)
+			fr.Channel.(*asyncChan).expired = func(v reflect.Value, queued int64) bool {
+				if expired(v, queued) {
+					fr.consume()
+					return true
+				}
+				return false
+			}
+		}
+		scs.router.Logf(LOG_INFO, "add flow recver: %v", sid)
+	}
+	if sid.SysIdIndex() < 0 && scs.proxy.clientRate != nil {
+		//msgs from broker client are bound by its rate
+		sch = &clientRateChan{sch, scs.proxy.clientRate}
 	}
-	routCh, err := rt.AttachSendChan(sid, sch.Interface())
+	routCh, err := rt.AttachSendChan(sid, sch.Interface(), chanType, scs.proxy)
 	if err != nil {
 		return
 	}
 	scs.chans[sid.Key()] = routCh
-	scs.router.Log(LOG_INFO, fmt.Sprintf("add sender for %v", sid))
+	scs.router.LogId(LOG_INFO, sid, "add sender")
 	return
 }
 
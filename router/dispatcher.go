@@ -7,6 +7,7 @@
 package router
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
 	"time"
@@ -43,6 +44,22 @@ func (f PolicyFunc) NewDispatcher() Dispatcher {
 	return f()
 }
 
+//namedPolicy gives a PolicyFunc a name, shown when inspecting router
+type namedPolicy struct {
+	PolicyFunc
+	name string
+}
+
+func (p *namedPolicy) String() string { return p.name }
+
+//return name of policy if it has one, or its type name
+func policyName(p DispatchPolicy) string {
+	if sp, ok := p.(fmt.Stringer); ok {
+		return sp.String()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
 /*
  simple dispatching algorithms which are the base of more practical ones:
  broadcast, roundrobin, etc
@@ -56,19 +73,21 @@ func Broadcast(v reflect.Value, recvers []*RoutedChan) {
 }
 
 //BroadcastPolicy is used to generate broadcast dispatcher instances
-var BroadcastPolicy DispatchPolicy = PolicyFunc(func() Dispatcher { return DispatchFunc(Broadcast) })
+var BroadcastPolicy DispatchPolicy = &namedPolicy{PolicyFunc(func() Dispatcher { return DispatchFunc(Broadcast) }), "BroadcastPolicy"}
 
 //KeepLastBroadcast never block. if running out of Chan buffer, drop old items and keep the latest items
 func KeepLatestBroadcast(v reflect.Value, recvers []*RoutedChan) {
 	for _, rc := range recvers {
 		for !rc.TrySend(v) {
-			rc.TryRecv()
+			if _, ok := rc.TryRecv(); ok {
+				rc.countDrop()
+			}
 		}
 	}
 }
 
 //KeepLatestBroadcastPolicy is used to generate KeepLatest broadcast dispatcher instances
-var KeepLatestBroadcastPolicy DispatchPolicy = PolicyFunc(func() Dispatcher { return DispatchFunc(KeepLatestBroadcast) })
+var KeepLatestBroadcastPolicy DispatchPolicy = &namedPolicy{PolicyFunc(func() Dispatcher { return DispatchFunc(KeepLatestBroadcast) }), "KeepLatestBroadcastPolicy"}
 
 //Roundrobin dispatcher will keep the "next" index as its state
 type Roundrobin int
@@ -84,13 +103,15 @@ func (r *Roundrobin) Dispatch(v reflect.Value, recvers []*RoutedChan) {
 			break
 		}
 		if *r == start {
+			//all recvers busy
+			rc.countDrop()
 			break
 		}
 	}
 }
 
 //RoundRobinPolicy is ued to generate roundrobin dispatchers
-var RoundRobinPolicy DispatchPolicy = PolicyFunc(func() Dispatcher { return NewRoundrobin() })
+var RoundRobinPolicy DispatchPolicy = &namedPolicy{PolicyFunc(func() Dispatcher { return NewRoundrobin() }), "RoundRobinPolicy"}
 
 //Random dispatcher
 type RandomDispatcher rand.Rand
@@ -109,4 +130,4 @@ func (rd *RandomDispatcher) Dispatch(v reflect.Value, recvers []*RoutedChan) {
 }
 
 //RandomPolicy is used to generate random dispatchers
-var RandomPolicy DispatchPolicy = PolicyFunc(func() Dispatcher { return NewRandomDispatcher() })
+var RandomPolicy DispatchPolicy = &namedPolicy{PolicyFunc(func() Dispatcher { return NewRandomDispatcher() }), "RandomPolicy"}
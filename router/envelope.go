@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+/*
+ Envelope is an optional wrapper carrying meta data along with an app msg.
+ Plain typed chans always send and recv bare values; recvers (and senders)
+ opt in by attaching a "chan *Envelope" instead, e.g.
+
+    envChan := make(chan *router.Envelope)
+    rot.AttachRecvChan(router.StrID("/quotes"), envChan, reflect.TypeOf(make(chan float64)))
+
+ the optional reflect.Type argument is the chan type of the bare msgs at this id;
+ it can be omitted if there are already typed chans attached to the same id.
+ When a send chan has recvers which want envelopes, router wraps the bare msgs
+ at the send chan, so Origin and Timestamp record where and when msgs are sent.
+ Envelopes are forwarded thru proxies and streams to connected routers.
+ The same envelope may be delivered to several recvers, so it should be treated as read only.
+ Deadline is absolute time, so clocks of connected routers should be in sync for it to work across them.
+*/
+type Envelope struct {
+	Origin        string            //name of router where the msg is sent
+	Timestamp     int64             //send time in UnixNano
+	Deadline      int64             //msg is dropped if not delivered by this time in UnixNano; 0 for no deadline
+	CorrelationId string            //app defined id to correlate requests and replies
+	Trace         TraceContext      //trace context propagated with msg
+	Headers       map[string]string //app defined headers
+	Data          interface{}       //the bare msg
+}
+
+//TraceContext identifies the trace and the span a msg belongs to
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+}
+
+func (tc TraceContext) IsValid() bool {
+	return len(tc.TraceId) > 0
+}
+
+func (env *Envelope) String() string {
+	return fmt.Sprintf("[%s %v %s] %v", env.Origin, env.Timestamp, env.CorrelationId, env.Data)
+}
+
+func (env *Envelope) expired(now int64) bool {
+	return env.Deadline > 0 && now > env.Deadline
+}
+
+//header returns a copy of envelope without its data, for marshaling before data
+func (env *Envelope) header() *Envelope {
+	hdr := *env
+	hdr.Data = nil
+	return &hdr
+}
+
+var (
+	envelopeType        = reflect.TypeOf(&Envelope{})
+	envelopeChanType    = reflect.TypeOf(make(chan *Envelope))
+	genericMsgChanType  = reflect.TypeOf(make(chan *genericMsg))
+	errEnvelopeChanType = "missing chan type for envelope chan"
+)
+
+func isEnvelope(v reflect.Value) bool {
+	return v.IsValid() && v.Type() == envelopeType
+}
+
+//unwrapEnvelope returns the bare msg inside envelope, checked against the elem type of recv chan
+func unwrapEnvelope(v reflect.Value, elemType reflect.Type) (reflect.Value, error) {
+	env := v.Interface().(*Envelope)
+	if env.Data == nil {
+		return reflect.Zero(elemType), nil
+	}
+	dv := reflect.ValueOf(env.Data)
+	if !dv.Type().AssignableTo(elemType) {
+		return dv, errors.New(fmt.Sprintf("%s: envelope data [%v] for chan of %v", errChanTypeMismatch, dv.Type(), elemType))
+	}
+	return dv, nil
+}
+
+/*
+ envelopeChan adapts an external "chan *Envelope" to Channel interface:
+ Type() reports the chan type of bare msgs, so it can be attached together
+ with plain typed chans and exported to remote routers; Send() wraps bare
+ msgs into envelopes. Interface() returns the external chan, so it can be
+ detached by it.
+*/
+type envelopeChan struct {
+	Channel  //the external chan *Envelope
+	chanType reflect.Type
+}
+
+func newEnvelopeChan(ch reflect.Value, chanType reflect.Type) *envelopeChan {
+	return &envelopeChan{ch, chanType}
+}
+
+func (ec *envelopeChan) Type() reflect.Type { return ec.chanType }
+
+func (ec *envelopeChan) wrap(v reflect.Value) reflect.Value {
+	if isEnvelope(v) {
+		return v
+	}
+	return reflect.ValueOf(&Envelope{Timestamp: time.Now().UnixNano(), Data: v.Interface()})
+}
+
+func (ec *envelopeChan) Send(v reflect.Value) {
+	ec.Channel.Send(ec.wrap(v))
+}
+
+func (ec *envelopeChan) TrySend(v reflect.Value) bool {
+	return ec.Channel.TrySend(ec.wrap(v))
+}
+
+/*
+ peerChan carries msgs from peer into local router at proxies: bare msgs are
+ passed as they are and msgs which came after envelope headers as *Envelope,
+ so no envelope is made for msgs peer sent without one. Type() reports the chan
+ type of bare msgs, so it is type checked as a plain chan.
+*/
+type peerChan struct {
+	Channel  //chan interface{}
+	chanType reflect.Type
+}
+
+var anyValueChanType = reflect.TypeOf(make(chan interface{}))
+
+func newPeerChan(chanType reflect.Type, buflen int) *peerChan {
+	return &peerChan{reflect.MakeChan(anyValueChanType, buflen), chanType}
+}
+
+func (pc *peerChan) Type() reflect.Type { return pc.chanType }
+
+func (pc *peerChan) Interface() interface{} { return pc }
+
+func (pc *peerChan) Recv() (reflect.Value, bool) {
+	v, ok := pc.Channel.Recv()
+	if ok {
+		v = v.Elem()
+	}
+	return v, ok
+}
+
+func (pc *peerChan) TryRecv() (reflect.Value, bool) {
+	v, ok := pc.Channel.TryRecv()
+	if ok {
+		v = v.Elem()
+	}
+	return v, ok
+}
+
+//envelopeChanType find the chan type of bare msgs for an envelope chan attached to id:
+//either from the optional argument or from the chans already attached to id
+func (s *routerImpl) envelopeChanType(id Id, t reflect.Type) (reflect.Type, error) {
+	if t != nil {
+		if t.Kind() != reflect.Chan {
+			return nil, errors.New(errInvalidChan)
+		}
+		return t, nil
+	}
+	s.tblLock.Lock()
+	defer s.tblLock.Unlock()
+	if ent, ok := s.routingTable[id.Key()]; ok {
+		return ent.chanType, nil
+	}
+	return nil, errors.New(fmt.Sprintf("%s: %v", errEnvelopeChanType, id))
+}
@@ -0,0 +1,250 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ FileSink writes LogRecords or FaultRecords received from an id in router
+ to a file as JSON lines, one record per line. To aggregate the log of all
+ connected routers at a central router, attach it with ScopeGlobal and connect
+ the routers with ExportRecords, e.g.
+
+    f, _ := router.NewRotatingFile("/var/log/router.log", 10<<20, 24*time.Hour, 7, 30*24*time.Hour)
+    sink := router.NewFileLogSink(rot.NewSysID(router.RouterLogId, router.ScopeGlobal), rot, f)
+    rot.ConnectRemote(conn, router.GobMarshaling, router.ExportRecords)
+*/
+type FileSink struct {
+	recvChan reflect.Value
+	sinkExit chan bool
+	w        io.Writer
+	id       Id
+	r        Router
+}
+
+//json view of LogRecord and FaultRecord
+type fileRecord struct {
+	Time   string            `json:"time"`
+	Pri    string            `json:"pri,omitempty"`
+	Source string            `json:"source"`
+	Info   string            `json:"info"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+}
+
+//create a file sink which receives LogRecords from id in router "r" and writes them to w
+func NewFileLogSink(id Id, r Router, w io.Writer) *FileSink {
+	return newFileSink(id, r, w, make(chan *LogRecord, DefLogBufSize))
+}
+
+//create a file sink which receives FaultRecords from id in router "r" and writes them to w
+func NewFileFaultSink(id Id, r Router, w io.Writer) *FileSink {
+	return newFileSink(id, r, w, make(chan *FaultRecord, DefCmdChanBufSize))
+}
+
+func newFileSink(id Id, r Router, w io.Writer, ch interface{}) *FileSink {
+	l := &FileSink{w: w, id: id, r: r}
+	l.sinkExit = make(chan bool)
+	_, err := r.AttachRecvChan(id, ch)
+	if err != nil {
+		log.Println("*** failed to enable router's file sink ***")
+		return l
+	}
+	l.recvChan = reflect.ValueOf(ch)
+	go func() {
+		enc := json.NewEncoder(w)
+		for {
+			v, ok := l.recvChan.Recv()
+			if !ok {
+				break
+			}
+			if err := enc.Encode(fileRecordOf(v.Interface())); err != nil {
+				log.Println("file sink failed to write record: ", err)
+			}
+		}
+		l.sinkExit <- true
+	}()
+	return l
+}
+
+func fileRecordOf(rec interface{}) *fileRecord {
+	switch r := rec.(type) {
+	case *LogRecord:
+		return &fileRecord{time.Unix(0, r.Timestamp).Format(time.RFC3339Nano), r.Pri.String(), r.Source, fmt.Sprint(r.Info), r.Attrs}
+	case *FaultRecord:
+		return &fileRecord{Time: time.Unix(0, r.Timestamp).Format(time.RFC3339Nano), Source: r.Source, Info: fmt.Sprint(r.Info)}
+	}
+	return nil
+}
+
+//detach from router, wait for queued records written and close the writer if it is a io.Closer
+func (l *FileSink) Close() {
+	if l.recvChan.IsValid() {
+		l.r.DetachChan(l.id, l.recvChan.Interface())
+		<-l.sinkExit
+	}
+	if c, ok := l.w.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+/*
+ RotatingFile is a io.WriteCloser writing to a file which is rotated when it grows
+ beyond maxSize bytes or gets older than maxAge. Rotated files are renamed with
+ their rotation time as suffix, e.g. "router.log.2012-03-04T05-06-07.000000000", and
+ only the newest maxBackups rotated files, rotated within maxBackupAge, are kept.
+ Other files in the same directory are left alone. Zero values disable
+ the corresponding rotation or retention.
+*/
+type RotatingFile struct {
+	sync.Mutex
+	path         string
+	maxSize      int64
+	maxAge       time.Duration
+	maxBackups   int
+	maxBackupAge time.Duration
+	file         *os.File
+	size         int64
+	opened       time.Time
+}
+
+const rotateTimeFormat = "2006-01-02T15-04-05.000000000"
+
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, maxBackupAge time.Duration) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, maxBackupAge: maxBackupAge}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Write(b []byte) (n int, err error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && ((rf.maxSize > 0 && rf.size+int64(len(b)) > rf.maxSize) ||
+		(rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge)) {
+		if err = rf.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = rf.file.Write(b)
+	rf.size += int64(n)
+	return
+}
+
+//Rotate closes current file, renames it and starts a new one
+func (rf *RotatingFile) Rotate() error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	backup := rf.path + "." + time.Now().Format(rotateTimeFormat)
+	renameErr := os.Rename(rf.path, backup)
+	//keep writing to the current file if it cannot be renamed
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.removeOldBackups()
+	return nil
+}
+
+//remove rotated files beyond maxBackups or older than maxBackupAge; time suffix sorts them from oldest to newest
+func (rf *RotatingFile) removeOldBackups() {
+	if rf.maxBackups <= 0 && rf.maxBackupAge <= 0 {
+		return
+	}
+	backups := rf.backups()
+	now := time.Now()
+	for i, b := range backups {
+		if (rf.maxBackups > 0 && i < len(backups)-rf.maxBackups) ||
+			(rf.maxBackupAge > 0 && now.Sub(b.rotated) > rf.maxBackupAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+type backupFile struct {
+	path    string
+	rotated time.Time
+}
+
+//rotated files of rf, from oldest to newest; only names with a rotation time suffix are ours
+func (rf *RotatingFile) backups() (backups []backupFile) {
+	dir, base := filepath.Split(rf.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	prefix := base + "."
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, err := time.ParseInLocation(rotateTimeFormat, name[len(prefix):], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{filepath.Join(dir, name), t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.Before(backups[j].rotated) })
+	return
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,225 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+)
+
+/*
+ Filters and translators of proxies can be changed while connected, thru
+ Proxy.SetFilter() and Proxy.SetTranslator(), without dropping the connection:
+ 1. local pubs/subs exported to peer are checked again: the ones blocked by new
+    filter, or translated to other ids by new translator, are unpubed/unsubed at
+    peer and their forwarding chans torn down; the ones passing now are pubed/subed
+ 2. pubs/subs of peer are kept as peer sent them, before translation and filtering,
+    and imported again thru new filter and translator; local subscribers of pub/sub
+    SysMsgs are not notified of them again
+ 3. filters and translators are replaced, not edited in place (e.g. FilterRules
+    compile their patterns once), so the old ones still tell what was exported
+ 4. in mesh mode, only filters can be changed
+ Changes made before proxy is connected take effect at connecting.
+*/
+
+func (p *proxyImpl) SetFilter(f IdFilter) error {
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+	return p.update(f, p.translator.get())
+}
+
+func (p *proxyImpl) SetTranslator(t IdTranslator) error {
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+	if p.router.mesh != nil {
+		return errors.New(errMeshTranslator)
+	}
+	return p.update(p.filter.get(), t)
+}
+
+//update replaces filter & translator and exchanges the changes of pubs/subs with peer
+func (p *proxyImpl) update(f IdFilter, t IdTranslator) error {
+	of, ot := p.filter.get(), p.translator.get()
+	p.proxyLock.Lock()
+	if p.Closed {
+		p.proxyLock.Unlock()
+		return errors.New(errProxyClosed)
+	}
+	if !p.connReady {
+		//exported ids are filtered at connecting
+		p.filter.set(f)
+		p.translator.set(t)
+		p.proxyLock.Unlock()
+		return nil
+	}
+	p.proxyLock.Unlock()
+
+	gf, gt := p.filter, p.translator
+	moved := func(id Id) bool {
+		return gt.translateOutward(ot, id).Key() != gt.translateOutward(t, id).Key()
+	}
+	outward := func(info *ChanInfo) *ChanInfo {
+		return &ChanInfo{Id: gt.translateOutward(ot, info.Id), ChanType: info.ChanType, ElemType: info.ElemType}
+	}
+	mesh := p.router.mesh
+
+	//1. with old filter & translator, drop the ids which are blocked or moved now;
+	//hold id locks (and meshLock in mesh mode) till the switch in step 2, so
+	//pubs/subs from peer are imported thru either old or new filter & translator
+	var unpubs, unsubs, goneSends, goneRecvs []*ChanInfo
+	p.outwardLock.Lock()
+	p.inwardLock.Lock()
+	if mesh == nil {
+		//in mesh mode, pubs are exported by meshTable
+		for k, pub := range p.exportSendIds {
+			if gf.blockOutward(f, pub.Id) || moved(pub.Id) {
+				delete(p.exportSendIds, k)
+				if p.appRecvChans.BindingCount(pub.Id) >= 0 {
+					p.appRecvChans.DelChan(pub.Id)
+				}
+				unpubs = append(unpubs, outward(pub))
+			}
+		}
+	}
+	for _, raw := range p.peerRecvIds {
+		id := gt.translateInward(ot, raw.Id)
+		sub, ok := p.importRecvIds[id.Key()]
+		if !ok {
+			continue
+		}
+		id1 := gt.translateInward(t, raw.Id)
+		if id1.Key() == id.Key() && !gf.blockOutward(f, id1) {
+			continue
+		}
+		delete(p.importRecvIds, id.Key())
+		if p.appRecvChans.BindingCount(sub.Id) >= 0 {
+			p.appRecvChans.DelChan(sub.Id)
+		}
+		goneRecvs = append(goneRecvs, &ChanInfo{Id: sub.Id, ChanType: sub.ChanType, ElemType: sub.ElemType})
+	}
+	for k, sub := range p.exportRecvIds {
+		if gf.blockInward(f, sub.Id) || moved(sub.Id) {
+			delete(p.exportRecvIds, k)
+			if pub, ok := p.importSendIds[k]; ok && p.appSendChans.BindingCount(pub.Id) >= 0 {
+				p.appSendChans.DelChan(pub.Id)
+			}
+			unsubs = append(unsubs, outward(sub))
+		}
+	}
+	for _, raw := range p.peerSendIds {
+		id := gt.translateInward(ot, raw.Id)
+		pub, ok := p.importSendIds[id.Key()]
+		if !ok {
+			continue
+		}
+		id1 := gt.translateInward(t, raw.Id)
+		if id1.Key() == id.Key() && !gf.blockInward(f, id1) {
+			continue
+		}
+		delete(p.importSendIds, id.Key())
+		if p.appSendChans.BindingCount(pub.Id) >= 0 {
+			p.appSendChans.DelChan(pub.Id)
+		}
+		goneSends = append(goneSends, &ChanInfo{Id: pub.Id, ChanType: pub.ChanType, ElemType: pub.ElemType})
+	}
+	//routes from peer in mesh mode, translator is not changed
+	var unroutes, reroutes []*ChanInfo
+	if mesh != nil {
+		p.meshLock.Lock()
+		for _, raw := range p.peerRoutes {
+			id := gt.translateInward(t, raw.Id)
+			switch blocked := gf.blockInward(f, id); {
+			case blocked && !gf.blockInward(of, id):
+				unroutes = append(unroutes, &ChanInfo{Id: id, ElemType: raw.ElemType, Path: raw.Path})
+			case !blocked && gf.blockInward(of, id):
+				reroutes = append(reroutes, &ChanInfo{Id: raw.Id, ChanType: raw.ChanType, ElemType: raw.ElemType, Path: raw.Path})
+			}
+		}
+	}
+
+	//2. switch to new filter & translator
+	p.filter.set(f)
+	p.translator.set(t)
+	if mesh != nil {
+		p.meshLock.Unlock()
+	}
+	p.inwardLock.Unlock()
+	p.outwardLock.Unlock()
+	p.Logf(LOG_INFO, "filter/translator changed, unpub [%d], unsub [%d], peer unpub [%d], peer unsub [%d]",
+		len(unpubs), len(unsubs), len(goneSends), len(goneRecvs))
+
+	//3. tell peer and local subscribers of ids not exchanged any more
+	r := p.router
+	if len(unsubs) > 0 {
+		p.peer.sendCtrlMsg(&genericMsg{r.SysID(UnSubId), &ChanInfoMsg{unsubs}})
+	}
+	if len(unpubs) > 0 {
+		p.peer.sendCtrlMsg(&genericMsg{r.SysID(UnPubId), &ChanInfoMsg{unpubs}})
+	}
+	if len(goneRecvs) > 0 {
+		p.sysChans.SendSysMsg(UnSubId, &ChanInfoMsg{goneRecvs})
+	}
+	if len(goneSends) > 0 {
+		p.sysChans.SendSysMsg(UnPubId, &ChanInfoMsg{goneSends})
+	}
+	for _, info := range unroutes {
+		mesh.post(&meshEvent{kind: unrouteEvent, proxy: p, info: info, path: append(append([]string(nil), info.Path...), p.peerMeshId)})
+	}
+
+	//4. import pubs/subs of peer passing now
+	if mesh != nil {
+		if len(reroutes) > 0 {
+			p.handlePeerMeshPubMsg(reroutes, true)
+		}
+	} else {
+		var pubs, subs []*ChanInfo
+		p.outwardLock.Lock()
+		for _, raw := range p.peerRecvIds {
+			if _, ok := p.importRecvIds[gt.translateInward(t, raw.Id).Key()]; !ok {
+				subs = append(subs, &ChanInfo{Id: raw.Id, ChanType: raw.ChanType, ElemType: raw.ElemType})
+			}
+		}
+		p.outwardLock.Unlock()
+		p.inwardLock.Lock()
+		for _, raw := range p.peerSendIds {
+			if _, ok := p.importSendIds[gt.translateInward(t, raw.Id).Key()]; !ok {
+				pubs = append(pubs, &ChanInfo{Id: raw.Id, ChanType: raw.ChanType, ElemType: raw.ElemType})
+			}
+		}
+		p.inwardLock.Unlock()
+		//local subscribers were notified when peer sent these, so import them only
+		var err error
+		if len(subs) > 0 {
+			_, err = p.handlePeerSubMsg(&genericMsg{r.SysID(SubId), &ChanInfoMsg{subs}})
+		}
+		if err == nil && len(pubs) > 0 {
+			_, err = p.handlePeerPubMsg(&genericMsg{r.SysID(PubId), &ChanInfoMsg{pubs}})
+		}
+		if err != nil {
+			p.peerMsgFailed(err)
+			return err
+		}
+	}
+
+	//5. export local pubs/subs passing now
+	switch {
+	case mesh != nil:
+		mesh.post(&meshEvent{kind: localEvent})
+	case r.broker != nil:
+		r.broker.post(&brokerEvent{kind: clientChange})
+	default:
+		p.applyLocalCtrlMsg(&genericMsg{r.SysID(PubId), &ChanInfoMsg{chanInfoList(r.idsForSend(p.exportedId))}})
+		p.applyLocalCtrlMsg(&genericMsg{r.SysID(SubId), &ChanInfoMsg{chanInfoList(r.idsForRecv(p.exportedId))}})
+	}
+	return nil
+}
+
+func chanInfoList(ids map[interface{}]*ChanInfo) (info []*ChanInfo) {
+	for _, v := range ids {
+		info = append(info, v)
+	}
+	return
+}
@@ -16,6 +16,7 @@ package router
  only involved in processing namespace change msgs: PubId/SubId
  4. by default, if no filter is defined, everything is allowed
  5. filters are used against ids in local namespace, not translated ones
+ 6. filter of a connected proxy can be replaced by Proxy.SetFilter()
 */
 type IdFilter interface {
 	BlockInward(Id) bool
@@ -32,6 +33,7 @@ type IdFilter interface {
  3. only translate the ids of application msgs (NOT system msgs), and it will affect the
  ids of every app msgs passed thru this proxy - must be highly efficient
  4. by default, if no translator is defined, no translation
+ 5. translator of a connected proxy can be replaced by Proxy.SetTranslator()
 */
 type IdTranslator interface {
 	TranslateInward(Id) Id
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"reflect"
 	"sync"
+	"time"
 )
 
 /*
@@ -39,6 +40,31 @@ type FlowRecver interface {
 	Channel
 }
 
+//CumulativeAcker is implemented by FlowSenders which accept cumulative acks:
+//the total number of msgs consumed at recver, with current window size
+type CumulativeAcker interface {
+	AckCumulative(acked, window int)
+}
+
+/*
+ FlowConn is passed to NewFlowSender() / NewFlowRecver() as the last argument, so
+ policies can keep state shared by all flow controlled chans of a connection.
+ FlowState returns the state of policy, created by newState at first call.
+*/
+type FlowConn interface {
+	FlowState(policy FlowControlPolicy, newState func() interface{}) interface{}
+}
+
+//find FlowConn in arguments of flow sender/recver constructors
+func flowConnOf(args []interface{}) FlowConn {
+	for _, a := range args {
+		if fc, ok := a.(FlowConn); ok {
+			return fc
+		}
+	}
+	return nil
+}
+
 /*
  WindowFlowController: simple window flow control protocol for lossless transport 
  the transport Channel between Sender, Recver should have capacity >= expected credit
@@ -303,3 +329,542 @@ func (fc *xOnOffFlowRecver) TryRecv() (v reflect.Value, ok bool) {
 func (fc *xOnOffFlowRecver) Interface() interface{} {
 	return fc
 }
+
+/*
+ Credit based flow control with cumulative acks and dynamic windows.
+ Recver acks in batches (a quarter of window) with the total number of msgs consumed
+ and its current window size, thru ReadyId msgs; sender can have at most "window"
+ msgs unacked. Recver sizes the window to cover its consumer's rate during a round
+ trip, measured as the time from an ack releasing a blocked sender to the arrival
+ of the next msg. The window grows (at most doubling per ack) when sender is
+ blocked by it, and shrinks when consumer falls behind and msgs pile up at recver.
+ Windows are kept in [MinWindow, MaxWindow]; the sum of windows of all chans of a
+ connection are limited by ConnWindow, 0 for no limit. Initial window is the buffer
+ size of recv chans.
+*/
+type CreditFlowControlPolicy struct {
+	MinWindow  int
+	MaxWindow  int
+	ConnWindow int
+}
+
+var CreditFlowController FlowControlPolicy = &CreditFlowControlPolicy{MinWindow: 4, MaxWindow: 4096, ConnWindow: 65536}
+
+func (cfp *CreditFlowControlPolicy) NewFlowSender(ch Channel, args ...interface{}) (FlowSender, error) {
+	credit := 0
+	if len(args) > 0 {
+		credit, _ = args[0].(int)
+	}
+	if credit <= 0 {
+		return nil, errors.New("CreditFlowController: invalid credit")
+	}
+	fc := &creditFlowSender{Channel: ch, window: credit}
+	fc.cond = sync.NewCond(&fc.lock)
+	return fc, nil
+}
+
+func (cfp *CreditFlowControlPolicy) NewFlowRecver(ch Channel, ack func(int), args ...interface{}) (FlowRecver, error) {
+	var ackWin func(int, int)
+	for _, a := range args {
+		if f, ok := a.(func(int, int)); ok {
+			ackWin = f
+		}
+	}
+	if ackWin == nil {
+		return nil, errors.New("CreditFlowController: missing cumulative ack callback")
+	}
+	fc := &creditFlowRecver{ackWin: ackWin, policy: cfp}
+	//window may grow beyond chan buffer, so recver never blocks the stream
+	fc.Channel = &asyncChan{Channel: ch}
+	fc.window = ch.Cap()
+	if fc.window < cfp.MinWindow {
+		fc.window = cfp.MinWindow
+	}
+	fc.limit = fc.window
+	if conn := flowConnOf(args); conn != nil && cfp.ConnWindow > 0 {
+		fc.budget = conn.FlowState(cfp, func() interface{} { return &creditBudget{limit: cfp.ConnWindow} }).(*creditBudget)
+		fc.budget.reserve(fc.window, fc.window)
+	}
+	fc.rateStart = time.Now()
+	return fc, nil
+}
+
+func (cfp *CreditFlowControlPolicy) String() string {
+	return "CreditFlowControlPolicy"
+}
+
+//creditBudget limits the sum of windows of a connection
+type creditBudget struct {
+	sync.Mutex
+	limit int
+	used  int
+}
+
+//reserve up to n for window, at least min, return the amount reserved
+func (b *creditBudget) reserve(n, min int) int {
+	b.Lock()
+	defer b.Unlock()
+	if free := b.limit - b.used; n > free {
+		n = free
+	}
+	if n < min {
+		n = min
+	}
+	b.used += n
+	return n
+}
+
+func (b *creditBudget) release(n int) {
+	b.Lock()
+	b.used -= n
+	b.Unlock()
+}
+
+type creditFlowSender struct {
+	Channel
+	sent   int
+	acked  int
+	window int
+	cond   *sync.Cond
+	lock   sync.Mutex
+}
+
+func (fc *creditFlowSender) Send(v reflect.Value) {
+	fc.lock.Lock()
+	for fc.sent-fc.acked >= fc.window {
+		fc.cond.Wait()
+	}
+	fc.sent++
+	fc.lock.Unlock()
+	fc.Channel.Send(v)
+}
+
+func (fc *creditFlowSender) TrySend(v reflect.Value) bool {
+	fc.lock.Lock()
+	if fc.sent-fc.acked >= fc.window {
+		fc.lock.Unlock()
+		return false
+	}
+	fc.sent++
+	fc.lock.Unlock()
+	return fc.Channel.TrySend(v)
+}
+
+//Ack adds n credits, same as window flow controller
+func (fc *creditFlowSender) Ack(n int) {
+	fc.lock.Lock()
+	fc.acked += n
+	fc.cond.Broadcast()
+	fc.lock.Unlock()
+}
+
+func (fc *creditFlowSender) AckCumulative(acked, window int) {
+	fc.lock.Lock()
+	if acked > fc.acked {
+		fc.acked = acked
+	}
+	fc.window = window
+	fc.cond.Broadcast()
+	fc.lock.Unlock()
+}
+
+func (fc *creditFlowSender) Len() int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.sent - fc.acked
+}
+
+func (fc *creditFlowSender) Cap() int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.window
+}
+
+func (fc *creditFlowSender) Interface() interface{} {
+	return fc
+}
+
+type creditFlowRecver struct {
+	Channel
+	policy *CreditFlowControlPolicy
+	ackWin func(acked, window int)
+	budget *creditBudget
+	lock   sync.Mutex
+	//counters of msgs
+	received int
+	consumed int
+	acked    int //consumed count in last ack
+	window   int
+	limit    int //sender can send up to this count, by last ack
+	//round trip measurement: an ack sent when sender used up its credits
+	rttWaitFor int //count of msg whose arrival completes measurement, 0 if none
+	rttAckTime time.Time
+	rtt        time.Duration //smoothed
+	//consumer rate measurement
+	rateStart time.Time
+	rateCount int
+	rate      float64 //smoothed msgs/sec
+}
+
+func (fc *creditFlowRecver) Send(v reflect.Value) {
+	fc.arrived()
+	fc.Channel.Send(v)
+}
+
+func (fc *creditFlowRecver) TrySend(v reflect.Value) bool {
+	fc.arrived()
+	return fc.Channel.TrySend(v)
+}
+
+func (fc *creditFlowRecver) arrived() {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.received++
+	if fc.rttWaitFor > 0 && fc.received >= fc.rttWaitFor {
+		fc.rttWaitFor = 0
+		sample := time.Since(fc.rttAckTime)
+		if fc.rtt == 0 {
+			fc.rtt = sample
+		} else {
+			fc.rtt = (7*fc.rtt + sample) / 8
+		}
+	}
+}
+
+func (fc *creditFlowRecver) Recv() (v reflect.Value, ok bool) {
+	v, ok = fc.Channel.Recv()
+	if ok {
+		fc.consume()
+	}
+	return
+}
+
+func (fc *creditFlowRecver) TryRecv() (v reflect.Value, ok bool) {
+	v, ok = fc.Channel.TryRecv()
+	if v.IsValid() && ok {
+		fc.consume()
+	}
+	return
+}
+
+//a msg is consumed (or dropped), ack in batches of a quarter window
+func (fc *creditFlowRecver) consume() {
+	fc.lock.Lock()
+	fc.consumed++
+	fc.rateCount++
+	batch := fc.window / 4
+	if batch < 1 {
+		batch = 1
+	}
+	if fc.consumed-fc.acked < batch {
+		fc.lock.Unlock()
+		return
+	}
+	fc.resize()
+	//sender blocked after using up credits, time how long it takes to resume
+	if fc.received >= fc.limit && fc.rttWaitFor == 0 {
+		fc.rttWaitFor = fc.limit + 1
+		fc.rttAckTime = time.Now()
+	}
+	fc.acked = fc.consumed
+	fc.limit = fc.acked + fc.window
+	acked, window := fc.acked, fc.window
+	fc.lock.Unlock()
+	fc.ackWin(acked, window)
+}
+
+//resize window by consumer rate and round trip time
+func (fc *creditFlowRecver) resize() {
+	now := time.Now()
+	if d := now.Sub(fc.rateStart); d >= time.Millisecond {
+		r := float64(fc.rateCount) / d.Seconds()
+		if fc.rate == 0 {
+			fc.rate = r
+		} else {
+			fc.rate = (3*fc.rate + r) / 4
+		}
+		fc.rateStart = now
+		fc.rateCount = 0
+	}
+	queued := fc.received - fc.consumed
+	want := fc.window
+	switch {
+	case queued > fc.window/2:
+		//consumer falls behind, a larger window only piles up msgs
+		want = fc.window / 2
+	case fc.received >= fc.limit && fc.rtt > 0:
+		//sender blocked by window, cover consumer rate during a round trip
+		want = int(2 * fc.rate * fc.rtt.Seconds())
+		if want > 2*fc.window {
+			want = 2 * fc.window
+		}
+	}
+	if want < fc.policy.MinWindow {
+		want = fc.policy.MinWindow
+	}
+	if fc.policy.MaxWindow > 0 && want > fc.policy.MaxWindow {
+		want = fc.policy.MaxWindow
+	}
+	if want == fc.window {
+		return
+	}
+	if fc.budget != nil {
+		if want > fc.window {
+			want = fc.window + fc.budget.reserve(want-fc.window, 0)
+		} else {
+			fc.budget.release(fc.window - want)
+		}
+	}
+	fc.window = want
+}
+
+func (fc *creditFlowRecver) Close() {
+	fc.lock.Lock()
+	if fc.budget != nil {
+		fc.budget.release(fc.window)
+		fc.budget = nil
+	}
+	fc.lock.Unlock()
+	fc.Channel.Close()
+}
+
+func (fc *creditFlowRecver) Interface() interface{} {
+	return fc
+}
+
+/*
+ Rate based flow control: token buckets limit each flow controlled chan to Rate msgs/sec,
+ with bursts of up to Burst msgs. The local limit applies to chans sending to peer; it is
+ also advertised to peer (thru ReadyId msgs) as the limit of chans recving from peer, and
+ sender uses the lower of its own and the advertised limit. The limit can be changed at
+ runtime by SetRate(), which existing senders follow at their next msg and existing recvers
+ re-advertise. A zero rate means no limit.
+*/
+type RateFlowControlPolicy struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   int
+	recvers map[*rateFlowRecver]bool
+}
+
+func NewRateFlowController(rate float64, burst int) *RateFlowControlPolicy {
+	rfp := &RateFlowControlPolicy{recvers: make(map[*rateFlowRecver]bool)}
+	rfp.rate, rfp.burst = rate, normBurst(burst)
+	return rfp
+}
+
+func normBurst(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+//Rate returns the current limit
+func (rfp *RateFlowControlPolicy) Rate() (rate float64, burst int) {
+	rfp.lock.Lock()
+	defer rfp.lock.Unlock()
+	return rfp.rate, rfp.burst
+}
+
+//SetRate changes the limit of existing and future chans, and advertises it to peers
+func (rfp *RateFlowControlPolicy) SetRate(rate float64, burst int) {
+	burst = normBurst(burst)
+	rfp.lock.Lock()
+	rfp.rate, rfp.burst = rate, burst
+	recvers := make([]*rateFlowRecver, 0, len(rfp.recvers))
+	for fr := range rfp.recvers {
+		recvers = append(recvers, fr)
+	}
+	rfp.lock.Unlock()
+	for _, fr := range recvers {
+		fr.advertise(rate, burst)
+	}
+}
+
+func (rfp *RateFlowControlPolicy) NewFlowSender(ch Channel, args ...interface{}) (FlowSender, error) {
+	fs := &rateFlowSender{Channel: ch, policy: rfp}
+	fs.localRate, fs.localBurst = rfp.Rate()
+	fs.update()
+	return fs, nil
+}
+
+func (rfp *RateFlowControlPolicy) NewFlowRecver(ch Channel, ack func(int), args ...interface{}) (FlowRecver, error) {
+	var advertise func(float64, int)
+	for _, a := range args {
+		if f, ok := a.(func(float64, int)); ok {
+			advertise = f
+		}
+	}
+	if advertise == nil {
+		return nil, errors.New("RateFlowController: missing rate advertising callback")
+	}
+	fr := &rateFlowRecver{Channel: ch, policy: rfp, advertiseFn: advertise}
+	rfp.lock.Lock()
+	rfp.recvers[fr] = true
+	rate, burst := rfp.rate, rfp.burst
+	rfp.lock.Unlock()
+	fr.advertise(rate, burst)
+	return fr, nil
+}
+
+func (rfp *RateFlowControlPolicy) String() string {
+	return "RateFlowControlPolicy"
+}
+
+//RateLimiter is implemented by FlowSenders which accept rate limits advertised by peer
+type RateLimiter interface {
+	SetPeerRate(rate float64, burst int)
+}
+
+//tokenBucket holds up to burst tokens, refilled at rate tokens/sec; rate 0 for no limit
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+//a new bucket starts full
+func (b *tokenBucket) set(rate float64, burst int) {
+	fresh := b.last.IsZero()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, burst
+	if fresh || b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 && !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+	}
+	b.last = now
+}
+
+//take a token, or return how long to wait for one
+func (b *tokenBucket) take() time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+//return a token taken for a msg which is not sent
+func (b *tokenBucket) giveBack() {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens++
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
+
+//longest sleep of a blocked sender before rechecking its limit, which may be raised
+const maxRateWait = 100 * time.Millisecond
+
+type rateFlowSender struct {
+	Channel
+	policy     *RateFlowControlPolicy
+	lock       sync.Mutex
+	bucket     tokenBucket
+	localRate  float64
+	localBurst int
+	peerRate   float64
+	peerBurst  int
+}
+
+//effective limit is the lower of local and peer's
+func (fc *rateFlowSender) update() {
+	rate, burst := fc.localRate, fc.localBurst
+	if fc.peerRate > 0 && (rate <= 0 || fc.peerRate < rate) {
+		rate = fc.peerRate
+	}
+	if fc.peerBurst > 0 && fc.peerBurst < burst {
+		burst = fc.peerBurst
+	}
+	fc.bucket.set(rate, burst)
+}
+
+//take a token, following changes of local limit by SetRate()
+func (fc *rateFlowSender) take() time.Duration {
+	rate, burst := fc.policy.Rate()
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if rate != fc.localRate || burst != fc.localBurst {
+		fc.localRate, fc.localBurst = rate, burst
+		fc.update()
+	}
+	return fc.bucket.take()
+}
+
+func (fc *rateFlowSender) SetPeerRate(rate float64, burst int) {
+	fc.lock.Lock()
+	fc.peerRate, fc.peerBurst = rate, burst
+	fc.update()
+	fc.lock.Unlock()
+}
+
+func (fc *rateFlowSender) Send(v reflect.Value) {
+	for {
+		wait := fc.take()
+		if wait == 0 {
+			break
+		}
+		if wait > maxRateWait {
+			wait = maxRateWait
+		}
+		time.Sleep(wait)
+	}
+	fc.Channel.Send(v)
+}
+
+func (fc *rateFlowSender) TrySend(v reflect.Value) bool {
+	if fc.take() > 0 {
+		return false
+	}
+	if !fc.Channel.TrySend(v) {
+		fc.lock.Lock()
+		fc.bucket.giveBack()
+		fc.lock.Unlock()
+		return false
+	}
+	return true
+}
+
+//rate flow control has no acks
+func (fc *rateFlowSender) Ack(n int) {}
+
+func (fc *rateFlowSender) Interface() interface{} {
+	return fc
+}
+
+type rateFlowRecver struct {
+	Channel
+	policy      *RateFlowControlPolicy
+	advertiseFn func(rate float64, burst int)
+}
+
+func (fc *rateFlowRecver) advertise(rate float64, burst int) {
+	fc.advertiseFn(rate, burst)
+}
+
+func (fc *rateFlowRecver) Close() {
+	fc.policy.lock.Lock()
+	delete(fc.policy.recvers, fc)
+	fc.policy.lock.Unlock()
+	fc.Channel.Close()
+}
+
+func (fc *rateFlowRecver) Interface() interface{} {
+	return fc
+}
@@ -82,10 +82,11 @@ const (
 const (
 	RouterLogId = NumSysIds + iota
 	RouterFaultId
+	EnvelopeId //marks an envelope header sent in stream before app msg
 	NumSysInternalIds
 )
 
-var sysIdxString []string = []string {"ConnId", "DisconnId", "ErrorId", "ReadyId", "PubId", "UnPubId", "SubId", "UnSubId", "RouterLogId", "RouterFaultId"}
+var sysIdxString []string = []string {"ConnId", "DisconnId", "ErrorId", "ReadyId", "PubId", "UnPubId", "SubId", "UnSubId", "RouterLogId", "RouterFaultId", "EnvelopeId"}
 
 //A function used as predicate in router.idsForSend()/idsForRecv() to find all ids in a router's
 //namespace which are exported to outside
@@ -211,8 +212,8 @@ func (id StrId) SysID(indx int, args ...int) (ssid Id, err error) {
 }
 func (id StrId) SysIdIndex() int {
 	if len(id.Val) >= 7 && StrSysIdBase == id.Val[0:6] {
-		idx := int(id.Val[6] - '0') //strconv.Atoi(id.Val[6:])
-		if idx >= 0 && idx < NumSysInternalIds {
+		idx, err := strconv.Atoi(id.Val[6:])
+		if err == nil && idx >= 0 && idx < NumSysInternalIds {
 			return idx
 		}
 	}
@@ -300,9 +301,9 @@ func (id PathId) SysID(indx int, args ...int) (ssid Id, err error) {
 	return
 }
 func (id PathId) SysIdIndex() int {
-	if len(id.Val) >= 8 && PathSysIdBase == id.Val[0:6] {
-		idx := int(id.Val[7] - '0') //strconv.Atoi(id.Val[7:])
-		if idx >= 0 && idx < NumSysInternalIds {
+	if len(id.Val) >= 8 && PathSysIdBase+"/" == id.Val[0:7] {
+		idx, err := strconv.Atoi(id.Val[7:])
+		if err == nil && idx >= 0 && idx < NumSysInternalIds {
 			return idx
 		}
 	}
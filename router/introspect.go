@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+//RouteInfo describes an entry in router's routing table: an id, its chan type
+//and the chans attached to it
+type RouteInfo struct {
+	Id       Id
+	ChanType reflect.Type
+	Senders  []*RoutedChanInfo
+	Recvers  []*RoutedChanInfo
+}
+
+//RoutedChanInfo describes a chan attached to router
+type RoutedChanInfo struct {
+	Id       Id
+	Dir      reflect.ChanDir
+	Dispatch string //name of dispatch policy, only for send chans
+	Cap      int
+	Len      int
+	Proxy    string //name of proxy if the chan is attached by proxy on behalf of peer router
+	Peers    []*PeerInfo
+}
+
+//PeerInfo describes a bound peer of an attached chan
+type PeerInfo struct {
+	Id    Id
+	Dir   reflect.ChanDir
+	Proxy string //name of proxy if peer is attached by proxy on behalf of peer router
+}
+
+func (ri *RouteInfo) String() string {
+	return fmt.Sprintf("%v_%v [senders: %d, recvers: %d]", ri.Id, ri.ChanType, len(ri.Senders), len(ri.Recvers))
+}
+
+func dirString(dir reflect.ChanDir) string {
+	switch dir {
+	case reflect.SendDir:
+		return "send"
+	case reflect.RecvDir:
+		return "recv"
+	}
+	return "invalid"
+}
+
+//return a copy of proxies attached to router
+func (s *routerImpl) proxyList() []*proxyImpl {
+	s.proxLock.Lock()
+	defer s.proxLock.Unlock()
+	proxies := make([]*proxyImpl, len(s.proxies))
+	for i, p := range s.proxies {
+		proxies[i] = p.(*proxyImpl)
+	}
+	return proxies
+}
+
+//name of proxy used in stats and inspection, unnamed proxies are named by their index
+func proxyName(i int, p *proxyImpl) string {
+	if len(p.name) > 0 {
+		return p.name
+	}
+	return fmt.Sprintf("proxy%d", i)
+}
+
+//names of proxies attached to router, to tell which proxy attached a chan
+func (s *routerImpl) proxyNames() map[*proxyImpl]string {
+	names := make(map[*proxyImpl]string)
+	for i, p := range s.proxyList() {
+		names[p] = proxyName(i, p)
+	}
+	return names
+}
+
+func (s *routerImpl) Routes(predicate func(id Id) bool) []*RouteInfo {
+	names := s.proxyNames()
+	var routes []*RouteInfo
+	var chans []*RoutedChan
+	s.tblLock.Lock()
+	for _, ent := range s.routingTable {
+		if !predicate(ent.id) {
+			continue
+		}
+		ri := &RouteInfo{Id: ent.id, ChanType: ent.chanType}
+		for _, rc := range ent.senders {
+			ri.Senders = append(ri.Senders, &RoutedChanInfo{Id: rc.Id, Dir: rc.Dir, Dispatch: policyName(rc.dispPolicy)})
+			chans = append(chans, rc)
+		}
+		for _, rc := range ent.recvers {
+			ri.Recvers = append(ri.Recvers, &RoutedChanInfo{Id: rc.Id, Dir: rc.Dir})
+			chans = append(chans, rc)
+		}
+		routes = append(routes, ri)
+	}
+	s.tblLock.Unlock()
+	//query chan state and bindings outside of tblLock
+	idx := 0
+	fill := func(infos []*RoutedChanInfo) {
+		for _, ci := range infos {
+			rc := chans[idx]
+			idx++
+			ci.Cap = rc.Cap()
+			ci.Len = rc.Len()
+			ci.Proxy = names[rc.proxy]
+			for _, peer := range rc.Peers() {
+				ci.Peers = append(ci.Peers, &PeerInfo{peer.Id, peer.Dir, names[peer.proxy]})
+			}
+		}
+	}
+	for _, ri := range routes {
+		fill(ri.Senders)
+		fill(ri.Recvers)
+	}
+	sort.Sort(routesByKey(routes))
+	return routes
+}
+
+type routesByKey []*RouteInfo
+
+func (r routesByKey) Len() int { return len(r) }
+func (r routesByKey) Less(i, j int) bool {
+	return fmt.Sprintf("%v", r[i].Id.Key()) < fmt.Sprintf("%v", r[j].Id.Key())
+}
+func (r routesByKey) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
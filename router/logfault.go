@@ -7,9 +7,11 @@
 package router
 
 import (
+	"fmt"
 	"log"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,11 +27,29 @@ var (
 	errDupAttachment         = "a channel has been attached to same id more than once"
 	errInvalidId             = "invalid id"
 	errInvalidSysId          = "invalid index for System Id"
+	errInvalidPriority       = "invalid priority"
+	errSlowConsumer          = "slow consumer, buffered msgs reach high-water mark"
+	errRecvOverflow          = "recv buffer overflow"
 
 	errConnFail            = "remote conn failed, possibly router type mismatch"
 	errConnInvalidMsg      = "remote conn failed, invalid msg transaction"
 	errRmtIdTypeMismatch   = "remote conn failed, remote router id type mismatch"
 	errRmtChanTypeMismatch = "remote conn failed, remote chan type mismatch"
+	errMeshModeMismatch    = "remote conn failed, only one of routers is in mesh mode"
+	errMeshIdConflict      = "remote conn failed, peer router has the same mesh id"
+	errMeshChanType        = "unknown chan type of id relayed in mesh"
+	errBrokerFull          = "remote conn failed, broker reaches max number of clients"
+	errBrokerChanType      = "unknown chan type of id forwarded by broker"
+	errClientLimit         = "broker client exceeds its limit"
+	errNotBroker           = "router is not in broker mode"
+	errInvalidRule         = "invalid id filter/translator rule"
+	errProxyClosed         = "proxy is closed"
+	errMeshTranslator      = "translator of proxy in mesh mode cannot be changed"
+
+	errSupervisorClosed = "supervisor closed"
+	errTaskFailed       = "supervised task failed"
+	errTaskPanic        = "supervised task panic"
+	errMaxRestarts      = "supervisor max restarts exceeded"
 	//...more
 )
 
@@ -56,12 +76,24 @@ func (lp LogPriority) String() string {
 	return "InvalidLogType"
 }
 
+//severity orders priorities for log levels: LOG_DEBUG < LOG_INFO < LOG_WARN < LOG_ERROR
+func (lp LogPriority) severity() int32 {
+	if lp == LOG_DEBUG {
+		return 0
+	}
+	if lp == LOG_INFO {
+		return 1
+	}
+	return int32(lp)
+}
+
 //LogRecord stores the log information
 type LogRecord struct {
 	Pri       LogPriority
 	Source    string
 	Info      interface{}
 	Timestamp int64
+	Attrs     map[string]string //structured attributes such as router, proxy, id; read only
 }
 
 //a LogRecord sender
@@ -69,16 +101,19 @@ type logger struct {
 	routCh  *RoutedChan
 	asyncCh Channel
 	source  string
+	attrs   map[string]string
+	minSev  int32 //records of lower severity are dropped, updated atomically
 	logChan chan *LogRecord
-	router  Router
+	router  *routerImpl
 	id      Id
 }
 
-func newlogger(id Id, r Router, src string, bufSize int) *logger {
+func newlogger(id Id, r *routerImpl, src string, attrs map[string]string, bufSize int) *logger {
 	logger := new(logger)
 	logger.id = id
 	logger.router = r
 	logger.source = src
+	logger.attrs = attrs
 	logger.logChan = make(chan *LogRecord, bufSize)
 	var err error
 	logger.routCh, err = logger.router.AttachSendChan(id, logger.logChan)
@@ -88,21 +123,36 @@ func newlogger(id Id, r Router, src string, bufSize int) *logger {
 		log.Panicln("failed to add logger for ", logger.source)
 		return nil
 	}
+	r.addLogger(logger)
 	return logger
 }
 
-func (l *logger) log(p LogPriority, msg interface{}) {
-	if l.routCh.NumPeers() == 0 {
+//check before creating records, so disabled logging costs nothing
+func (l *logger) enabled(p LogPriority) bool {
+	return p.severity() >= atomic.LoadInt32(&l.minSev) && l.routCh.NumPeers() > 0
+}
+
+func (l *logger) log(p LogPriority, id Id, msg interface{}) {
+	if !l.enabled(p) {
 		return
 	}
 
-	lr := &LogRecord{p, l.source, msg, time.Now().UnixNano()}
+	attrs := l.attrs
+	if id != nil {
+		attrs = make(map[string]string, len(l.attrs)+1)
+		for k, v := range l.attrs {
+			attrs[k] = v
+		}
+		attrs["id"] = fmt.Sprint(id.Key())
+	}
+	lr := &LogRecord{p, l.source, msg, time.Now().UnixNano(), attrs}
 	//log all log msgs asynchronously so that it will not block the sender
 	l.asyncCh.Send(reflect.ValueOf(lr))
 }
 
 func (l *logger) Close() {
 	//l.router.DetachChan(l.id, l.logChan)
+	l.router.delLogger(l)
 	l.asyncCh.Close()
 }
 
@@ -118,12 +168,23 @@ func NewLogger(id Id, r Router, src string) *Logger {
 	return new(Logger).Init(id, r, src)
 }
 
-func (l *Logger) Init(id Id, r Router, src string) *Logger {
+//Init Logger with source name src; optional attrs are key/value pairs
+//added to all LogRecords from this Logger, besides the name of router
+func (l *Logger) Init(id Id, r Router, src string, attrs ...string) *Logger {
 	l.Lock()
 	defer l.Unlock()
 	l.router = r.(*routerImpl)
 	if len(src) > 0 {
-		l.logger = newlogger(id, l.router, src, DefLogBufSize)
+		am := make(map[string]string)
+		if len(l.router.name) > 0 {
+			am["router"] = l.router.name
+		}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			if len(attrs[i+1]) > 0 {
+				am[attrs[i]] = attrs[i+1]
+			}
+		}
+		l.logger = newlogger(id, l.router, src, am, DefLogBufSize)
 	}
 	return l
 }
@@ -143,16 +204,41 @@ func (l *Logger) Log(p LogPriority, msg interface{}) {
 	l.Lock()
 	defer l.Unlock()
 	if l.logger != nil {
-		l.logger.log(p, msg)
+		l.logger.log(p, nil, msg)
+	}
+}
+
+//send a log record about id, with id added to its attributes
+func (l *Logger) LogId(p LogPriority, id Id, msg interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	if l.logger != nil {
+		l.logger.log(p, id, msg)
+	}
+}
+
+//send a log record formatted from args; formatting is skipped when the record would be dropped
+func (l *Logger) Logf(p LogPriority, format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	if l.logger != nil && l.logger.enabled(p) {
+		l.logger.log(p, nil, fmt.Sprintf(format, args...))
 	}
 }
 
+//check if log records of priority p will be sent, to avoid formatting msgs which will be dropped
+func (l *Logger) LogEnabled(p LogPriority) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.logger != nil && l.logger.enabled(p)
+}
+
 //send a log record and store error info in it
 func (l *Logger) LogError(err error) {
 	l.Lock()
 	defer l.Unlock()
 	if l.logger != nil {
-		l.logger.log(LOG_ERROR, err)
+		l.logger.log(LOG_ERROR, nil, err)
 	}
 }
 
@@ -300,6 +386,17 @@ func (l *FaultRaiser) Close() {
 	}
 }
 
+//raise a fault only if it will be handled, instead of crashing; return false if nobody handles faults
+func (r *FaultRaiser) tryRaise(msg error) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.faultRaiser == nil || r.faultRaiser.routCh.NumPeers() == 0 {
+		return false
+	}
+	r.faultRaiser.raise(msg)
+	return true
+}
+
 //raise a fault - send a FaultRecord to faultId in router
 func (r *FaultRaiser) Raise(msg error) {
 	r.Lock()
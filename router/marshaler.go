@@ -9,6 +9,7 @@ package router
 import (
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -109,6 +110,19 @@ func (jm *jsonDemarshaler) Demarshal(e interface{}) error {
 	return jm.Decode(e)
 }
 
+//skipMsg reads and drops the next value, such as a msg of an id without forwarding chan
+func skipMsg(demar Demarshaler) error {
+	switch d := demar.(type) {
+	case *gobDemarshaler:
+		var none interface{} //gob discards the value decoded into nil
+		return d.Decode(none)
+	case *jsonDemarshaler:
+		var raw json.RawMessage
+		return d.Decode(&raw)
+	}
+	return errors.New(fmt.Sprintf("cannot skip msg with %T", demar))
+}
+
 func marshalConnReadyMsg(mar Marshaler, crm *ConnReadyMsg) (err error) {
 	sz := len(crm.Info)
 	if err = mar.Marshal(sz); err != nil {
@@ -133,7 +147,9 @@ func demarshalConnReadyMsg(demar Demarshaler, id Id, crm *ConnReadyMsg) (err err
 	return demar.Demarshal(crm)
 }
 
-func marshalIdChanInfoMsg(mar Marshaler, crm *ChanInfoMsg) (err error) {
+//Path of pub/sub info is exchanged only when both sides are in mesh mode,
+//so routers not in mesh mode keep the original wire format
+func marshalIdChanInfoMsg(mar Marshaler, crm *ChanInfoMsg, withPath bool) (err error) {
 	sz := len(crm.Info)
 	if err = mar.Marshal(sz); err != nil {
 		return
@@ -141,8 +157,7 @@ func marshalIdChanInfoMsg(mar Marshaler, crm *ChanInfoMsg) (err error) {
 	for i := 0; i < sz; i++ {
 		ici := crm.Info[i]
 		if err = mar.Marshal(ici.Id); err != nil {
-			//fmt.Printf("marshalIdChanInfoMsg: failed to marshal Id=%v, err=%v\n", ici.Id, err)
-			//return
+			return
 		}
 		if ici.ElemType == nil {
 			ici.ElemType = new(chanElemTypeData)
@@ -151,14 +166,18 @@ func marshalIdChanInfoMsg(mar Marshaler, crm *ChanInfoMsg) (err error) {
 			ici.ElemType.FullName = getMsgTypeEncoding(ici.ChanType.Elem())
 		}
 		if err = mar.Marshal(ici.ElemType); err != nil {
-			//fmt.Printf("marshalIdChanInfoMsg: failed to marshal ElemType=%v, err=%v\n", ici.ElemType, err)
-			//return
+			return
+		}
+		if withPath {
+			if err = mar.Marshal(ici.Path); err != nil {
+				return
+			}
 		}
 	}
 	return
 }
 
-func demarshalIdChanInfoMsg(demar Demarshaler, id Id, crm *ChanInfoMsg) (err error) {
+func demarshalIdChanInfoMsg(demar Demarshaler, id Id, crm *ChanInfoMsg, withPath bool) (err error) {
 	num := 0
 	if err = demar.Demarshal(&num); err != nil {
 		return
@@ -169,12 +188,15 @@ func demarshalIdChanInfoMsg(demar Demarshaler, id Id, crm *ChanInfoMsg) (err err
 			id1, _ := id.Clone()
 			info[i] = &ChanInfo{Id: id1, ElemType: &chanElemTypeData{}}
 			if err = demar.Demarshal(info[i].Id); err != nil {
-				//fmt.Printf("marshalIdChanInfoMsg: failed to demarshal Id=%v, err=%v\n", info[i].Id, err)
-				//return
+				return
 			}
 			if err = demar.Demarshal(info[i].ElemType); err != nil {
-				//fmt.Printf("marshalIdChanInfoMsg: failed to demarshal ElemType=%v, err=%v\n", info[i].ElemType, err)
-				//return
+				return
+			}
+			if withPath {
+				if err = demar.Demarshal(&info[i].Path); err != nil {
+					return
+				}
 			}
 		}
 		crm.Info = info
@@ -197,3 +219,12 @@ func getMsgTypeEncoding(t reflect.Type) string {
 	b := baseType(t)
 	return fmt.Sprintf("%v.%v.%v", b.PkgPath(), b.Name(), t.Kind())
 }
+
+//on connections with MatchAnyType, a chan of interface{} matches chans of any elem type at peer,
+//its msgs are the generic values made by demarshaler, such as map[string]interface{} for json objects
+var anyChanType = reflect.TypeOf(make(chan interface{}))
+var anyElemType = getMsgTypeEncoding(anyChanType.Elem())
+
+func elemTypeMatch(name1, name2 string, anyType bool) bool {
+	return name1 == name2 || anyType && (name1 == anyElemType || name2 == anyElemType)
+}
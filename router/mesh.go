@@ -0,0 +1,638 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ MeshRouting turns on mesh mode, passed as an optional argument to New(). By default
+ routers only export their local pubs/subs to connected routers, so msgs are routed
+ one hop, and a cycle of connected routers would loop msgs if they were relayed.
+ In mesh mode routers can be connected in any topology, such as full mesh or ring,
+ and msgs are relayed thru them:
+    1. router's name is its unique id in the mesh, so a router in mesh mode must have
+       a name. Both routers of a connection must be in mesh mode, with different ids.
+    2. pub info carries the path of ids of routers it travelled from its origin.
+       Routers drop pub info whose path contains themselves, and re-export the
+       shortest route of each origin to the other connected routers.
+    3. subscriptions travel back along the chosen routes: a router asks the next hop
+       of each origin for the msgs sent there, if it has local recvers, or other routers
+       ask it for them. Routes of equal length are chosen by lower id of next hop.
+    4. msgs between routers are wrapped in envelopes whose Origin is the id of the
+       router where they were sent. Only msgs from the origins asked for are forwarded
+       to a connected router, so every subscribing router gets each msg exactly once.
+ Routers relaying msgs of an id without local chans attached to it need its chan type
+ to demarshal msgs from remote routers; they can be listed in Types.
+*/
+type MeshRouting struct {
+	Types []reflect.Type //chan types of msgs relayed thru this router
+}
+
+//a route to origin of pub: thru a proxy, or local pub if proxy is nil
+type meshRoute struct {
+	proxy *proxyImpl
+	path  []string //ids of routers from origin to next hop
+}
+
+//routing state of a pub id
+type meshEntry struct {
+	info      *ChanInfo
+	routes    map[string][]*meshRoute            //routes by origin
+	wanted    map[*proxyImpl]map[string]bool     //origins connected routers ask for
+	announced map[*proxyImpl]map[string][]string //routes exported to connected routers, by origin
+	pulled    map[*proxyImpl]string              //origins asked from connected routers
+}
+
+//kinds of routing changes
+const (
+	joinEvent = iota
+	leaveEvent
+	routeEvent
+	unrouteEvent
+	wantEvent
+	localEvent
+)
+
+type meshEvent struct {
+	kind    int
+	proxy   *proxyImpl
+	info    *ChanInfo
+	path    []string
+	origins []string
+}
+
+//meshTable keeps the routes of router in mesh mode. All routing changes are
+//handled in order in a single goroutine, which sends pub info and
+//ConnReadyMsg to connected routers.
+type meshTable struct {
+	router    *routerImpl
+	id        string
+	types     []reflect.Type
+	proxies   []*proxyImpl
+	pubs      map[interface{}]*meshEntry
+	localPubs map[interface{}]*ChanInfo
+	localSubs map[interface{}]*ChanInfo
+	//queue of routing changes
+	lock   sync.Mutex
+	cond   *sync.Cond
+	events []*meshEvent
+	closed bool
+}
+
+func newMeshTable(r *routerImpl, mr MeshRouting) *meshTable {
+	m := &meshTable{router: r, id: r.name, types: mr.Types}
+	m.pubs = make(map[interface{}]*meshEntry)
+	m.localPubs = make(map[interface{}]*ChanInfo)
+	m.localSubs = make(map[interface{}]*ChanInfo)
+	m.cond = sync.NewCond(&m.lock)
+	go m.run()
+	return m
+}
+
+func (m *meshTable) post(ev *meshEvent) {
+	m.lock.Lock()
+	if !m.closed {
+		m.events = append(m.events, ev)
+		m.cond.Signal()
+	}
+	m.lock.Unlock()
+}
+
+func (m *meshTable) run() {
+	for {
+		m.lock.Lock()
+		for len(m.events) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if m.closed {
+			m.lock.Unlock()
+			return
+		}
+		events := m.events
+		m.events = nil
+		m.lock.Unlock()
+		for _, ev := range events {
+			switch ev.kind {
+			case joinEvent:
+				m.join(ev.proxy)
+			case leaveEvent:
+				m.leave(ev.proxy)
+			case routeEvent, unrouteEvent:
+				m.route(ev.proxy, ev.info, ev.path, ev.kind == routeEvent)
+			case wantEvent:
+				m.want(ev.proxy, ev.info.Id, ev.origins)
+			case localEvent:
+				m.localChanged()
+			}
+		}
+	}
+}
+
+func (m *meshTable) Close() {
+	m.lock.Lock()
+	m.closed = true
+	m.cond.Signal()
+	m.lock.Unlock()
+}
+
+func (m *meshTable) entry(info *ChanInfo) *meshEntry {
+	k := info.Id.Key()
+	e, ok := m.pubs[k]
+	if !ok {
+		e = &meshEntry{info: &ChanInfo{Id: info.Id}}
+		e.routes = make(map[string][]*meshRoute)
+		e.wanted = make(map[*proxyImpl]map[string]bool)
+		e.announced = make(map[*proxyImpl]map[string][]string)
+		e.pulled = make(map[*proxyImpl]string)
+		m.pubs[k] = e
+	}
+	//keep the best known type info
+	if e.info.ChanType == nil && info.ChanType != nil {
+		e.info.ChanType = info.ChanType
+	}
+	if e.info.ElemType == nil || len(e.info.ElemType.FullName) == 0 {
+		switch {
+		case info.ElemType != nil && len(info.ElemType.FullName) > 0:
+			e.info.ElemType = info.ElemType
+		case e.info.ChanType != nil:
+			e.info.ElemType = &chanElemTypeData{FullName: getMsgTypeEncoding(e.info.ChanType.Elem())}
+		}
+	}
+	return e
+}
+
+//chanType finds the chan type of relayed msgs, from pub info, local chans or MeshRouting.Types
+func (m *meshTable) chanType(info *ChanInfo) reflect.Type {
+	return m.router.relayChanType(info, m.types, false)
+}
+
+//join starts exporting routes to a newly connected router
+func (m *meshTable) join(p *proxyImpl) {
+	m.proxies = append(m.proxies, p)
+	m.refreshLocal()
+	m.syncAll()
+}
+
+//leave drops routes thru a disconnected router
+func (m *meshTable) leave(p *proxyImpl) {
+	for i, q := range m.proxies {
+		if q == p {
+			m.proxies = append(m.proxies[:i], m.proxies[i+1:]...)
+			break
+		}
+	}
+	for _, e := range m.pubs {
+		for o := range e.routes {
+			e.delRoute(o, p)
+		}
+		delete(e.wanted, p)
+		delete(e.announced, p)
+		delete(e.pulled, p)
+	}
+	m.syncAll()
+}
+
+//route adds or removes a route to pub origin thru proxy p
+func (m *meshTable) route(p *proxyImpl, info *ChanInfo, path []string, add bool) {
+	k := info.Id.Key()
+	e, ok := m.pubs[k]
+	if add {
+		e = m.entry(info)
+		e.delRoute(path[0], p)
+		e.routes[path[0]] = append(e.routes[path[0]], &meshRoute{p, path})
+		p.meshImport(info)
+	} else {
+		if !ok {
+			return
+		}
+		e.delRoute(path[0], p)
+		if !e.routedBy(p) {
+			p.meshUnimport(info.Id)
+		}
+	}
+	m.sync(k, e)
+}
+
+//want records the origins a connected router asks for
+func (m *meshTable) want(p *proxyImpl, id Id, origins []string) {
+	e := m.entry(&ChanInfo{Id: id})
+	if len(origins) == 0 {
+		delete(e.wanted, p)
+	} else {
+		w := make(map[string]bool)
+		for _, o := range origins {
+			w[o] = true
+		}
+		e.wanted[p] = w
+	}
+	m.sync(id.Key(), e)
+}
+
+//localChanged updates routes after local chans attached / detached
+func (m *meshTable) localChanged() {
+	m.refreshLocal()
+	m.syncAll()
+}
+
+func (m *meshTable) refreshLocal() {
+	pubs := m.router.IdsForSend(ExportedId)
+	for k, info := range pubs {
+		if _, ok := m.localPubs[k]; !ok {
+			e := m.entry(info)
+			e.routes[m.id] = []*meshRoute{&meshRoute{}}
+		}
+	}
+	for k := range m.localPubs {
+		if _, ok := pubs[k]; !ok {
+			if e, ok := m.pubs[k]; ok {
+				delete(e.routes, m.id)
+			}
+		}
+	}
+	m.localPubs = pubs
+	m.localSubs = m.router.IdsForRecv(ExportedId)
+}
+
+func (m *meshTable) syncAll() {
+	for k, e := range m.pubs {
+		m.sync(k, e)
+	}
+}
+
+//sync exports the best routes of pub id to connected routers,
+//and asks the next hops of its origins for msgs wanted here
+func (m *meshTable) sync(k interface{}, e *meshEntry) {
+	best := make(map[string]*meshRoute)
+	for o, rs := range e.routes {
+		best[o] = shortest(rs)
+	}
+	//1. export best routes to routers which are not on them
+	for _, q := range m.proxies {
+		routes := make(map[string][]string)
+		if !q.filter.BlockOutward(e.info.Id) {
+			for o, b := range best {
+				if b.proxy != q && !onPath(b.path, q.peerMeshId) {
+					routes[o] = b.path
+				}
+			}
+		}
+		sent := e.announced[q]
+		var pubs, unpubs []*ChanInfo
+		for o, path := range sent {
+			if _, ok := routes[o]; !ok {
+				unpubs = append(unpubs, &ChanInfo{Id: e.info.Id, ElemType: e.info.ElemType, Path: path})
+			}
+		}
+		for o, path := range routes {
+			if old, ok := sent[o]; !ok || strings.Join(old, ",") != strings.Join(path, ",") {
+				pubs = append(pubs, &ChanInfo{Id: e.info.Id, ChanType: e.info.ChanType, ElemType: e.info.ElemType, Path: path})
+			}
+		}
+		if len(routes) > 0 {
+			e.announced[q] = routes
+		} else {
+			delete(e.announced, q)
+		}
+		if len(pubs) > 0 || len(unpubs) > 0 {
+			q.meshExport(e.info, pubs, unpubs, len(routes) > 0)
+		}
+	}
+	//2. ask next hops for msgs from origins wanted by local recvers or other routers
+	local := false
+	for _, sub := range m.localSubs {
+		if sub.Id.Match(e.info.Id) {
+			local = true
+			break
+		}
+	}
+	pulls := make(map[*proxyImpl][]string)
+	for o, b := range best {
+		if b.proxy == nil {
+			continue
+		}
+		need := local
+		for q, w := range e.wanted {
+			if q != b.proxy && w[o] {
+				need = true
+				break
+			}
+		}
+		if need {
+			pulls[b.proxy] = append(pulls[b.proxy], o)
+		}
+	}
+	for _, q := range m.proxies {
+		origins := pulls[q]
+		sort.Strings(origins)
+		s := strings.Join(origins, ",")
+		if e.pulled[q] == s || !q.meshPull(e.info, origins) {
+			continue
+		}
+		if len(s) > 0 {
+			e.pulled[q] = s
+		} else {
+			delete(e.pulled, q)
+		}
+	}
+	if len(e.routes) == 0 && len(e.wanted) == 0 && len(e.announced) == 0 && len(e.pulled) == 0 {
+		delete(m.pubs, k)
+	}
+}
+
+func (e *meshEntry) delRoute(origin string, p *proxyImpl) {
+	rs := e.routes[origin]
+	for i, r := range rs {
+		if r.proxy == p {
+			rs = append(rs[:i], rs[i+1:]...)
+			break
+		}
+	}
+	if len(rs) > 0 {
+		e.routes[origin] = rs
+	} else {
+		delete(e.routes, origin)
+	}
+}
+
+func (e *meshEntry) routedBy(p *proxyImpl) bool {
+	for _, rs := range e.routes {
+		for _, r := range rs {
+			if r.proxy == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//shortest route, ties broken by lower id of next hop
+func shortest(rs []*meshRoute) (best *meshRoute) {
+	for _, r := range rs {
+		switch {
+		case best == nil, len(r.path) < len(best.path):
+			best = r
+		case len(r.path) == len(best.path) && len(r.path) > 0 && r.path[len(r.path)-1] < best.path[len(best.path)-1]:
+			best = r
+		}
+	}
+	return
+}
+
+func onPath(path []string, id string) bool {
+	for _, p := range path {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+//meshOrigins is the set of origins whose msgs a connected router asks for
+type meshOrigins struct {
+	sync.RWMutex
+	origins map[string]bool
+}
+
+func (mo *meshOrigins) set(origins []string) {
+	mo.Lock()
+	defer mo.Unlock()
+	mo.origins = make(map[string]bool)
+	for _, o := range origins {
+		mo.origins[o] = true
+	}
+}
+
+//msgs without origin cannot be routed in mesh, so they are not forwarded
+func (mo *meshOrigins) has(v reflect.Value) bool {
+	if !isEnvelope(v) {
+		return false
+	}
+	mo.RLock()
+	defer mo.RUnlock()
+	return mo.origins[v.Interface().(*Envelope).Origin]
+}
+
+//in mesh or broker mode, msgs from a connected router are relayed to the others, never back to itself
+func (s *routerImpl) relayMatch(sender, recver *RoutedChan) bool {
+	return s.relayChan(sender) && s.relayChan(recver) && sender.proxy != recver.proxy
+}
+
+//chans attached by proxies in mesh or broker mode, relaying app msgs between routers
+func (s *routerImpl) relayChan(e *RoutedChan) bool {
+	return (s.mesh != nil || s.broker != nil) && e.proxy != nil && e.Id.SysIdIndex() < 0 && e.Id.Member() == MemberRemote
+}
+
+//relayChanType finds the chan type of relayed msgs, from pub/sub info, local chans or types;
+//generic msgs are relayed only if anyType is set for the connection they come from
+func (s *routerImpl) relayChanType(info *ChanInfo, types []reflect.Type, anyType bool) reflect.Type {
+	if info.ChanType != nil {
+		return info.ChanType
+	}
+	if info.ElemType == nil {
+		return nil
+	}
+	s.tblLock.Lock()
+	ent, ok := s.routingTable[info.Id.Key()]
+	s.tblLock.Unlock()
+	if ok && elemTypeMatch(getMsgTypeEncoding(ent.chanType.Elem()), info.ElemType.FullName, anyType) {
+		return ent.chanType
+	}
+	for _, t := range types {
+		if getMsgTypeEncoding(t.Elem()) == info.ElemType.FullName {
+			return t
+		}
+	}
+	if anyType && info.ElemType.FullName == anyElemType {
+		//generic msgs from peer, relayed as they are decoded
+		return anyChanType
+	}
+	return nil
+}
+
+//id of router in mesh, empty if not in mesh mode
+func (s *routerImpl) meshId() string {
+	if s.mesh == nil {
+		return ""
+	}
+	return s.mesh.id
+}
+
+//check mesh id of peer router at conn setup
+func (s *routerImpl) checkMeshPeer(peerId string) error {
+	switch {
+	case (s.mesh == nil) != (len(peerId) == 0):
+		return errors.New(errMeshModeMismatch)
+	case s.mesh != nil && peerId == s.mesh.id:
+		return errors.New(fmt.Sprintf("%s: %s", errMeshIdConflict, peerId))
+	}
+	return nil
+}
+
+//skip msgs from origins peer router does not ask for
+func (e *RoutedChan) offRoute(v reflect.Value) bool {
+	return e.meshWant != nil && !e.meshWant.has(v)
+}
+
+//origins asked by peer for msgs of id, shared by forwarding chan and ConnReadyMsg handler
+func (p *proxyImpl) meshWant(id Id) *meshOrigins {
+	p.meshLock.Lock()
+	defer p.meshLock.Unlock()
+	if p.meshWants == nil {
+		p.meshWants = make(map[interface{}]*meshOrigins)
+	}
+	mo, ok := p.meshWants[id.Key()]
+	if !ok {
+		mo = &meshOrigins{origins: make(map[string]bool)}
+		p.meshWants[id.Key()] = mo
+	}
+	return mo
+}
+
+//send ctrl msgs from mesh goroutine, unless proxy is closed
+func (p *proxyImpl) meshSend(m *genericMsg) {
+	p.proxyLock.Lock()
+	closed := p.Closed
+	p.proxyLock.Unlock()
+	if !closed {
+		p.peer.sendCtrlMsg(m)
+	}
+}
+
+//key of route from peer: pub id in peer's namespace and its origin
+type peerRoute struct {
+	key    interface{}
+	origin string
+}
+
+//handle pub info from peer in mesh mode
+func (p *proxyImpl) handlePeerMeshPubMsg(pInfo []*ChanInfo, add bool) (num int) {
+	m := p.router.mesh
+	for _, pub := range pInfo {
+		pub.Id, _ = pub.Id.Clone(ScopeLocal, MemberRemote)
+		//record and filter it under meshLock, so filter changes see it either way
+		p.meshLock.Lock()
+		if !onPath(pub.Path, m.id) {
+			p.recordPeerRoute(pub, add)
+		}
+		pub.Id = p.translator.TranslateInward(pub.Id)
+		blocked := p.filter.BlockInward(pub.Id)
+		p.meshLock.Unlock()
+		if blocked {
+			continue
+		}
+		if onPath(pub.Path, m.id) {
+			//looped back
+			continue
+		}
+		p.Logf(LOG_INFO, "handlePeerMeshPubMsg: %v %v %v", pub.Id, pub.Path, add)
+		ev := &meshEvent{kind: unrouteEvent, proxy: p, info: pub}
+		if add {
+			ev.kind = routeEvent
+		}
+		ev.path = append(append([]string(nil), pub.Path...), p.peerMeshId)
+		m.post(ev)
+		num++
+	}
+	return
+}
+
+//recordPeerRoute keeps routes from peer, so they are re-evaluated when filter changes;
+//caller holds meshLock
+func (p *proxyImpl) recordPeerRoute(pub *ChanInfo, add bool) {
+	origin := p.peerMeshId
+	if len(pub.Path) > 0 {
+		origin = pub.Path[0]
+	}
+	k := peerRoute{pub.Id.Key(), origin}
+	if !add {
+		delete(p.peerRoutes, k)
+		return
+	}
+	if p.peerRoutes == nil {
+		p.peerRoutes = make(map[peerRoute]*ChanInfo)
+	}
+	p.peerRoutes[k] = &ChanInfo{Id: pub.Id, ChanType: pub.ChanType, ElemType: pub.ElemType, Path: append([]string(nil), pub.Path...)}
+}
+
+//meshImport records pub id routed thru peer
+func (p *proxyImpl) meshImport(info *ChanInfo) {
+	p.inwardLock.Lock()
+	defer p.inwardLock.Unlock()
+	if _, ok := p.importSendIds[info.Id.Key()]; !ok {
+		p.importSendIds[info.Id.Key()] = info
+	}
+}
+
+//meshUnimport removes pub id no longer routed thru peer
+func (p *proxyImpl) meshUnimport(id Id) {
+	p.inwardLock.Lock()
+	defer p.inwardLock.Unlock()
+	delete(p.importSendIds, id.Key())
+	if p.appSendChans.BindingCount(id) >= 0 {
+		p.appSendChans.DelChan(id)
+	}
+}
+
+//meshExport sends changed routes of pub id to peer; exported tells if any route of id is still exported
+func (p *proxyImpl) meshExport(info *ChanInfo, pubs, unpubs []*ChanInfo, exported bool) {
+	k := info.Id.Key()
+	p.outwardLock.Lock()
+	_, ok := p.exportSendIds[k]
+	switch {
+	case exported && !ok:
+		//chan type is needed if forwarding chans are attached first
+		p.exportSendIds[k] = &ChanInfo{Id: info.Id, ChanType: p.router.mesh.chanType(info), ElemType: info.ElemType}
+	case !exported && ok:
+		delete(p.exportSendIds, k)
+		if p.appRecvChans.BindingCount(info.Id) >= 0 {
+			p.appRecvChans.DelChan(info.Id)
+		}
+	}
+	p.outwardLock.Unlock()
+	for _, pub := range append(pubs, unpubs...) {
+		pub.Id = p.translator.TranslateOutward(pub.Id)
+	}
+	if len(unpubs) > 0 {
+		p.meshSend(&genericMsg{p.router.SysID(UnPubId), &ChanInfoMsg{unpubs}})
+	}
+	if len(pubs) > 0 {
+		p.meshSend(&genericMsg{p.router.SysID(PubId), &ChanInfoMsg{pubs}})
+	}
+}
+
+//meshPull asks peer for msgs of id from origins; false if msgs from peer cannot be recved
+func (p *proxyImpl) meshPull(info *ChanInfo, origins []string) bool {
+	id, _ := info.Id.Clone(ScopeLocal, MemberRemote)
+	ready := &ChanReadyInfo{Id: id, Origins: origins, Reroute: true}
+	p.inwardLock.Lock()
+	if len(origins) > 0 && p.appSendChans.BindingCount(id) < 0 {
+		chanType := p.router.mesh.chanType(info)
+		if chanType == nil {
+			p.inwardLock.Unlock()
+			p.LogError(errors.New(fmt.Sprintf("%s: %v", errMeshChanType, id)))
+			return false
+		}
+		if err := p.appSendChans.AddSender(id, chanType); err != nil {
+			p.inwardLock.Unlock()
+			p.LogError(err)
+			return false
+		}
+		ready.Credit = p.router.recvChanBufSize(id)
+	}
+	p.inwardLock.Unlock()
+	ready.Id = p.translator.TranslateOutward(ready.Id)
+	p.Logf(LOG_INFO, "meshPull: %v %v", ready.Id, origins)
+	p.meshSend(&genericMsg{p.router.SysID(ReadyId), &ConnReadyMsg{[]*ChanReadyInfo{ready}}})
+	return true
+}
@@ -0,0 +1,244 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//counters kept for each id in router's routing table, updated atomically
+type idCounters struct {
+	sent      uint64 //msgs sent from send chans
+	delivered uint64 //msgs delivered into recv chans
+	dropped   uint64 //msgs dropped before delivery
+	expired   uint64 //msgs dropped because of ttl or deadline, included in dropped
+	overflows uint64 //overflows of bounded recv buffers of async router
+	binds     uint64 //bindings added between send and recv chans
+	unbinds   uint64 //bindings removed
+}
+
+//counters kept for each proxy, updated atomically
+type proxyCounters struct {
+	bytesIn       uint64
+	bytesOut      uint64
+	marshalErrs   uint64
+	demarshalErrs uint64
+	expired       uint64 //msgs expired in stream output
+	handshakeNs   int64
+}
+
+//RecverStats shows the queue state of a recv chan
+type RecverStats struct {
+	Id  Id
+	Len int
+	Cap int
+}
+
+//IdStats is a snapshot of counters for an id in router's routing table
+type IdStats struct {
+	Key       string
+	ChanType  string
+	Sent      uint64
+	Delivered uint64
+	Dropped   uint64
+	Expired   uint64
+	Overflows uint64
+	Binds     uint64
+	Unbinds   uint64
+	Recvers   []*RecverStats
+}
+
+//ProxyStats is a snapshot of counters for a proxy connected to peer router
+type ProxyStats struct {
+	Name              string
+	ConnType          string
+	Connected         bool
+	BytesIn           uint64
+	BytesOut          uint64
+	MarshalErrors     uint64
+	DemarshalErrors   uint64
+	Expired           uint64
+	HandshakeDuration time.Duration
+}
+
+//RouterStats is a snapshot of router's counters and gauges, returned by Router.Stats()
+type RouterStats struct {
+	Name      string
+	Timestamp int64
+	Ids       []*IdStats
+	Proxies   []*ProxyStats
+}
+
+func (s *routerImpl) Stats() *RouterStats {
+	st := &RouterStats{Name: s.name, Timestamp: time.Now().UnixNano()}
+	s.tblLock.Lock()
+	for _, ent := range s.routingTable {
+		if ent.id.SysIdIndex() >= 0 {
+			continue
+		}
+		is := &IdStats{Key: fmt.Sprintf("%v", ent.id.Key()), ChanType: fmt.Sprintf("%v", ent.chanType)}
+		is.Sent = atomic.LoadUint64(&ent.stats.sent)
+		is.Delivered = atomic.LoadUint64(&ent.stats.delivered)
+		is.Dropped = atomic.LoadUint64(&ent.stats.dropped)
+		is.Expired = atomic.LoadUint64(&ent.stats.expired)
+		is.Overflows = atomic.LoadUint64(&ent.stats.overflows)
+		is.Binds = atomic.LoadUint64(&ent.stats.binds)
+		is.Unbinds = atomic.LoadUint64(&ent.stats.unbinds)
+		for _, r := range ent.recvers {
+			is.Recvers = append(is.Recvers, &RecverStats{r.Id, r.Len(), r.Cap()})
+		}
+		st.Ids = append(st.Ids, is)
+	}
+	s.tblLock.Unlock()
+	sort.Sort(idStatsByKey(st.Ids))
+	for i, pi := range s.proxyList() {
+		ps := &ProxyStats{Name: proxyName(i, pi), ConnType: pi.connType()}
+		pi.proxyLock.Lock()
+		ps.Connected = pi.connReady && !pi.Closed
+		pi.proxyLock.Unlock()
+		ps.BytesIn = atomic.LoadUint64(&pi.stats.bytesIn)
+		ps.BytesOut = atomic.LoadUint64(&pi.stats.bytesOut)
+		ps.MarshalErrors = atomic.LoadUint64(&pi.stats.marshalErrs)
+		ps.DemarshalErrors = atomic.LoadUint64(&pi.stats.demarshalErrs)
+		ps.Expired = atomic.LoadUint64(&pi.stats.expired)
+		ps.HandshakeDuration = time.Duration(atomic.LoadInt64(&pi.stats.handshakeNs))
+		st.Proxies = append(st.Proxies, ps)
+	}
+	return st
+}
+
+type idStatsByKey []*IdStats
+
+func (s idStatsByKey) Len() int           { return len(s) }
+func (s idStatsByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s idStatsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//io adapters counting bytes thru stream connection
+type countingWriter struct {
+	io.Writer
+	count *uint64
+}
+
+func (cw *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.Writer.Write(b)
+	atomic.AddUint64(cw.count, uint64(n))
+	return
+}
+
+type countingReader struct {
+	io.Reader
+	count *uint64
+}
+
+func (cr *countingReader) Read(b []byte) (n int, err error) {
+	n, err = cr.Reader.Read(b)
+	atomic.AddUint64(cr.count, uint64(n))
+	return
+}
+
+/*
+ StatsHandler serves the stats of routers in Prometheus text exposition format, e.g.
+
+    http.Handle("/metrics", router.NewStatsHandler(rot1, rot2))
+*/
+type StatsHandler struct {
+	routers []Router
+}
+
+func NewStatsHandler(routers ...Router) *StatsHandler {
+	return &StatsHandler{routers}
+}
+
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	stats := make([]*RouterStats, len(h.routers))
+	for i, r := range h.routers {
+		stats[i] = r.Stats()
+	}
+	writePromStats(w, stats)
+}
+
+type promMetric struct {
+	name, kind, help string
+	idVal            func(*IdStats) float64
+	proxyVal         func(*ProxyStats) float64
+}
+
+var promMetrics = []*promMetric{
+	{name: "router_msgs_sent_total", kind: "counter", help: "Messages sent from send chans.",
+		idVal: func(s *IdStats) float64 { return float64(s.Sent) }},
+	{name: "router_msgs_delivered_total", kind: "counter", help: "Messages delivered into recv chans.",
+		idVal: func(s *IdStats) float64 { return float64(s.Delivered) }},
+	{name: "router_msgs_dropped_total", kind: "counter", help: "Messages dropped before delivery.",
+		idVal: func(s *IdStats) float64 { return float64(s.Dropped) }},
+	{name: "router_msgs_expired_total", kind: "counter", help: "Messages dropped because of ttl or deadline.",
+		idVal: func(s *IdStats) float64 { return float64(s.Expired) }},
+	{name: "router_recv_overflows_total", kind: "counter", help: "Overflows of bounded recv buffers of async router.",
+		idVal: func(s *IdStats) float64 { return float64(s.Overflows) }},
+	{name: "router_binds_total", kind: "counter", help: "Bindings added between send and recv chans.",
+		idVal: func(s *IdStats) float64 { return float64(s.Binds) }},
+	{name: "router_unbinds_total", kind: "counter", help: "Bindings removed between send and recv chans.",
+		idVal: func(s *IdStats) float64 { return float64(s.Unbinds) }},
+	{name: "router_recvers", kind: "gauge", help: "Recv chans attached.",
+		idVal: func(s *IdStats) float64 { return float64(len(s.Recvers)) }},
+	{name: "router_queue_length", kind: "gauge", help: "Msgs queued in recv chans.",
+		idVal: func(s *IdStats) float64 {
+			n := 0
+			for _, r := range s.Recvers {
+				n += r.Len
+			}
+			return float64(n)
+		}},
+	{name: "router_queue_length_max", kind: "gauge", help: "Msgs queued in the fullest recv chan.",
+		idVal: func(s *IdStats) float64 {
+			n := 0
+			for _, r := range s.Recvers {
+				if r.Len > n {
+					n = r.Len
+				}
+			}
+			return float64(n)
+		}},
+	{name: "router_proxy_bytes_in_total", kind: "counter", help: "Bytes read from proxy connection.",
+		proxyVal: func(s *ProxyStats) float64 { return float64(s.BytesIn) }},
+	{name: "router_proxy_bytes_out_total", kind: "counter", help: "Bytes written to proxy connection.",
+		proxyVal: func(s *ProxyStats) float64 { return float64(s.BytesOut) }},
+	{name: "router_proxy_marshal_errors_total", kind: "counter", help: "Marshaling errors at proxy connection.",
+		proxyVal: func(s *ProxyStats) float64 { return float64(s.MarshalErrors) }},
+	{name: "router_proxy_demarshal_errors_total", kind: "counter", help: "Demarshaling errors at proxy connection.",
+		proxyVal: func(s *ProxyStats) float64 { return float64(s.DemarshalErrors) }},
+	{name: "router_proxy_msgs_expired_total", kind: "counter", help: "Messages expired in proxy connection output.",
+		proxyVal: func(s *ProxyStats) float64 { return float64(s.Expired) }},
+	{name: "router_proxy_handshake_seconds", kind: "gauge", help: "Duration of proxy connection handshake.",
+		proxyVal: func(s *ProxyStats) float64 { return s.HandshakeDuration.Seconds() }},
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writePromStats(w io.Writer, stats []*RouterStats) {
+	for _, m := range promMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, st := range stats {
+			rn := promEscaper.Replace(st.Name)
+			if m.idVal != nil {
+				for _, is := range st.Ids {
+					fmt.Fprintf(w, "%s{router=\"%s\",id=\"%s\"} %v\n", m.name, rn, promEscaper.Replace(is.Key), m.idVal(is))
+				}
+			} else {
+				for _, ps := range st.Proxies {
+					fmt.Fprintf(w, "%s{router=\"%s\",proxy=\"%s\"} %v\n", m.name, rn, promEscaper.Replace(ps.Name), m.proxyVal(ps))
+				}
+			}
+		}
+	}
+}
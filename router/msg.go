@@ -21,6 +21,8 @@ type ChanInfo struct {
 	Id       Id
 	ChanType reflect.Type
 	ElemType *chanElemTypeData
+	//mesh mode: ids of routers the pub info travelled thru, starting from its origin
+	Path []string
 }
 
 func (ici ChanInfo) String() string {
@@ -53,12 +55,24 @@ type ConnInfoMsg struct {
 	Error    string
 	Id       Id
 	Type     string //async/flowControlled/raw
+	MeshId   string //router's id in mesh, empty if router is not in mesh mode
+	AnyType  bool   //sender connects with MatchAnyType
 }
 
 //recver-router notify sender-router which channel are ready to recv how many msgs
 type ChanReadyInfo struct {
 	Id     Id
 	Credit int
+	//window size advertised with cumulative acks, used by CreditFlowController:
+	//Credit is then the total number of msgs consumed at recver
+	Window int
+	//rate limit (msgs/sec) and burst advertised by recver, used by RateFlowControlPolicy
+	Rate  float64
+	Burst int
+	//mesh mode: when Reroute is set, Origins replaces the set of routers whose msgs
+	//recver want to get thru this connection
+	Origins []string
+	Reroute bool
 }
 
 func (cri ChanReadyInfo) String() string {
@@ -7,7 +7,6 @@
 package router
 
 import (
-	"fmt"
 	"reflect"
 	"sync"
 )
@@ -58,15 +57,22 @@ func (n *notifier) Close() {
 	}
 }
 
-func (n notifier) notify(idx int, info *ChanInfo) {
+func (n *notifier) notify(idx int, info *ChanInfo) {
 	n.Lock()
 	defer n.Unlock()
 	if n.closed {
 		return
 	}
-	n.router.Log(LOG_INFO, fmt.Sprintf("notify: %v, %v", sysIdxString[idx], info.Id))
+	if info.Id.SysIdIndex() < 0 {
+		//loggers notify their own log/fault ids when attached, so never log those
+		n.router.LogId(LOG_INFO, info.Id, "notify: "+sysIdxString[idx])
+	}
 	nc := n.notifyChans[idx-PubId]
 	if nc.routCh.NumPeers() > 0 {
+		//info is shared by all proxies, encode its type before their streams marshal it
+		if info.ElemType == nil && info.ChanType != nil {
+			info.ElemType = &chanElemTypeData{FullName: getMsgTypeEncoding(info.ChanType.Elem())}
+		}
 		nc.asyncCh.Send(reflect.ValueOf(&ChanInfoMsg{Info: []*ChanInfo{info}}))
 	}
 }
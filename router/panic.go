@@ -0,0 +1,209 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+/*
+ PanicReaction: how router reacts to panics in user code it calls: dispatch
+ policies, custom Channel implementations, IdFilters and IdTranslators.
+ Panics are recovered and reported as FaultRecords (with PanicError as Info)
+ on RouterFaultId, or logged to console if nobody handles faults.
+ It is passed as an optional argument to router.New(); by default DropOnPanic.
+*/
+type PanicReaction int
+
+const (
+	//drop the msg being dispatched; a panicking IdFilter blocks the id, a panicking IdTranslator keeps it untranslated
+	DropOnPanic PanicReaction = iota
+	//detach the chan which panics (the recv chan in delivery, or the send chan in dispatching)
+	DetachOnPanic
+	//close the proxy whose filter, translator or chans panic; panics at local chans are handled as DetachOnPanic
+	CloseProxyOnPanic
+)
+
+//PanicError records a recovered panic, with the stack where it happens
+type PanicError struct {
+	Where string
+	Value string
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %s", e.Where, e.Value)
+}
+
+//recoveredPanic is called in deferred functions after recover() to report the panic
+func recoveredPanic(l *Logger, fr *FaultRaiser, where string, r interface{}) *PanicError {
+	err := &PanicError{where, fmt.Sprint(r), string(debug.Stack())}
+	l.LogError(err)
+	if !fr.tryRaise(err) {
+		log.Printf("%v\n%s", err, err.Stack)
+	}
+	return err
+}
+
+//report a panic at routed chan and react to it
+func (s *routerImpl) chanPanic(routCh *RoutedChan, where string, r interface{}) {
+	proxy := s.reportChanPanic(routCh, where, r)
+	switch s.panicReaction {
+	case CloseProxyOnPanic:
+		if proxy != nil {
+			go proxy.Close()
+			break
+		}
+		fallthrough
+	case DetachOnPanic:
+		if routCh.Dir == reflect.SendDir {
+			//sender goroutine will detach it when its chan closed
+			routCh.Close()
+		} else {
+			routCh.Detach()
+		}
+	}
+}
+
+//report a panic at routed chan, return the proxy which attaches it if any
+func (s *routerImpl) reportChanPanic(routCh *RoutedChan, where string, r interface{}) *proxyImpl {
+	proxy := routCh.proxy
+	where = fmt.Sprintf("%s %s chan of %v", where, dirString(routCh.Dir), routCh.Id)
+	if proxy != nil {
+		recoveredPanic(&proxy.Logger, &proxy.FaultRaiser, where, r)
+	} else {
+		recoveredPanic(&s.Logger, &s.FaultRaiser, where, r)
+	}
+	return proxy
+}
+
+//closing a closed chan is expected when router and chan owners race to close it
+func closedTwice(r interface{}) bool {
+	err, ok := r.(runtime.Error)
+	return ok && err.Error() == "close of closed channel"
+}
+
+//report a panic at proxy's filter or translator and react to it
+func (p *proxyImpl) filterPanic(where string, r interface{}) {
+	recoveredPanic(&p.Logger, &p.FaultRaiser, where, r)
+	if p.router.panicReaction == CloseProxyOnPanic {
+		go p.Close()
+	}
+}
+
+//guardedFilter recovers panics in IdFilter callbacks, blocking the id;
+//sys ids always pass. user's filter is swapped at runtime by Proxy.SetFilter()
+type guardedFilter struct {
+	filter atomic.Value //userFilter
+	proxy  *proxyImpl
+}
+
+type userFilter struct{ IdFilter }
+
+func (f *guardedFilter) get() IdFilter {
+	uf, _ := f.filter.Load().(userFilter)
+	return uf.IdFilter
+}
+
+func (f *guardedFilter) set(filter IdFilter) { f.filter.Store(userFilter{filter}) }
+
+func (f *guardedFilter) BlockInward(id Id) bool { return f.blockInward(f.get(), id) }
+
+func (f *guardedFilter) BlockOutward(id Id) bool { return f.blockOutward(f.get(), id) }
+
+func (f *guardedFilter) blockInward(filter IdFilter, id Id) (block bool) {
+	if filter == nil || id.SysIdIndex() >= 0 {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			f.proxy.filterPanic(fmt.Sprintf("IdFilter.BlockInward(%v)", id), r)
+			block = true
+		}
+	}()
+	return filter.BlockInward(id)
+}
+
+func (f *guardedFilter) blockOutward(filter IdFilter, id Id) (block bool) {
+	if filter == nil || id.SysIdIndex() >= 0 {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			f.proxy.filterPanic(fmt.Sprintf("IdFilter.BlockOutward(%v)", id), r)
+			block = true
+		}
+	}()
+	return filter.BlockOutward(id)
+}
+
+//guardedTranslator recovers panics in IdTranslator callbacks, keeping the id untranslated;
+//sys ids are never translated. user's translator is swapped at runtime by Proxy.SetTranslator()
+type guardedTranslator struct {
+	translator atomic.Value //userTranslator
+	proxy      *proxyImpl
+}
+
+type userTranslator struct{ IdTranslator }
+
+func (t *guardedTranslator) get() IdTranslator {
+	ut, _ := t.translator.Load().(userTranslator)
+	return ut.IdTranslator
+}
+
+func (t *guardedTranslator) set(translator IdTranslator) {
+	t.translator.Store(userTranslator{translator})
+}
+
+func (t *guardedTranslator) TranslateInward(id Id) Id { return t.translateInward(t.get(), id) }
+
+func (t *guardedTranslator) TranslateOutward(id Id) Id { return t.translateOutward(t.get(), id) }
+
+func (t *guardedTranslator) translateInward(translator IdTranslator, id Id) (id1 Id) {
+	if translator == nil || id.SysIdIndex() >= 0 {
+		return id
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.proxy.filterPanic(fmt.Sprintf("IdTranslator.TranslateInward(%v)", id), r)
+			id1 = id
+		}
+	}()
+	return translator.TranslateInward(id)
+}
+
+func (t *guardedTranslator) translateOutward(translator IdTranslator, id Id) (id1 Id) {
+	if translator == nil || id.SysIdIndex() >= 0 {
+		return id
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.proxy.filterPanic(fmt.Sprintf("IdTranslator.TranslateOutward(%v)", id), r)
+			id1 = id
+		}
+	}()
+	return translator.TranslateOutward(id)
+}
+
+//name of user's filter or translator behind guards
+func typeName(v interface{}) string {
+	switch g := v.(type) {
+	case *guardedFilter:
+		v = g.get()
+	case *guardedTranslator:
+		v = g.get()
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,70 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ Priority classes of ids, used to schedule msgs sent to remote routers.
+ Each stream connection keeps a queue per class and its output loop serves
+ higher classes first, so bulk transfers at low priority ids do not delay
+ time critical msgs such as heartbeats, e.g.
+
+    rot.SetPriority(router.StrID("/Sys/Ctrl/Heartbeat"), router.PriorityHigh)
+
+ System ids (pub/sub, flow control, connection ctrl) are always served before app ids.
+ To avoid starvation, a class which has been passed over starvationLimit times
+ while it has queued msgs is served next.
+ Priority of an id is applied to stream connections when id is exported to them,
+ so it should be set before chans are attached to the id.
+*/
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	NumPriorities
+)
+
+const starvationLimit = 16
+
+var priorityString = [NumPriorities]string{"PriorityLow", "PriorityNormal", "PriorityHigh"}
+
+func (p Priority) String() string {
+	if p < PriorityLow || p >= NumPriorities {
+		return "InvalidPriority"
+	}
+	return priorityString[p]
+}
+
+//SetPriority sets the priority class of id, by default ids are PriorityNormal
+func (s *routerImpl) SetPriority(id Id, p Priority) {
+	if p < PriorityLow || p >= NumPriorities {
+		s.LogError(errors.New(fmt.Sprintf("%s %d for %v", errInvalidPriority, p, id)))
+		return
+	}
+	s.prioLock.Lock()
+	defer s.prioLock.Unlock()
+	if p == PriorityNormal {
+		delete(s.priorities, id.Key())
+		return
+	}
+	s.priorities[id.Key()] = p
+}
+
+func (s *routerImpl) priorityOf(id Id) Priority {
+	s.prioLock.Lock()
+	defer s.prioLock.Unlock()
+	if p, ok := s.priorities[id.Key()]; ok {
+		return p
+	}
+	return PriorityNormal
+}
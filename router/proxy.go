@@ -8,10 +8,11 @@ package router
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -30,10 +31,15 @@ type Proxy interface {
 	//Connect to a remote router thru io conn
 	//1. io.ReadWriteCloser: transport connection
 	//2. MarshalingPolicy: gob or json marshaling
-	//3. remaining args can be a FlowControlPolicy (e.g. window based or XOnOff)
+	//3. remaining args can be a FlowControlPolicy (e.g. window based, credit based or XOnOff),
+	//   a *StreamBatching and ConnOptions
 	ConnectRemote(io.ReadWriteCloser, MarshalingPolicy, ...interface{}) error
 	//close proxy and disconnect from peer
 	Close()
+	//replace IdFilter / IdTranslator while connected (nil for none); pubs/subs
+	//exchanged with peer are updated to pass thru new ones, see filterupdate.go
+	SetFilter(IdFilter) error
+	SetTranslator(IdTranslator) error
 	//query messaging interface with peer
 	LocalPubInfo() []*ChanInfo
 	LocalSubInfo() []*ChanInfo
@@ -41,6 +47,17 @@ type Proxy interface {
 	PeerSubInfo() []*ChanInfo
 }
 
+//ConnOption is an optional argument of ConnectRemote() turning on a feature of the connection
+type ConnOption int
+
+const (
+	//exchange log and fault records with peer (see records.go), it must be set at both sides
+	ExportRecords ConnOption = iota
+	//chans of interface{} at either side match chans of any msg type at the other side,
+	//for generic clients such as routerctl; it must be set at both sides
+	MatchAnyType
+)
+
 /*
  Peers are to be connected thru forwarding channels
  Proxy and Stream are peers
@@ -53,6 +70,8 @@ type peerIntf interface {
 }
 
 type proxyImpl struct {
+	//counters, keep at top for 64-bit alignment of atomic ops
+	stats proxyCounters
 	//chan for ctrl msgs from peers during connSetup
 	ctrlChan chan *genericMsg
 	//use peerIntf to forward app/ctrl msgs to peer (proxy or stream)
@@ -64,18 +83,26 @@ type proxyImpl struct {
 	appSendChans *sendChanSet //send to local router
 	appRecvChans *recvChanSet //recv from local router
 	//filter & translator & flowController
-	filter         IdFilter
-	translator     IdTranslator
+	filter         *guardedFilter
+	translator     *guardedTranslator
 	flowController FlowControlPolicy
+	//exchange log/fault records with peer, set by ExportRecords
+	exportRecords bool
+	//chans of interface{} match chans of any type, set by MatchAnyType at both sides
+	matchAnyType bool
 	//cache of export/import ids at proxy
 	exportSendIds map[interface{}]*ChanInfo //exported send ids, global publish
 	exportRecvIds map[interface{}]*ChanInfo //exported recv ids, global subscribe
 	importSendIds map[interface{}]*ChanInfo //imported send ids from peer
 	importRecvIds map[interface{}]*ChanInfo //imported recv ids from peer
+	//pub/sub ids of peer before translation & filtering, re-evaluated when they change
+	peerSendIds map[interface{}]*ChanInfo
+	peerRecvIds map[interface{}]*ChanInfo
 	//mutex to protect cache
-	inwardLock  sync.Mutex //protect exportRecvIds, importSendIds
-	outwardLock sync.Mutex //protect exportSendIds, importRecvIds
+	inwardLock  sync.Mutex //protect exportRecvIds, importSendIds, peerSendIds
+	outwardLock sync.Mutex //protect exportSendIds, importRecvIds, peerRecvIds
 	proxyLock   sync.Mutex //protect other proxy state
+	updateLock  sync.Mutex //serialize changes of filter & translator
 	//for log/debug
 	name string
 	Logger
@@ -84,6 +111,15 @@ type proxyImpl struct {
 	connReady bool
 	Closed    bool
 	errChan   chan error
+	//state of flow control policies for this connection
+	flowStates map[FlowControlPolicy]interface{}
+	//mesh mode: id of peer router and origins of msgs peer asks for, by id
+	peerMeshId string
+	meshLock   sync.Mutex
+	meshWants  map[interface{}]*meshOrigins
+	peerRoutes map[peerRoute]*ChanInfo //routes from peer before translation & filtering
+	//rate limit of msgs from client, in broker mode
+	clientRate *clientBucket
 }
 
 /*
@@ -97,8 +133,11 @@ func NewProxy(r Router, name string, f IdFilter, t IdTranslator) Proxy {
 	p := new(proxyImpl)
 	p.router = r.(*routerImpl)
 	p.name = name
-	p.filter = f
-	p.translator = t
+	//guard against panics in user callbacks
+	p.filter = &guardedFilter{proxy: p}
+	p.filter.set(f)
+	p.translator = &guardedTranslator{proxy: p}
+	p.translator.set(t)
 	//create chan for incoming ctrl msgs during connSetup
 	p.ctrlChan = make(chan *genericMsg, DefCmdChanBufSize)
 	//chans to local router
@@ -108,6 +147,11 @@ func NewProxy(r Router, name string, f IdFilter, t IdTranslator) Proxy {
 	//cache: only need to create import cache, since export cache are queried/returned from router
 	p.importSendIds = make(map[interface{}]*ChanInfo)
 	p.importRecvIds = make(map[interface{}]*ChanInfo)
+	p.peerSendIds = make(map[interface{}]*ChanInfo)
+	p.peerRecvIds = make(map[interface{}]*ChanInfo)
+	if b := p.router.broker; b != nil && b.mode.Limits.Rate > 0 {
+		p.clientRate = newClientBucket(b.mode.Limits)
+	}
 	p.router.addProxy(p)
 	ln := ""
 	if len(p.router.name) > 0 {
@@ -117,7 +161,7 @@ func NewProxy(r Router, name string, f IdFilter, t IdTranslator) Proxy {
 			ln = p.router.name + "_proxy"
 		}
 	}
-	p.Logger.Init(p.router.SysID(RouterLogId), p.router, ln)
+	p.Logger.Init(p.router.SysID(RouterLogId), p.router, ln, "proxy", p.name)
 	p.FaultRaiser.Init(p.router.SysID(RouterFaultId), p.router, ln)
 	return p
 }
@@ -133,14 +177,25 @@ func (p1 *proxyImpl) Connect(pp Proxy) error {
 }
 
 func (p *proxyImpl) ConnectRemote(rwc io.ReadWriteCloser, mar MarshalingPolicy, args ...interface{}) error {
-	if len(args) > 0 {
-		var ok bool
-		p.flowController, ok = args[0].(FlowControlPolicy)
-		if !ok {
-			return errors.New("Proxy ConnectRemote(): invalid argument for FlowControlPolicy")
+	var batching *StreamBatching
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case FlowControlPolicy:
+			p.flowController = a
+		case *StreamBatching:
+			batching = a
+		case ConnOption:
+			switch a {
+			case ExportRecords:
+				p.exportRecords = true
+			case MatchAnyType:
+				p.matchAnyType = true
+			}
+		default:
+			return errors.New("Proxy ConnectRemote(): invalid argument, neither FlowControlPolicy, *StreamBatching nor ConnOption")
 		}
 	}
-	s := newStream(rwc, mar, p)
+	s := newStream(rwc, mar, p, batching)
 	s.peer = p
 	p.peer = s
 	p.errChan = make(chan error)
@@ -151,6 +206,21 @@ func (p *proxyImpl) ConnectRemote(rwc io.ReadWriteCloser, mar MarshalingPolicy,
 
 func (p *proxyImpl) start() { go p.connInit() }
 
+//FlowConn interface: policy state is kept as long as proxy
+func (p *proxyImpl) FlowState(policy FlowControlPolicy, newState func() interface{}) interface{} {
+	p.proxyLock.Lock()
+	defer p.proxyLock.Unlock()
+	if p.flowStates == nil {
+		p.flowStates = make(map[FlowControlPolicy]interface{})
+	}
+	st, ok := p.flowStates[policy]
+	if !ok {
+		st = newState()
+		p.flowStates[policy] = st
+	}
+	return st
+}
+
 func (p *proxyImpl) Close() {
 	p.Log(LOG_INFO, "proxy.Close() is called")
 	p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(DisconnId), &ConnInfoMsg{}})
@@ -168,15 +238,18 @@ func (p *proxyImpl) closeImpl() {
 		pubInfo := p.PeerPubInfo()
 		subInfo := p.PeerSubInfo()
 		//notify local chan that remote peer is leaving (unpub, unsub)
-		p.Log(LOG_INFO, fmt.Sprintf("unpub [%d], unsub [%d]", len(pubInfo), len(subInfo)))
+		p.Logf(LOG_INFO, "unpub [%d], unsub [%d]", len(pubInfo), len(subInfo))
 		if len(pubInfo) > 0 {
-			p.Log(LOG_INFO, fmt.Sprintf("unpub info 1 [%v]", pubInfo))
+			p.Logf(LOG_INFO, "unpub info 1 [%v]", pubInfo)
 		}
 		if len(subInfo) > 0 {
-			p.Log(LOG_INFO, fmt.Sprintf("unsub info 1 [%v]", subInfo))
+			p.Logf(LOG_INFO, "unsub info 1 [%v]", subInfo)
 		}
 		p.sysChans.SendSysMsg(UnSubId, &ChanInfoMsg{subInfo})
 		p.sysChans.SendSysMsg(UnPubId, &ChanInfoMsg{pubInfo})
+		if m := p.router.mesh; m != nil {
+			m.post(&meshEvent{kind: leaveEvent, proxy: p})
+		}
 		//start closing
 		p.Log(LOG_INFO, "proxy closing")
 		p.router.delProxy(p)
@@ -187,6 +260,10 @@ func (p *proxyImpl) closeImpl() {
 		p.inwardLock.Lock()
 		p.appSendChans.Close()
 		p.inwardLock.Unlock()
+		if b := p.router.broker; b != nil {
+			//after chans are detached, so other clients' chans are not bound to them
+			b.post(&brokerEvent{kind: clientLeave, proxy: p})
+		}
 		p.Log(LOG_INFO, "proxy closed")
 		//close logger
 		p.FaultRaiser.Close()
@@ -215,16 +292,21 @@ func (p *proxyImpl) connType() string {
 func (p *proxyImpl) connSetup() error {
 	r := p.router
 	//1. to initiate conn setup handshaking, send my conn info to peer
-	p.peer.sendCtrlMsg(&genericMsg{r.SysID(ConnId), &ConnInfoMsg{Id: r.seedId, Type: p.connType()}})
+	p.peer.sendCtrlMsg(&genericMsg{r.SysID(ConnId), &ConnInfoMsg{Id: r.seedId, Type: p.connType(), MeshId: r.meshId(), AnyType: p.matchAnyType}})
 	//2. recv connInfo from peer
 	switch m := <-p.ctrlChan; m.Id.SysIdIndex() {
 	case ConnId:
 		//save peer conninfo & forward it to local subscribers
 		ci := m.Data.(*ConnInfoMsg)
 		p.sysChans.SendSysMsg(ConnId, ci)
-		//check type info
+		//check type info and mesh mode
+		var err error
 		if reflect.TypeOf(ci.Id) != reflect.TypeOf(r.seedId) || ci.Type != p.connType() {
-			err := errors.New(errRouterTypeMismatch)
+			err = errors.New(errRouterTypeMismatch)
+		} else if err = r.checkMeshPeer(ci.MeshId); err == nil {
+			err = r.checkBrokerClient(p)
+		}
+		if err != nil {
 			ci.Error = err.Error()
 			//tell local listeners about the fail
 			p.sysChans.SendSysMsg(ErrorId, ci)
@@ -233,6 +315,8 @@ func (p *proxyImpl) connSetup() error {
 			p.LogError(err)
 			return err
 		}
+		p.peerMeshId = ci.MeshId
+		p.matchAnyType = p.matchAnyType && ci.AnyType
 	default:
 		err := errors.New(errConnInvalidMsg)
 		//tell peer about fail
@@ -245,6 +329,10 @@ func (p *proxyImpl) connSetup() error {
 	//3. send initial pub/sub info to peer
 	p.peer.sendCtrlMsg(&genericMsg{r.SysID(PubId), p.initPubInfoMsg()})
 	p.peer.sendCtrlMsg(&genericMsg{r.SysID(SubId), p.initSubInfoMsg()})
+	if m := r.mesh; m != nil {
+		//in mesh mode, routes are exported to peer from mesh goroutine
+		m.post(&meshEvent{kind: joinEvent, proxy: p})
+	}
 	//4. handle init_pub/sub msgs, send connReady to peer and wait for peer's connReady
 	peerReady := false
 	myReady := false
@@ -258,7 +346,7 @@ func (p *proxyImpl) connSetup() error {
 			return ee
 		case ReadyId:
 			crm := m.Data.(*ConnReadyMsg)
-			p.Log(LOG_INFO, fmt.Sprintf("recv readyId: %v", crm))
+			p.Logf(LOG_INFO, "recv readyId: %v", crm)
 			if crm.Info != nil {
 				_, err := p.handlePeerReadyMsg(m)
 				p.sysChans.SendSysMsg(ReadyId, m.Data)
@@ -316,24 +404,31 @@ func (p *proxyImpl) connSetup() error {
 
 func (p *proxyImpl) connInit() {
 	//query router main goroutine to retrieve exported ids
-	p.exportSendIds = p.router.IdsForSend(ExportedId)
-	p.exportRecvIds = p.router.IdsForRecv(ExportedId)
+	if p.router.mesh != nil || p.router.broker != nil {
+		//in mesh mode, pubs are exported by meshTable and subs follow pub routes;
+		//in broker mode, brokerTable exports pubs/subs of hub and other clients
+		p.exportSendIds = make(map[interface{}]*ChanInfo)
+		p.exportRecvIds = make(map[interface{}]*ChanInfo)
+	} else {
+		p.exportSendIds = p.router.idsForSend(p.exportedId)
+		p.exportRecvIds = p.router.idsForRecv(p.exportedId)
+	}
 	//filter out blocked ids
-	if p.filter != nil {
-		for k, v := range p.exportSendIds {
-			if p.filter.BlockOutward(v.Id) {
-				delete(p.exportSendIds, k)
-			}
+	for k, v := range p.exportSendIds {
+		if p.filter.BlockOutward(v.Id) {
+			delete(p.exportSendIds, k)
 		}
-		for k, v := range p.exportRecvIds {
-			if p.filter.BlockInward(v.Id) {
-				delete(p.exportRecvIds, k)
-			}
+	}
+	for k, v := range p.exportRecvIds {
+		if p.filter.BlockInward(v.Id) {
+			delete(p.exportRecvIds, k)
 		}
 	}
 
 	//start conn handshaking
+	start := time.Now()
 	err := p.connSetup()
+	atomic.StoreInt64(&p.stats.handshakeNs, int64(time.Since(start)))
 	if p.errChan != nil {
 		p.errChan <- err
 	}
@@ -342,6 +437,9 @@ func (p *proxyImpl) connInit() {
 		p.closeImpl()
 		return
 	}
+	if b := p.router.broker; b != nil {
+		b.post(&brokerEvent{kind: clientJoin, proxy: p})
+	}
 
 	p.proxyLock.Lock()
 	p.connReady = true
@@ -362,6 +460,20 @@ func (p *proxyImpl) connInit() {
 
 func (p *proxyImpl) handleLocalCtrlMsg(m *genericMsg) {
 	p.Log(LOG_INFO, "enter handleLocalCtrlMsg")
+	if m := p.router.mesh; m != nil {
+		m.post(&meshEvent{kind: localEvent})
+		return
+	}
+	if b := p.router.broker; b != nil {
+		b.post(&brokerEvent{kind: clientChange})
+		return
+	}
+	p.applyLocalCtrlMsg(m)
+	p.Log(LOG_INFO, "exit handleLocalCtrlMsg")
+}
+
+//export local namespace changes to peer
+func (p *proxyImpl) applyLocalCtrlMsg(m *genericMsg) {
 	var err error
 	switch m.Id.SysIdIndex() {
 	case PubId:
@@ -380,8 +492,6 @@ func (p *proxyImpl) handleLocalCtrlMsg(m *genericMsg) {
 		p.sysChans.SendSysMsg(ErrorId, ci)
 		p.LogError(err)
 	}
-	p.Log(LOG_INFO, "exit handleLocalCtrlMsg")
-	return
 }
 
 func (p *proxyImpl) handlePeerCtrlMsg(m *genericMsg) (err error) {
@@ -413,17 +523,24 @@ func (p *proxyImpl) handlePeerCtrlMsg(m *genericMsg) (err error) {
 		_, err = p.handlePeerUnSubMsg(m)
 		p.sysChans.SendSysMsg(UnSubId, m.Data)
 	}
+	if b := p.router.broker; b != nil && m.Id.SysIdIndex() >= PubId && m.Id.SysIdIndex() <= UnSubId {
+		b.post(&brokerEvent{kind: clientChange})
+	}
 	if err != nil {
-		//tell peer about fail
-		ci := &ConnInfoMsg{Error: err.Error()}
-		p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ErrorId), ci})
-		p.sysChans.SendSysMsg(ErrorId, ci)
-		p.LogError(err)
-		p.closeImpl()
+		p.peerMsgFailed(err)
 	}
 	return
 }
 
+//tell peer and local subscribers about the fail of handling peer's msg, and close proxy
+func (p *proxyImpl) peerMsgFailed(err error) {
+	ci := &ConnInfoMsg{Error: err.Error()}
+	p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ErrorId), ci})
+	p.sysChans.SendSysMsg(ErrorId, ci)
+	p.LogError(err)
+	p.closeImpl()
+}
+
 //the following 2 functions are external interface exposed to peers
 func (p *proxyImpl) sendCtrlMsg(m *genericMsg) (err error) {
 	p.proxyLock.Lock()
@@ -441,10 +558,7 @@ func (p *proxyImpl) sendCtrlMsg(m *genericMsg) (err error) {
 }
 
 func (p *proxyImpl) appMsgChanForId(id Id) (Channel, int) {
-	id1 := id
-	if p.translator != nil {
-		id1 = p.translator.TranslateInward(id)
-	}
+	id1 := p.translator.TranslateInward(id)
 	p.inwardLock.Lock() //protect appSendChans
 	defer p.inwardLock.Unlock()
 	return p.appSendChans.findChan(id1)
@@ -453,11 +567,11 @@ func (p *proxyImpl) appMsgChanForId(id Id) (Channel, int) {
 func (p *proxyImpl) chanTypeMatch(info1, info2 *ChanInfo) bool {
 	if info1.ChanType != nil {
 		if info2.ChanType != nil {
-			return info1.ChanType == info2.ChanType
+			return info1.ChanType == info2.ChanType || p.matchAnyType && (info1.ChanType == anyChanType || info2.ChanType == anyChanType)
 		}
 		//at here, info2 should be marshaled data from remote
 		if info2.ElemType == nil {
-			p.Log(LOG_ERROR, fmt.Sprintf("IdChanInfo miss both ChanType & ElemType info for %v", info2.Id))
+			p.Logf(LOG_ERROR, "IdChanInfo miss both ChanType & ElemType info for %v", info2.Id)
 			return false
 		}
 		//1. marshal data for info1
@@ -469,22 +583,22 @@ func (p *proxyImpl) chanTypeMatch(info1, info2 *ChanInfo) bool {
 			//do the real type encoding
 		}
 		//2. compare marshaled data
-		if info1.ElemType.FullName == info2.ElemType.FullName {
+		if elemTypeMatch(info1.ElemType.FullName, info2.ElemType.FullName, p.matchAnyType) {
 			//3. since type match, use info1's ChanType for info2
 			info2.ChanType = info1.ChanType
 			return true
 		} else {
-			p.Log(LOG_ERROR, fmt.Sprintf("ElemType.FullName mismatch1 %v, %v", info1.ElemType.FullName, info2.ElemType.FullName))
+			p.Logf(LOG_ERROR, "ElemType.FullName mismatch1 %v, %v", info1.ElemType.FullName, info2.ElemType.FullName)
 			return false
 		}
 	} else {
 		if info2.ChanType == nil {
-			p.Log(LOG_ERROR, fmt.Sprintf("both pub/sub miss ChanType for %v", info2.Id))
+			p.Logf(LOG_ERROR, "both pub/sub miss ChanType for %v", info2.Id)
 			return false
 		}
 		//at here, info1 should be marshaled data from remote
 		if info1.ElemType == nil {
-			p.Log(LOG_ERROR, fmt.Sprintf("IdChanInfo miss both ChanType & ElemType info for %v", info1.Id))
+			p.Logf(LOG_ERROR, "IdChanInfo miss both ChanType & ElemType info for %v", info1.Id)
 			return false
 		}
 		//1. marshal data for info2
@@ -496,12 +610,12 @@ func (p *proxyImpl) chanTypeMatch(info1, info2 *ChanInfo) bool {
 			//do the real type encoding
 		}
 		//2. compare marshaled data
-		if info1.ElemType.FullName == info2.ElemType.FullName {
+		if elemTypeMatch(info1.ElemType.FullName, info2.ElemType.FullName, p.matchAnyType) {
 			//3. since type match, use info1's ChanType for info2
 			info1.ChanType = info2.ChanType
 			return true
 		} else {
-			p.Log(LOG_ERROR, fmt.Sprintf("ElemType.FullName mismatch2 %v, %v", info1.ElemType.FullName, info2.ElemType.FullName))
+			p.Logf(LOG_ERROR, "ElemType.FullName mismatch2 %v, %v", info1.ElemType.FullName, info2.ElemType.FullName)
 			return false
 		}
 	}
@@ -523,8 +637,8 @@ func (p *proxyImpl) handleLocalSubMsg(m *genericMsg) (num int, err error) {
 	sInfo2 := make([]*ChanInfo, len(sInfo))
 	p.inwardLock.Lock()
 	for _, sub := range sInfo {
-		p.Log(LOG_INFO, fmt.Sprintf("handleLocalSubMsg: %v", sub.Id))
-		if p.filter != nil && p.filter.BlockInward(sub.Id) {
+		p.Logf(LOG_INFO, "handleLocalSubMsg: %v", sub.Id)
+		if !p.exchanged(sub.Id) || p.filter.BlockInward(sub.Id) {
 			continue
 		}
 		_, ok := p.exportRecvIds[sub.Id.Key()]
@@ -540,9 +654,9 @@ func (p *proxyImpl) handleLocalSubMsg(m *genericMsg) (num int, err error) {
 		for _, pub := range p.importSendIds {
 			if sub.Id.Match(pub.Id) {
 				if p.chanTypeMatch(sub, pub) {
-					readyInfo[numReady] = &ChanReadyInfo{pub.Id, p.router.recvChanBufSize(sub.Id)}
+					readyInfo[numReady] = &ChanReadyInfo{Id: pub.Id, Credit: p.router.recvChanBufSize(sub.Id)}
 					numReady++
-					p.Log(LOG_INFO, fmt.Sprintf("send ConnReady for: %v", pub.Id))
+					p.Logf(LOG_INFO, "send ConnReady for: %v", pub.Id)
 					p.appSendChans.AddSender(pub.Id, pub.ChanType)
 				} else {
 					err = errors.New(errRmtChanTypeMismatch)
@@ -557,29 +671,21 @@ func (p *proxyImpl) handleLocalSubMsg(m *genericMsg) (num int, err error) {
 	//send subscriptions to peer
 	if num > 0 {
 		sInfo2 = sInfo2[0:num]
-		if p.translator == nil {
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
-		} else {
-			for i, sub := range sInfo2 {
-				sInfo2[i] = new(ChanInfo)
-				sInfo2[i].Id = p.translator.TranslateOutward(sub.Id)
-				sInfo2[i].ChanType = sub.ChanType
-				sInfo2[i].ElemType = sub.ElemType
-			}
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
+		for i, sub := range sInfo2 {
+			sInfo2[i] = new(ChanInfo)
+			sInfo2[i].Id = p.translator.TranslateOutward(sub.Id)
+			sInfo2[i].ChanType = sub.ChanType
+			sInfo2[i].ElemType = sub.ElemType
 		}
+		p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
 	}
 	//send connReadyInfo to peer
 	if numReady > 0 {
 		readyInfo = readyInfo[0:numReady]
-		if p.translator == nil {
-			p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ReadyId), &ConnReadyMsg{Info: readyInfo}})
-		} else {
-			for i, ready := range readyInfo {
-				readyInfo[i].Id = p.translator.TranslateOutward(ready.Id)
-			}
-			p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ReadyId), &ConnReadyMsg{Info: readyInfo}})
+		for i, ready := range readyInfo {
+			readyInfo[i].Id = p.translator.TranslateOutward(ready.Id)
 		}
+		p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ReadyId), &ConnReadyMsg{Info: readyInfo}})
 	}
 	return
 }
@@ -593,12 +699,12 @@ func (p *proxyImpl) handleLocalUnSubMsg(m *genericMsg) (num int, err error) {
 	sInfo2 := make([]*ChanInfo, len(sInfo))
 	p.inwardLock.Lock()
 	for _, sub := range sInfo {
-		p.Log(LOG_INFO, fmt.Sprintf("handleLocalUnSubMsg: %v", sub.Id))
+		p.Logf(LOG_INFO, "handleLocalUnSubMsg: %v", sub.Id)
 		_, ok := p.exportRecvIds[sub.Id.Key()]
 		if !ok {
 			continue
 		}
-		if p.filter != nil && p.filter.BlockInward(sub.Id) {
+		if p.filter.BlockInward(sub.Id) {
 			continue
 		}
 
@@ -632,17 +738,13 @@ func (p *proxyImpl) handleLocalUnSubMsg(m *genericMsg) (num int, err error) {
 	p.inwardLock.Unlock()
 	if num > 0 {
 		sInfo2 = sInfo2[0:num]
-		if p.translator == nil {
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
-		} else {
-			for i, sub := range sInfo2 {
-				sInfo2[i] = new(ChanInfo)
-				sInfo2[i].Id = p.translator.TranslateOutward(sub.Id)
-				sInfo2[i].ChanType = sub.ChanType
-				sInfo2[i].ElemType = sub.ElemType
-			}
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
+		for i, sub := range sInfo2 {
+			sInfo2[i] = new(ChanInfo)
+			sInfo2[i].Id = p.translator.TranslateOutward(sub.Id)
+			sInfo2[i].ChanType = sub.ChanType
+			sInfo2[i].ElemType = sub.ElemType
 		}
+		p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{Info: sInfo2}})
 	}
 	return
 }
@@ -656,8 +758,8 @@ func (p *proxyImpl) handleLocalPubMsg(m *genericMsg) (num int, err error) {
 	pInfo2 := make([]*ChanInfo, len(pInfo))
 	p.outwardLock.Lock()
 	for _, pub := range pInfo {
-		p.Log(LOG_INFO, fmt.Sprintf("handleLocalPubMsg: %v", pub.Id))
-		if p.filter != nil && p.filter.BlockOutward(pub.Id) {
+		p.Logf(LOG_INFO, "handleLocalPubMsg: %v", pub.Id)
+		if !p.exchanged(pub.Id) || p.filter.BlockOutward(pub.Id) {
 			continue
 		}
 		_, ok := p.exportSendIds[pub.Id.Key()]
@@ -683,17 +785,13 @@ func (p *proxyImpl) handleLocalPubMsg(m *genericMsg) (num int, err error) {
 	p.outwardLock.Unlock()
 	if num > 0 {
 		pInfo2 = pInfo2[0:num]
-		if p.translator == nil {
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
-		} else {
-			for cnt, pub := range pInfo2 {
-				pInfo2[cnt] = new(ChanInfo)
-				pInfo2[cnt].Id = p.translator.TranslateOutward(pub.Id)
-				pInfo2[cnt].ChanType = pub.ChanType
-				pInfo2[cnt].ElemType = pub.ElemType
-			}
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
+		for cnt, pub := range pInfo2 {
+			pInfo2[cnt] = new(ChanInfo)
+			pInfo2[cnt].Id = p.translator.TranslateOutward(pub.Id)
+			pInfo2[cnt].ChanType = pub.ChanType
+			pInfo2[cnt].ElemType = pub.ElemType
 		}
+		p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
 	}
 	return
 }
@@ -707,12 +805,12 @@ func (p *proxyImpl) handleLocalUnPubMsg(m *genericMsg) (num int, err error) {
 	pInfo2 := make([]*ChanInfo, len(pInfo))
 	p.outwardLock.Lock()
 	for _, pub := range pInfo {
-		p.Log(LOG_INFO, fmt.Sprintf("handleLocalUnPubMsg: %v", pub.Id))
+		p.Logf(LOG_INFO, "handleLocalUnPubMsg: %v", pub.Id)
 		_, ok := p.exportSendIds[pub.Id.Key()]
 		if !ok {
 			continue
 		}
-		if p.filter != nil && p.filter.BlockOutward(pub.Id) {
+		if p.filter.BlockOutward(pub.Id) {
 			continue
 		}
 
@@ -746,17 +844,13 @@ func (p *proxyImpl) handleLocalUnPubMsg(m *genericMsg) (num int, err error) {
 	p.outwardLock.Unlock()
 	if num > 0 {
 		pInfo2 = pInfo2[0:num]
-		if p.translator == nil {
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
-		} else {
-			for cnt, pub := range pInfo2 {
-				pInfo2[cnt] = new(ChanInfo)
-				pInfo2[cnt].Id = p.translator.TranslateOutward(pub.Id)
-				pInfo2[cnt].ChanType = pub.ChanType
-				pInfo2[cnt].ElemType = pub.ElemType
-			}
-			p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
+		for cnt, pub := range pInfo2 {
+			pInfo2[cnt] = new(ChanInfo)
+			pInfo2[cnt].Id = p.translator.TranslateOutward(pub.Id)
+			pInfo2[cnt].ChanType = pub.ChanType
+			pInfo2[cnt].ElemType = pub.ElemType
 		}
+		p.peer.sendCtrlMsg(&genericMsg{m.Id, &ChanInfoMsg{pInfo2}})
 	}
 	return
 }
@@ -771,21 +865,30 @@ func (p *proxyImpl) handlePeerReadyMsg(m *genericMsg) (num int, err error) {
 	for _, ready := range rInfo {
 		//update id scope/member
 		ready.Id, _ = ready.Id.Clone(ScopeLocal, MemberRemote)
-		if p.translator != nil {
-			ready.Id = p.translator.TranslateInward(ready.Id)
-		}
+		ready.Id = p.translator.TranslateInward(ready.Id)
 		//p.Log(LOG_INFO, fmt.Sprintf("handlePeerReadyMsg: %v, %v", ready.Id, ready.Credit))
-		if p.filter != nil && p.filter.BlockOutward(ready.Id) {
+		if p.filter.BlockOutward(ready.Id) {
 			continue
 		}
+		if m := p.router.mesh; m != nil && ready.Reroute {
+			//peer changes the origins of msgs it asks for
+			p.meshWant(ready.Id).set(ready.Origins)
+			m.post(&meshEvent{kind: wantEvent, proxy: p, info: &ChanInfo{Id: ready.Id}, origins: ready.Origins})
+			if ready.Credit == 0 {
+				continue
+			}
+		}
 		//check
 		p.outwardLock.Lock()
 		r, _ := p.appRecvChans.findChan(ready.Id)
 		if r != nil {
 			p.outwardLock.Unlock()
 			//p.Log(LOG_INFO, fmt.Sprintf("handlePeerReadyMsg22: %v, %v", ready.Id, ready.Credit))
-			fs, ok := r.(FlowSender)
-			if ok {
+			if rl, ok := r.(RateLimiter); ok && ready.Burst > 0 {
+				rl.SetPeerRate(ready.Rate, ready.Burst)
+			} else if ca, ok := r.(CumulativeAcker); ok && ready.Window > 0 {
+				ca.AckCumulative(ready.Credit, ready.Window)
+			} else if fs, ok := r.(FlowSender); ok {
 				fs.Ack(ready.Credit)
 				//p.Log(LOG_INFO, fmt.Sprintf("handlePeerReadyMsg: add credit %v for recver %v", ready.Credit, ready.Id))
 			} else {
@@ -798,7 +901,16 @@ func (p *proxyImpl) handlePeerReadyMsg(m *genericMsg) (num int, err error) {
 					//ready.Id, _ = ready.Id.Clone(ScopeLocal, MemberRemote)
 					peerChan, _ := p.peer.appMsgChanForId(ready.Id)
 					if peerChan != nil {
-						p.appRecvChans.AddRecver(ready.Id, peerChan, ready.Credit)
+						var args []interface{}
+						if pub.ChanType != nil {
+							args = append(args, pub.ChanType)
+						}
+						p.appRecvChans.AddRecver(ready.Id, peerChan, ready.Credit, args...)
+						//rate limit advertised before credit
+						r, _ = p.appRecvChans.findChan(ready.Id)
+						if rl, ok := r.(RateLimiter); ok && ready.Burst > 0 {
+							rl.SetPeerRate(ready.Rate, ready.Burst)
+						}
 						//p.Log(LOG_INFO, fmt.Sprintf("handlePeerReadyMsg, add recver for: %v, %v", ready.Id, ready.Credit))
 					}
 					num++
@@ -813,7 +925,7 @@ func (p *proxyImpl) handlePeerReadyMsg(m *genericMsg) (num int, err error) {
 
 func (p *proxyImpl) handlePeerSubMsg(m *genericMsg) (num int, err error) {
 	msg := m.Data.(*ChanInfoMsg)
-	p.Log(LOG_INFO, fmt.Sprintf("handlePeerSubMsg: %v", msg))
+	p.Logf(LOG_INFO, "handlePeerSubMsg: %v", msg)
 	sInfo := msg.Info
 	if len(sInfo) == 0 {
 		return
@@ -821,11 +933,13 @@ func (p *proxyImpl) handlePeerSubMsg(m *genericMsg) (num int, err error) {
 	p.outwardLock.Lock()
 	for _, sub := range sInfo {
 		sub.Id, _ = sub.Id.Clone(ScopeLocal, MemberRemote)
-		if p.translator != nil {
-			sub.Id = p.translator.TranslateInward(sub.Id)
+		if !p.exchanged(sub.Id) {
+			continue
 		}
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerSubMsg: %v", sub.Id))
-		if p.filter != nil && p.filter.BlockOutward(sub.Id) {
+		p.peerRecvIds[sub.Id.Key()] = &ChanInfo{Id: sub.Id, ChanType: sub.ChanType, ElemType: sub.ElemType}
+		sub.Id = p.translator.TranslateInward(sub.Id)
+		p.Logf(LOG_INFO, "handlePeerSubMsg: %v", sub.Id)
+		if p.filter.BlockOutward(sub.Id) {
 			continue
 		}
 		_, ok := p.importRecvIds[sub.Id.Key()]
@@ -833,8 +947,11 @@ func (p *proxyImpl) handlePeerSubMsg(m *genericMsg) (num int, err error) {
 			p.outwardLock.Unlock()
 			return
 		}
+		if p.clientLimit(SubId, p.importRecvIds, sub.Id) {
+			continue
+		}
 		p.importRecvIds[sub.Id.Key()] = sub
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerSubMsg1: %v", sub.Id))
+		p.Logf(LOG_INFO, "handlePeerSubMsg1: %v", sub.Id)
 		//check if local already pubed it
 		for _, pub := range p.exportSendIds {
 			if pub.Id.Match(sub.Id) {
@@ -863,10 +980,9 @@ func (p *proxyImpl) handlePeerUnSubMsg(m *genericMsg) (num int, err error) {
 	defer p.outwardLock.Unlock()
 	for _, sub := range sInfo {
 		sub.Id, _ = sub.Id.Clone(ScopeLocal, MemberRemote)
-		if p.translator != nil {
-			sub.Id = p.translator.TranslateInward(sub.Id)
-		}
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerUnSubMsg: %v", sub.Id))
+		delete(p.peerRecvIds, sub.Id.Key())
+		sub.Id = p.translator.TranslateInward(sub.Id)
+		p.Logf(LOG_INFO, "handlePeerUnSubMsg: %v", sub.Id)
 		//update import cache
 		delete(p.importRecvIds, sub.Id.Key())
 		//check if local already pubed it
@@ -878,20 +994,26 @@ func (p *proxyImpl) handlePeerUnSubMsg(m *genericMsg) (num int, err error) {
 
 func (p *proxyImpl) handlePeerPubMsg(m *genericMsg) (num int, err error) {
 	msg := m.Data.(*ChanInfoMsg)
-	p.Log(LOG_INFO, fmt.Sprintf("handlePeerPubMsg: %v", msg))
+	p.Logf(LOG_INFO, "handlePeerPubMsg: %v", msg)
 	pInfo := msg.Info
 	if len(pInfo) == 0 {
 		return
 	}
+	if p.router.mesh != nil {
+		num = p.handlePeerMeshPubMsg(pInfo, true)
+		return
+	}
 	readyInfo := make([]*ChanReadyInfo, len(pInfo))
 	p.inwardLock.Lock()
 	for _, pub := range pInfo {
 		pub.Id, _ = pub.Id.Clone(ScopeLocal, MemberRemote)
-		if p.translator != nil {
-			pub.Id = p.translator.TranslateInward(pub.Id)
+		if !p.exchanged(pub.Id) {
+			continue
 		}
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerPubMsg: %v", pub.Id))
-		if p.filter != nil && p.filter.BlockInward(pub.Id) {
+		p.peerSendIds[pub.Id.Key()] = &ChanInfo{Id: pub.Id, ChanType: pub.ChanType, ElemType: pub.ElemType}
+		pub.Id = p.translator.TranslateInward(pub.Id)
+		p.Logf(LOG_INFO, "handlePeerPubMsg: %v", pub.Id)
+		if p.filter.BlockInward(pub.Id) {
 			continue
 		}
 		_, ok := p.importSendIds[pub.Id.Key()]
@@ -899,6 +1021,9 @@ func (p *proxyImpl) handlePeerPubMsg(m *genericMsg) (num int, err error) {
 			p.inwardLock.Unlock()
 			return
 		}
+		if p.clientLimit(PubId, p.importSendIds, pub.Id) {
+			continue
+		}
 		p.importSendIds[pub.Id.Key()] = pub
 		for _, sub := range p.exportRecvIds {
 			if pub.Id.Match(sub.Id) {
@@ -908,12 +1033,9 @@ func (p *proxyImpl) handlePeerPubMsg(m *genericMsg) (num int, err error) {
 					p.inwardLock.Unlock()
 					return
 				}
-				id := pub.Id
-				if p.translator != nil {
-					id = p.translator.TranslateOutward(id)
-				}
-				p.Log(LOG_INFO, fmt.Sprintf("send ConnReady for: %v", pub.Id))
-				readyInfo[num] = &ChanReadyInfo{id, p.router.recvChanBufSize(sub.Id)}
+				id := p.translator.TranslateOutward(pub.Id)
+				p.Logf(LOG_INFO, "send ConnReady for: %v", pub.Id)
+				readyInfo[num] = &ChanReadyInfo{Id: id, Credit: p.router.recvChanBufSize(sub.Id)}
 				num++
 				p.appSendChans.AddSender(pub.Id, pub.ChanType)
 			}
@@ -923,7 +1045,7 @@ func (p *proxyImpl) handlePeerPubMsg(m *genericMsg) (num int, err error) {
 	//send ConnReadyMsg
 	if num > 0 {
 		p.peer.sendCtrlMsg(&genericMsg{p.router.SysID(ReadyId), &ConnReadyMsg{Info: readyInfo[0:num]}})
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerPubMsg sends ConnReadyMsg for : %v, num : %v", readyInfo[0].Id, num))
+		p.Logf(LOG_INFO, "handlePeerPubMsg sends ConnReadyMsg for : %v, num : %v", readyInfo[0].Id, num)
 	}
 	return
 }
@@ -934,14 +1056,17 @@ func (p *proxyImpl) handlePeerUnPubMsg(m *genericMsg) (num int, err error) {
 	if len(pInfo) == 0 {
 		return
 	}
+	if p.router.mesh != nil {
+		num = p.handlePeerMeshPubMsg(pInfo, false)
+		return
+	}
 	p.inwardLock.Lock()
 	defer p.inwardLock.Unlock()
 	for _, pub := range pInfo {
 		pub.Id, _ = pub.Id.Clone(ScopeLocal, MemberRemote)
-		if p.translator != nil {
-			pub.Id = p.translator.TranslateInward(pub.Id)
-		}
-		p.Log(LOG_INFO, fmt.Sprintf("handlePeerUnPubMsg: %v", pub.Id))
+		delete(p.peerSendIds, pub.Id.Key())
+		pub.Id = p.translator.TranslateInward(pub.Id)
+		p.Logf(LOG_INFO, "handlePeerUnPubMsg: %v", pub.Id)
 		//update import cache
 		delete(p.importSendIds, pub.Id.Key())
 		p.appSendChans.DelChan(pub.Id)
@@ -956,15 +1081,11 @@ func (p *proxyImpl) initSubInfoMsg() *ChanInfoMsg {
 	idx := 0
 	for _, v := range p.exportRecvIds {
 		info[idx] = new(ChanInfo)
-		if p.translator != nil {
-			info[idx].Id = p.translator.TranslateOutward(v.Id)
-		} else {
-			info[idx].Id = v.Id
-		}
+		info[idx].Id = p.translator.TranslateOutward(v.Id)
 		info[idx].ChanType = v.ChanType
 		idx++
 	}
-	p.Log(LOG_INFO, fmt.Sprintf("initSubInfoMsg: %v", info[0:idx]))
+	p.Logf(LOG_INFO, "initSubInfoMsg: %v", info[0:idx])
 	return &ChanInfoMsg{Info: info[0:idx]}
 }
 
@@ -974,16 +1095,11 @@ func (p *proxyImpl) initPubInfoMsg() *ChanInfoMsg {
 	idx := 0
 	for _, v := range p.exportSendIds {
 		info[idx] = new(ChanInfo)
-		if p.translator != nil {
-			info[idx].Id = p.translator.TranslateOutward(v.Id)
-		} else {
-			info[idx].Id = v.Id
-		}
-		info[idx].Id = v.Id
+		info[idx].Id = p.translator.TranslateOutward(v.Id)
 		info[idx].ChanType = v.ChanType
 		idx++
 	}
-	p.Log(LOG_INFO, fmt.Sprintf("initPubInfoMsg: %v", info[0:idx]))
+	p.Logf(LOG_INFO, "initPubInfoMsg: %v", info[0:idx])
 	return &ChanInfoMsg{Info: info[0:idx]}
 }
 
@@ -997,6 +1113,7 @@ func (p *proxyImpl) PeerPubInfo() []*ChanInfo {
 		info[idx] = new(ChanInfo)
 		info[idx].Id = v.Id
 		info[idx].ChanType = v.ChanType
+		info[idx].ElemType = v.ElemType
 		idx++
 	}
 	return info
@@ -1012,6 +1129,7 @@ func (p *proxyImpl) PeerSubInfo() []*ChanInfo {
 		info[idx] = new(ChanInfo)
 		info[idx].Id = v.Id
 		info[idx].ChanType = v.ChanType
+		info[idx].ElemType = v.ElemType
 		idx++
 	}
 	return info
@@ -0,0 +1,134 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+/*
+ Log and fault records of connected routers:
+ records are exchanged only on connections set up with ExportRecords at both sides,
+ e.g. ConnectRemote(conn, router.GobMarshaling, router.ExportRecords). On such connections
+ recv chans attached to RouterLogId or RouterFaultId with ScopeGlobal (or ScopeRemote)
+ are exported to peer like app ids, so records of peer routers show up together with
+ local ones, e.g. the console log sink of a router created with ScopeGlobal, or a file log sink:
+
+    sink := router.NewFileLogSink(rot.NewSysID(router.RouterLogId, router.ScopeGlobal), rot, f)
+
+ Records are forwarded one hop only, they are not relayed by routers in mesh or
+ broker mode. Filters and translators of proxies do not apply to these ids.
+ On the wire, Info of records is carried in its string form: LogRecords arrive with a
+ string Info, and FaultRecords with an error made from the message of the original one.
+*/
+
+//exportedSysId tells if sys id of index idx is exported as app ids when records are exchanged
+func exportedSysId(idx int) bool {
+	return idx == RouterLogId || idx == RouterFaultId
+}
+
+//recordOrExportedId tells if local id is exported to peers exchanging records
+func recordOrExportedId(id Id) bool {
+	idx := id.SysIdIndex()
+	return (idx < 0 || exportedSysId(idx)) && ExportedId(id)
+}
+
+//exchanged tells if id is exchanged with peer: app ids, and log/fault ids if records are
+//exported at this connection
+func (p *proxyImpl) exchanged(id Id) bool {
+	idx := id.SysIdIndex()
+	return idx < 0 || (p.exportRecords && p.router.mesh == nil && exportedSysId(idx))
+}
+
+//exportedId is the predicate of local ids exported to peer
+func (p *proxyImpl) exportedId(id Id) bool {
+	return ExportedId(id) && p.exchanged(id)
+}
+
+//wire form of LogRecord
+type logRecordData struct {
+	Pri       LogPriority
+	Source    string
+	Info      string
+	Timestamp int64
+	Attrs     map[string]string
+}
+
+//wire form of FaultRecord
+type faultRecordData struct {
+	Source    string
+	Info      string
+	Timestamp int64
+}
+
+func infoString(v interface{}) string {
+	switch i := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return i
+	case error:
+		return i.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+func (lr LogRecord) data() *logRecordData {
+	return &logRecordData{lr.Pri, lr.Source, infoString(lr.Info), lr.Timestamp, lr.Attrs}
+}
+
+func (lr *LogRecord) setData(d *logRecordData) {
+	*lr = LogRecord{Pri: d.Pri, Source: d.Source, Timestamp: d.Timestamp, Attrs: d.Attrs}
+	if len(d.Info) > 0 {
+		lr.Info = d.Info
+	}
+}
+
+func (fr FaultRecord) data() *faultRecordData {
+	return &faultRecordData{fr.Source, infoString(fr.Info), fr.Timestamp}
+}
+
+func (fr *FaultRecord) setData(d *faultRecordData) {
+	*fr = FaultRecord{Source: d.Source, Timestamp: d.Timestamp}
+	if len(d.Info) > 0 {
+		fr.Info = errors.New(d.Info)
+	}
+}
+
+//marshalRecord sends log/fault record in wire form
+func marshalRecord(mar Marshaler, v interface{}) error {
+	switch r := v.(type) {
+	case *LogRecord:
+		return mar.Marshal(r.data())
+	case *FaultRecord:
+		return mar.Marshal(r.data())
+	}
+	return mar.Marshal(v)
+}
+
+//demarshalRecord recvs log/fault record of sys id idx in wire form
+func demarshalRecord(demar Demarshaler, idx int) (v reflect.Value, err error) {
+	switch idx {
+	case RouterLogId:
+		d := new(logRecordData)
+		if err = demar.Demarshal(d); err == nil {
+			lr := new(LogRecord)
+			lr.setData(d)
+			v = reflect.ValueOf(lr)
+		}
+	case RouterFaultId:
+		d := new(faultRecordData)
+		if err = demar.Demarshal(d); err == nil {
+			fr := new(FaultRecord)
+			fr.setData(d)
+			v = reflect.ValueOf(fr)
+		}
+	}
+	return
+}
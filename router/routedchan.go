@@ -7,8 +7,10 @@
 package router
 
 import (
-	"sync"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type operType int
@@ -38,6 +40,7 @@ type RoutedChan struct {
 	Channel      //external SendChan/RecvChan, attached by clients
 	router       *routerImpl
 	dispatcher   Dispatcher //current for push dispacher, only sender uses dispatcher
+	dispPolicy   DispatchPolicy
 	bindChan     chan *BindEvent
 	bindCond     *sync.Cond
 	bindLock     sync.Mutex
@@ -46,6 +49,20 @@ type RoutedChan struct {
 	opBuf        []*oper
 	internalChan bool
 	detached     bool
+	//envelope handling
+	wantEnvelope   bool //recver want msgs wrapped in envelopes
+	unwrapEnvelope bool //recver want bare msgs
+	numEnvPeers    int  //sender: number of bound recvers which want envelopes
+	stats          *idCounters
+	//slow consumer detection for recvers
+	slow      int32         //reported as slow consumer, till a msg delivered without blocking
+	evicted   chan struct{} //closed when detached as slow consumer
+	evictOnce sync.Once
+	//proxy which attached the chan on behalf of peer, and in mesh mode,
+	//origins of msgs peer asks for thru its forwarding chan
+	proxy    *proxyImpl
+	meshWant *meshOrigins
+	msgType  reflect.Type //chan type of msgs relayed thru proxy chan, which could be attached first
 }
 
 func newRoutedChan(id Id, t reflect.ChanDir, ch Channel, r *routerImpl, bc chan *BindEvent) *RoutedChan {
@@ -57,6 +74,8 @@ func newRoutedChan(id Id, t reflect.ChanDir, ch Channel, r *routerImpl, bc chan
 	routCh.bindChan = bc
 	if t == reflect.SendDir {
 		routCh.bindCond = sync.NewCond(&routCh.bindLock)
+	} else {
+		routCh.evicted = make(chan struct{})
 	}
 	return routCh
 }
@@ -65,14 +84,126 @@ func (e *RoutedChan) Interface() interface{} {
 	return e
 }
 
+//override Channel.Send() method, recvers which want bare msgs will get the data inside envelopes
+func (e *RoutedChan) Send(v reflect.Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.countDrop()
+			e.router.chanPanic(e, "delivery to", r)
+		}
+	}()
+	if e.router.tracing && isEnvelope(v) && e.Channel.Type() != genericMsgChanType {
+		span := e.router.startSpan("deliver", e.Id, v.Interface().(*Envelope).Trace)
+		defer span.End()
+	}
+	if e.expiredEnvelope(v) || e.offRoute(v) {
+		return
+	}
+	if e.unwrapEnvelope && isEnvelope(v) {
+		var err error
+		if v, err = unwrapEnvelope(v, e.Channel.Type().Elem()); err != nil {
+			e.router.LogError(err)
+			e.countDrop()
+			return
+		}
+	}
+	if e.router.slowPolicy != nil {
+		if !e.sendOrEvict(v) {
+			e.countDrop()
+			return
+		}
+	} else {
+		e.Channel.Send(v)
+	}
+	atomic.AddUint64(&e.stats.delivered, 1)
+}
+
+//override Channel.TrySend() method, same as Send()
+func (e *RoutedChan) TrySend(v reflect.Value) (sent bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.countDrop()
+			e.router.chanPanic(e, "delivery to", r)
+			sent = true //drop it
+		}
+	}()
+	if e.router.tracing && isEnvelope(v) && e.Channel.Type() != genericMsgChanType {
+		span := e.router.startSpan("deliver", e.Id, v.Interface().(*Envelope).Trace)
+		defer span.End()
+	}
+	if e.expiredEnvelope(v) || e.offRoute(v) {
+		return true //drop it
+	}
+	if e.unwrapEnvelope && isEnvelope(v) {
+		var err error
+		if v, err = unwrapEnvelope(v, e.Channel.Type().Elem()); err != nil {
+			e.router.LogError(err)
+			e.countDrop()
+			return true //drop it
+		}
+	}
+	if e.Channel.TrySend(v) {
+		atomic.AddUint64(&e.stats.delivered, 1)
+		return true
+	}
+	return false
+}
+
+//count msgs dropped at this chan, used by dispatchers
+func (e *RoutedChan) countDrop() {
+	if e.stats != nil {
+		atomic.AddUint64(&e.stats.dropped, 1)
+	}
+}
+
+//wrap bare msgs into envelopes at send chan if any bound recvers want them,
+//and stamp envelopes sent from local chans; envelopes could be shared by recvers
+//of earlier hops, so a copy is stamped
+func (e *RoutedChan) envelope(v reflect.Value, wrap bool) reflect.Value {
+	if isEnvelope(v) {
+		if e.Id.Member() == MemberLocal {
+			env := *v.Interface().(*Envelope)
+			if env.Timestamp == 0 {
+				env.Timestamp = time.Now().UnixNano()
+			}
+			if len(env.Origin) == 0 || e.router.mesh != nil {
+				//in mesh mode, origin is used to route msgs
+				env.Origin = e.router.name
+			}
+			if env.Deadline == 0 {
+				env.Deadline = e.deadline(env.Timestamp)
+			}
+			return reflect.ValueOf(&env)
+		}
+		return v
+	}
+	if !wrap {
+		return v
+	}
+	now := time.Now().UnixNano()
+	return reflect.ValueOf(&Envelope{Origin: e.router.name, Timestamp: now, Deadline: e.deadline(now), Data: v.Interface()})
+}
+
+//deadline of msgs sent at time t from this chan, by ttl of its id
+func (e *RoutedChan) deadline(t int64) int64 {
+	if ttl := e.router.ttlOf(e.Id); ttl > 0 {
+		return t + int64(ttl)
+	}
+	return 0
+}
+
 //override Channel.Close() method
 func (e *RoutedChan) Close() {
+	//recover panic to handle race(close twice) when proxy destroy and a sender chan close from outside of router at the same time;
+	//or when locally connected proxies both close the chan shared between sender and recver,
+	//or a recv chan closed by its owner is detached on panic;
+	//other panics (such as from custom Channels) are reported as faults
+	defer func() {
+		if r := recover(); r != nil && !closedTwice(r) {
+			e.router.reportChanPanic(e, "close", r)
+		}
+	}()
 	if e.Dir == reflect.SendDir {
-		//recover panic to handle race(close twice) when proxy destroy and a sender chan close from outside of router at the same time
-		defer func() {
-			_ = recover()
-		}()
-
 		//wake up sender goroutine blocked waiting for peers
 		e.bindLock.Lock()
 		e.detached = true
@@ -111,14 +242,21 @@ func (e *RoutedChan) Peers() (copySet []*RoutedChan) {
 	return
 }
 
-func (e *RoutedChan) start(disp DispatchPolicy) {
+func (e *RoutedChan) start() {
 	if e.Dir == reflect.SendDir {
-		e.dispatcher = disp.NewDispatcher()
+		e.dispatcher = e.dispPolicy.NewDispatcher()
 		go e.senderLoop()
 	}
 }
 
+//typedForwarder is implemented by typed chans, which forward msgs without reflection
+type typedForwarder interface {
+	//recv a msg and dispatch it, return false when chan is closed
+	forward(e *RoutedChan) bool
+}
+
 func (e *RoutedChan) senderLoop() {
+	tf, typed := e.Channel.(typedForwarder)
 	cont := true
 	for cont {
 		e.bindLock.Lock()
@@ -127,29 +265,87 @@ func (e *RoutedChan) senderLoop() {
 			e.bindCond.Wait()
 		}
 		e.bindLock.Unlock()
-		v, chOpen := e.Channel.Recv()
-		if chOpen {
-			e.bindLock.Lock()
-			if len(e.bindings) > 0 {
-				e.inDisp = true
-			}
-			e.bindLock.Unlock()
-			if e.inDisp {
-				e.dispatcher.Dispatch(v, e.bindings)
-			}
-			e.bindLock.Lock()
-			e.inDisp = false
-			if len(e.opBuf) > 0 {
-				e.runPendingOps()
-			}
-			e.bindLock.Unlock()
+		if typed {
+			cont = tf.forward(e)
 		} else {
-			e.router.detach(e, true)
-			cont = false
+			cont = e.forward()
 		}
 	}
 }
 
+func (e *RoutedChan) forward() bool {
+	v, chOpen := e.recv()
+	if !chOpen {
+		e.router.detach(e, true)
+		return false
+	}
+	wrap := e.beginDispatch()
+	if e.inDisp {
+		e.dispatch(v, wrap)
+	} else {
+		//all recvers detached while waiting for msg
+		e.countDrop()
+	}
+	e.endDispatch()
+	return true
+}
+
+//mark dispatching in progress, so bindings changes are buffered till endDispatch();
+//return if msgs should be wrapped in envelopes
+func (e *RoutedChan) beginDispatch() bool {
+	e.bindLock.Lock()
+	defer e.bindLock.Unlock()
+	if len(e.bindings) > 0 {
+		e.inDisp = true
+	}
+	//when tracing, always wrap app msgs to carry trace context
+	return (e.numEnvPeers > 0 || e.router.tracing) && e.Id.SysIdIndex() < 0
+}
+
+func (e *RoutedChan) endDispatch() {
+	e.bindLock.Lock()
+	defer e.bindLock.Unlock()
+	e.inDisp = false
+	if len(e.opBuf) > 0 {
+		e.runPendingOps()
+	}
+}
+
+//recv from send chan; a panicking chan is treated as closed
+func (e *RoutedChan) recv() (v reflect.Value, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.router.chanPanic(e, "recv from", r)
+			ok = false
+		}
+	}()
+	return e.Channel.Recv()
+}
+
+//dispatch msg to bound recvers, recovering panics in dispatch policy
+func (e *RoutedChan) dispatch(v reflect.Value, wrap bool) {
+	var span Span
+	defer func() {
+		if span != nil {
+			span.End()
+		}
+		if r := recover(); r != nil {
+			e.countDrop()
+			e.router.chanPanic(e, "dispatch from", r)
+		}
+	}()
+	v = e.envelope(v, wrap)
+	if e.router.tracing && isEnvelope(v) {
+		//the envelope could be delivered to recvers already, set span context on a copy
+		env := *v.Interface().(*Envelope)
+		span = e.router.startSpan("send", e.Id, env.Trace)
+		env.Trace = span.Context()
+		v = reflect.ValueOf(&env)
+	}
+	atomic.AddUint64(&e.stats.sent, 1)
+	e.dispatcher.Dispatch(v, e.bindings)
+}
+
 func (e *RoutedChan) runPendingOps() {
 	for i := 0; i < len(e.opBuf); i++ {
 		op := e.opBuf[i]
@@ -177,6 +373,12 @@ func (e *RoutedChan) Detach() {
 
 func (e *RoutedChan) attachImpl(p *RoutedChan) {
 	e.bindings = append(e.bindings, p)
+	if p.wantEnvelope {
+		e.numEnvPeers++
+	}
+	if e.Dir == reflect.SendDir {
+		atomic.AddUint64(&e.stats.binds, 1)
+	}
 	if e.bindChan != nil {
 		//KeepLatest non-blocking send
 	L:
@@ -210,6 +412,12 @@ func (e *RoutedChan) attach(p *RoutedChan) {
 func (e *RoutedChan) detachImpl(p *RoutedChan) {
 	for i, v := range e.bindings {
 		if v == p {
+			if p.wantEnvelope {
+				e.numEnvPeers--
+			}
+			if e.Dir == reflect.SendDir {
+				atomic.AddUint64(&e.stats.unbinds, 1)
+			}
 			n := len(e.bindings)
 			copy(e.bindings[i:], e.bindings[i+1:])
 			e.bindings[n-1] = nil
@@ -30,8 +30,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //Default size settings in router
@@ -72,7 +75,8 @@ type Router interface {
 	//Connect to a remote router thru io conn
 	//1. io.ReadWriteCloser: transport connection
 	//2. MarshalingPolicy: gob or json marshaling
-	//3. remaining args can be a FlowControlPolicy (e.g. window based or XOnOff)
+	//3. remaining args can be a FlowControlPolicy (e.g. window based, credit based or XOnOff),
+	//   a *StreamBatching, or ConnOptions such as ExportRecords and MatchAnyType
 	ConnectRemote(io.ReadWriteCloser, MarshalingPolicy, ...interface{}) (Proxy, error)
 
 	//--- other utils ---
@@ -85,6 +89,22 @@ type Router interface {
 	//return all ids and their ChanTypes from router's namespace which satisfy predicate
 	IdsForSend(predicate func(id Id) bool) map[interface{}]*ChanInfo
 	IdsForRecv(predicate func(id Id) bool) map[interface{}]*ChanInfo
+
+	//return a snapshot of msg counters for ids and proxies
+	Stats() *RouterStats
+
+	//return the routing table entries for ids satisfying predicate, with attached chans and their bindings
+	Routes(predicate func(id Id) bool) []*RouteInfo
+
+	//set the min priority of log records from source src (the log name of router, proxy or stream);
+	//records less severe (in order of LOG_DEBUG, LOG_INFO, LOG_WARN, LOG_ERROR) are dropped
+	//before they are created. empty src sets the default for sources without their own setting
+	SetLogLevel(src string, p LogPriority)
+	//set time-to-live of msgs of id queued in router, expired msgs are dropped before delivery;
+	//ttl <= 0 removes it
+	SetTTL(id Id, ttl time.Duration)
+	//set priority class of id, used to schedule msgs of id sent to remote routers
+	SetPriority(id Id, p Priority)
 }
 
 //Major data structures for router:
@@ -95,6 +115,7 @@ type tblEntry struct {
 	id       Id
 	senders  map[interface{}]*RoutedChan
 	recvers  map[interface{}]*RoutedChan
+	stats    idCounters
 }
 
 type routerImpl struct {
@@ -109,15 +130,35 @@ type routerImpl struct {
 	routingTable   map[interface{}](*tblEntry)
 	sysIds         [NumSysInternalIds]Id
 	notifier       *notifier
+	mesh           *meshTable
+	broker         *brokerTable
 	proxLock       sync.Mutex
 	proxies        []Proxy
 	bufSizeLock    sync.Mutex
 	recvBufSizes   map[interface{}]int
+	highWater      int
+	onOverflow     OverflowReaction
+	ttlLock        sync.RWMutex
+	ttls           map[interface{}]time.Duration
+	prioLock       sync.Mutex
+	priorities     map[interface{}]Priority
 	//for log/debug, if name != nil, debug is enabled
 	Logger
 	LogSink
 	FaultRaiser
-	name string
+	name     string
+	slogSink *SlogSink
+	//min log priorities by source and the loggers they apply to
+	logLevelLock sync.Mutex
+	logLevels    map[string]LogPriority
+	loggers      map[*logger]bool
+	//tracing hooks
+	tracer  Tracer
+	tracing bool
+	//reaction to panics in user callbacks and chans
+	panicReaction PanicReaction
+	//slow consumer detection for recv chans, nil if disabled
+	slowPolicy *SlowConsumerPolicy
 }
 
 func (s *routerImpl) NewSysID(idx int, args ...int) Id {
@@ -137,13 +178,21 @@ func (s *routerImpl) SysID(indx int) Id {
 }
 
 func (s *routerImpl) IdsForSend(predicate func(id Id) bool) map[interface{}]*ChanInfo {
+	return s.idsForSend(func(id Id) bool { return id.SysIdIndex() < 0 && predicate(id) })
+}
+
+func (s *routerImpl) IdsForRecv(predicate func(id Id) bool) map[interface{}]*ChanInfo {
+	return s.idsForRecv(func(id Id) bool { return id.SysIdIndex() < 0 && predicate(id) })
+}
+
+//idsForSend/idsForRecv don't skip sys ids, so proxies can export log/fault ids
+func (s *routerImpl) idsForSend(predicate func(id Id) bool) map[interface{}]*ChanInfo {
 	ids := make(map[interface{}]*ChanInfo)
 	s.tblLock.Lock()
 	defer s.tblLock.Unlock()
 	for _, v := range s.routingTable {
 		for _, e := range v.senders {
-			idx := e.Id.SysIdIndex()
-			if idx < 0 && predicate(e.Id) {
+			if predicate(e.Id) {
 				ids[e.Id.Key()] = &ChanInfo{Id: e.Id, ChanType: v.chanType}
 			}
 		}
@@ -151,14 +200,13 @@ func (s *routerImpl) IdsForSend(predicate func(id Id) bool) map[interface{}]*Cha
 	return ids
 }
 
-func (s *routerImpl) IdsForRecv(predicate func(id Id) bool) map[interface{}]*ChanInfo {
+func (s *routerImpl) idsForRecv(predicate func(id Id) bool) map[interface{}]*ChanInfo {
 	ids := make(map[interface{}]*ChanInfo)
 	s.tblLock.Lock()
 	defer s.tblLock.Unlock()
 	for _, v := range s.routingTable {
 		for _, e := range v.recvers {
-			idx := e.Id.SysIdIndex()
-			if idx < 0 && predicate(e.Id) {
+			if predicate(e.Id) {
 				ids[e.Id.Key()] = &ChanInfo{Id: e.Id, ChanType: v.chanType}
 			}
 		}
@@ -181,8 +229,13 @@ func (s *routerImpl) AttachSendChan(id Id, v interface{}, args ...interface{}) (
 		//s.Raise(err)
 		return
 	}
-	ch, internalChan := v.(Channel)
-	if !internalChan {
+	ch, isChannel := v.(Channel)
+	//typed chans are created for users, attached and type checked as plain chans
+	_, typed := v.(typedForwarder)
+	//so are proxy chans carrying msgs from peer
+	_, fromPeer := v.(*peerChan)
+	internalChan := isChannel && !typed && !fromPeer
+	if !isChannel {
 		ch1 := reflect.ValueOf(v)
 		if ch1.Kind() != reflect.Chan {
 			err = errors.New(errInvalidChan)
@@ -192,10 +245,11 @@ func (s *routerImpl) AttachSendChan(id Id, v interface{}, args ...interface{}) (
 		}
 		ch = ch1
 	}
-	l := len(args)
 	var bindChan chan *BindEvent
-	if l > 0 {
-		switch cv := args[0].(type) {
+	var envChanType reflect.Type
+	var owner *proxyImpl
+	for i := 0; i < len(args); i++ {
+		switch cv := args[i].(type) {
 		case chan *BindEvent:
 			bindChan = cv
 			if cap(bindChan) == 0 {
@@ -204,6 +258,12 @@ func (s *routerImpl) AttachSendChan(id Id, v interface{}, args ...interface{}) (
 				//s.Raise(err)
 				return
 			}
+		case reflect.Type:
+			//chan type of bare msgs sent thru envelope chan
+			envChanType = cv
+		case *proxyImpl:
+			//chan attached by proxy on behalf of peer
+			owner = cv
 		default:
 			err = errors.New("invalid arguments to attach send chan")
 			s.LogError(err)
@@ -211,8 +271,22 @@ func (s *routerImpl) AttachSendChan(id Id, v interface{}, args ...interface{}) (
 			return
 		}
 	}
+	envChan := !isChannel && ch.Type() == envelopeChanType
+	if envChan {
+		if envChanType, err = s.envelopeChanType(id, envChanType); err != nil {
+			s.LogError(err)
+			return
+		}
+		ch = newEnvelopeChan(ch.(reflect.Value), envChanType)
+	} else if !isChannel {
+		//plain chans with fast path enabled are delivered without reflection
+		if fc := fastChan(ch.(reflect.Value)); fc != nil {
+			ch = fc
+		}
+	}
 	routCh = newRoutedChan(id, reflect.SendDir, ch, s, bindChan)
 	routCh.internalChan = internalChan
+	routCh.proxy = owner
 	err = s.attach(routCh)
 	if err != nil {
 		s.LogError(err)
@@ -232,8 +306,12 @@ func (s *routerImpl) AttachRecvChan(id Id, v interface{}, args ...interface{}) (
 		//s.Raise(err)
 		return
 	}
-	ch, internalChan := v.(Channel)
-	if !internalChan {
+	ch, isChannel := v.(Channel)
+	//typed chans are created for users, attached and type checked as plain chans
+	_, typed := v.(typedForwarder)
+	internalChan := isChannel && !typed
+	var ac *asyncChan //buffer of async router
+	if !isChannel {
 		ch1 := reflect.ValueOf(v)
 		if ch1.Kind() != reflect.Chan {
 			err = errors.New(errInvalidChan)
@@ -244,6 +322,8 @@ func (s *routerImpl) AttachRecvChan(id Id, v interface{}, args ...interface{}) (
 		ch = ch1
 	}
 	var bindChan chan *BindEvent
+	var envChanType reflect.Type
+	var owner *proxyImpl
 	for i := 0; i < len(args); i++ {
 		switch cv := args[i].(type) {
 		case chan *BindEvent:
@@ -254,6 +334,12 @@ func (s *routerImpl) AttachRecvChan(id Id, v interface{}, args ...interface{}) (
 				//s.Raise(err)
 				return
 			}
+		case reflect.Type:
+			//chan type of bare msgs recved thru envelope chan or proxy chan
+			envChanType = cv
+		case *proxyImpl:
+			//chan attached by proxy on behalf of peer
+			owner = cv
 		case int:
 			//set recv chan buffer size
 			s.bufSizeLock.Lock()
@@ -269,13 +355,48 @@ func (s *routerImpl) AttachRecvChan(id Id, v interface{}, args ...interface{}) (
 			return
 		}
 	}
+	envChan := !isChannel && ch.Type() == envelopeChanType
+	if envChan {
+		if envChanType, err = s.envelopeChanType(id, envChanType); err != nil {
+			s.LogError(err)
+			return
+		}
+		ch = newEnvelopeChan(ch.(reflect.Value), envChanType)
+	} else if !isChannel {
+		//plain chans with fast path enabled are delivered without reflection
+		if fc := fastChan(ch.(reflect.Value)); fc != nil {
+			ch = fc
+		}
+	}
 	if s.async && ch.Cap() != UnlimitedBuffer && !internalChan {
 		//for async router, external recv chans must have unlimited buffering, 
 		//ie. Cap()==-1, all undelivered msgs will be buffered right before ext recv chans
-		ch = &asyncChan{Channel: ch}
+		ac = &asyncChan{Channel: ch, expired: s.queueExpiry(id), limit: s.highWater, onFull: s.onOverflow}
+		ch = ac
 	}
 	routCh = newRoutedChan(id, reflect.RecvDir, ch, s, bindChan)
+	if ac != nil {
+		ac.full, ac.overflow = s.recvOverflow(routCh)
+		ac.panicked = func(r interface{}) {
+			routCh.countDrop()
+			s.chanPanic(routCh, "delivery to", r)
+		}
+	}
 	routCh.internalChan = internalChan
+	//envelope chans want envelopes, proxy forwarding chans pass them thru as they are,
+	//all other recvers get bare msgs
+	routCh.wantEnvelope = envChan
+	routCh.unwrapEnvelope = !envChan && ch.Type() != genericMsgChanType
+	routCh.proxy = owner
+	if !envChan {
+		routCh.msgType = envChanType
+	}
+	if s.mesh != nil && owner != nil && id.SysIdIndex() < 0 {
+		//in mesh mode, msgs are forwarded in envelopes to carry their origins
+		routCh.wantEnvelope = true
+		routCh.unwrapEnvelope = false
+		routCh.meshWant = owner.meshWant(id)
+	}
 	err = s.attach(routCh)
 	if err != nil {
 		s.LogError(err)
@@ -335,17 +456,24 @@ func (s *routerImpl) attach(routCh *RoutedChan) (err error) {
 	//router entry
 	ent, ok := s.routingTable[routCh.Id.Key()]
 	if !ok {
+		chanType := routCh.Channel.Type()
 		if routCh.internalChan {
-			err = errors.New(fmt.Sprintf("%s %v", errChanGenericType, routCh.Id))
-			s.LogError(err)
-			s.tblLock.Unlock()
-			return
+			//in mesh or broker mode, proxy chans relaying msgs between peers could be attached first
+			if s.relayChan(routCh) && chanType == genericMsgChanType {
+				chanType = routCh.msgType
+			}
+			if !s.relayChan(routCh) || chanType == nil {
+				err = errors.New(fmt.Sprintf("%s %v", errChanGenericType, routCh.Id))
+				s.LogError(err)
+				s.tblLock.Unlock()
+				return
+			}
 		}
 		//first routedChan attached to this id, add a router-entry for this id
 		ent = &tblEntry{}
 		s.routingTable[routCh.Id.Key()] = ent
 		ent.id = routCh.Id // will only use the Val/Match() part of id
-		ent.chanType = routCh.Channel.Type()
+		ent.chanType = chanType
 		ent.senders = make(map[interface{}]*RoutedChan)
 		ent.recvers = make(map[interface{}]*RoutedChan)
 	} else {
@@ -357,6 +485,14 @@ func (s *routerImpl) attach(routCh *RoutedChan) (err error) {
 		}
 	}
 
+	routCh.stats = &ent.stats
+	//force broadcaster for system ids
+	if routCh.Id.SysIdIndex() >= 0 {
+		routCh.dispPolicy = BroadcastPolicy
+	} else {
+		routCh.dispPolicy = s.dispPolicy
+	}
+
 	//check for duplicate
 	switch routCh.Dir {
 	case reflect.SendDir:
@@ -387,15 +523,15 @@ func (s *routerImpl) attach(routCh *RoutedChan) (err error) {
 		switch routCh.Dir {
 		case reflect.SendDir:
 			for _, recver := range ent.recvers {
-				if scope_match(routCh.Id, recver.Id) {
-					s.Log(LOG_INFO, fmt.Sprintf("add bindings: %v -> %v", routCh.Id, recver.Id))
+				if scope_match(routCh.Id, recver.Id) || s.relayMatch(routCh, recver) {
+					s.Logf(LOG_INFO, "add bindings: %v -> %v", routCh.Id, recver.Id)
 					matches = append(matches, recver)
 				}
 			}
 		case reflect.RecvDir:
 			for _, sender := range ent.senders {
-				if scope_match(sender.Id, routCh.Id) {
-					s.Log(LOG_INFO, fmt.Sprintf("add bindings: %v -> %v", sender.Id, routCh.Id))
+				if scope_match(sender.Id, routCh.Id) || s.relayMatch(sender, routCh) {
+					s.Logf(LOG_INFO, "add bindings: %v -> %v", sender.Id, routCh.Id)
 					matches = append(matches, sender)
 				}
 			}
@@ -408,15 +544,15 @@ func (s *routerImpl) attach(routCh *RoutedChan) (err error) {
 					switch routCh.Dir {
 					case reflect.SendDir:
 						for _, recver := range ent2.recvers {
-							if scope_match(routCh.Id, recver.Id) {
-								s.Log(LOG_INFO, fmt.Sprintf("add bindings: %v -> %v", routCh.Id, recver.Id))
+							if scope_match(routCh.Id, recver.Id) || s.relayMatch(routCh, recver) {
+								s.Logf(LOG_INFO, "add bindings: %v -> %v", routCh.Id, recver.Id)
 								matches = append(matches, recver)
 							}
 						}
 					case reflect.RecvDir:
 						for _, sender := range ent2.senders {
-							if scope_match(sender.Id, routCh.Id) {
-								s.Log(LOG_INFO, fmt.Sprintf("add bindings: %v -> %v", sender.Id, routCh.Id))
+							if scope_match(sender.Id, routCh.Id) || s.relayMatch(sender, routCh) {
+								s.Logf(LOG_INFO, "add bindings: %v -> %v", sender.Id, routCh.Id)
 								matches = append(matches, sender)
 							}
 						}
@@ -445,15 +581,10 @@ func (s *routerImpl) attach(routCh *RoutedChan) (err error) {
 	}
 
 	//activate
-	//force broadcaster for system ids
-	if idx >= 0 { //sys ids
-		routCh.start(BroadcastPolicy)
-	} else {
-		routCh.start(s.dispPolicy)
-	}
+	routCh.start()
 
 	//notifier will send in a separate goroutine, so non-blocking here
-	if idx < 0 && routCh.Id.Member() == MemberLocal { //not sys ids
+	if (idx < 0 || exportedSysId(idx)) && routCh.Id.Member() == MemberLocal { //app ids and log/fault ids
 		switch routCh.Dir {
 		case reflect.SendDir:
 			s.notifier.notify(PubId, &ChanInfo{Id: routCh.Id, ChanType: routCh.Channel.Type()})
@@ -540,7 +671,7 @@ func (s *routerImpl) detach(routCh *RoutedChan, bySelf bool) (err error) {
 	routerClosed := s.closed
 	s.tblLock.Unlock()
 	idx := routCh1.Id.SysIdIndex()
-	if !routerClosed && idx < 0 && routCh1.Id.Member() == MemberLocal { //not sys ids
+	if !routerClosed && (idx < 0 || exportedSysId(idx)) && routCh1.Id.Member() == MemberLocal { //app ids and log/fault ids
 		switch routCh1.Dir {
 		case reflect.SendDir:
 			s.notifier.notify(UnPubId, &ChanInfo{Id: routCh1.Id, ChanType: routCh1.Channel.Type()})
@@ -600,7 +731,16 @@ func (s *routerImpl) shutdown() {
 	s.FaultRaiser.Close()
 	s.Logger.Close()
 	s.LogSink.Close()
+	if s.slogSink != nil {
+		s.slogSink.Close()
+	}
 	s.notifier.Close()
+	if s.mesh != nil {
+		s.mesh.Close()
+	}
+	if s.broker != nil {
+		s.broker.Close()
+	}
 }
 
 func (s *routerImpl) initSysIds() {
@@ -619,6 +759,37 @@ func (s *routerImpl) recvChanBufSize(id Id) int {
 	return s.defChanBufSize
 }
 
+func (s *routerImpl) SetLogLevel(src string, p LogPriority) {
+	s.logLevelLock.Lock()
+	defer s.logLevelLock.Unlock()
+	s.logLevels[src] = p
+	for l := range s.loggers {
+		if _, own := s.logLevels[l.source]; l.source == src || (len(src) == 0 && !own) {
+			atomic.StoreInt32(&l.minSev, p.severity())
+		}
+	}
+}
+
+//register logger and apply log level of its source
+func (s *routerImpl) addLogger(l *logger) {
+	s.logLevelLock.Lock()
+	defer s.logLevelLock.Unlock()
+	p, ok := s.logLevels[l.source]
+	if !ok {
+		if p, ok = s.logLevels[""]; !ok {
+			p = LOG_DEBUG
+		}
+	}
+	atomic.StoreInt32(&l.minSev, p.severity())
+	s.loggers[l] = true
+}
+
+func (s *routerImpl) delLogger(l *logger) {
+	s.logLevelLock.Lock()
+	defer s.logLevelLock.Unlock()
+	delete(s.loggers, l)
+}
+
 func (s *routerImpl) addProxy(p Proxy) {
 	s.Log(LOG_INFO, "add proxy")
 	s.proxLock.Lock()
@@ -668,33 +839,75 @@ func (r *routerImpl) ConnectRemote(rwc io.ReadWriteCloser, mar MarshalingPolicy,
        name:     router's name, if name is defined, router internal logging will be turned on, ie LogRecord generated
        LogScope: if this is set, a console log sink is installed to show router internal log
           if logScope == ScopeLocal, only log msgs from local router will show up
-          if logScope == ScopeGlobal, all log msgs from connected routers will show up
+          if logScope == ScopeGlobal, all log msgs from connected routers will show up,
+          from connections exchanging records (see ExportRecords)
+       Tracer:   if this is set, msgs passing thru router are traced
+       *slog.Logger: if this is set, router internal log (ScopeLocal) is sent to this logger;
+          records not enabled in its handler are dropped at source
+       PanicReaction: how to react to panics in dispatch policies, chans, IdFilters and IdTranslators
+       HighWaterMark: max number of msgs buffered before a recv chan of async router, or in a
+          stream connection to remote router; senders block when it is reached
+       OverflowReaction: how msgs beyond HighWaterMark of a recv chan are handled
+       SlowConsumerPolicy: detect (and detach) recv chans which block delivery too long
+       MeshRouting: relay msgs thru routers connected in any topology, router must have a name
+       BrokerMode: forward pubs/subs and msgs between connected client routers, with per-client limits
 */
 func New(seedId Id, bufSize int, disp DispatchPolicy, args ...interface{}) Router {
-	//parse optional router name and flag for enable console logging
+	//parse optional router name, flag for enable console logging and other settings
 	var name string
 	consoleLogScope := -1
-	l := len(args)
-	if l > 0 {
-		if sv, ok := args[0].(string); !ok {
-			return nil
-		} else {
-			name = sv
-		}
-	}
-	if l > 1 {
-		if iv, ok := args[1].(int); !ok {
-			return nil
-		} else {
-			consoleLogScope = iv
+	var tracer Tracer = NoopTracer
+	var slogger *slog.Logger
+	panicReaction := DropOnPanic
+	highWater := 0
+	overflowReaction := BlockOnOverflow
+	var slowPolicy *SlowConsumerPolicy
+	var mesh *MeshRouting
+	var broker *BrokerMode
+	for _, arg := range args {
+		switch av := arg.(type) {
+		case string:
+			name = av
+		case int:
+			consoleLogScope = av
 			if consoleLogScope < ScopeGlobal || consoleLogScope > ScopeLocal {
 				return nil
 			}
+		case Tracer:
+			tracer = av
+		case *slog.Logger:
+			slogger = av
+		case PanicReaction:
+			panicReaction = av
+		case HighWaterMark:
+			highWater = int(av)
+		case OverflowReaction:
+			overflowReaction = av
+		case SlowConsumerPolicy:
+			if av.Threshold > 0 {
+				slowPolicy = &av
+			}
+		case MeshRouting:
+			mesh = &av
+		case BrokerMode:
+			broker = &av
+		default:
+			return nil
 		}
 	}
+	if mesh != nil && (len(name) == 0 || broker != nil) {
+		//router name is its id in mesh; broker's clients are not in mesh
+		return nil
+	}
 	//create a new router
 	router := &routerImpl{}
 	router.name = name
+	router.tracer = tracer
+	router.tracing = tracer != NoopTracer
+	router.panicReaction = panicReaction
+	router.highWater = highWater
+	router.onOverflow = overflowReaction
+	router.slowPolicy = slowPolicy
 	router.seedId = seedId
 	router.idType = reflect.TypeOf(router.seedId)
 	router.matchType = router.seedId.MatchType()
@@ -708,11 +921,28 @@ func New(seedId Id, bufSize int, disp DispatchPolicy, args ...interface{}) Route
 	router.dispPolicy = disp
 	router.routingTable = make(map[interface{}](*tblEntry))
 	router.recvBufSizes = make(map[interface{}]int)
+	router.ttls = make(map[interface{}]time.Duration)
+	router.priorities = make(map[interface{}]Priority)
 	router.notifier = newNotifier(router)
+	if mesh != nil {
+		router.mesh = newMeshTable(router, *mesh)
+	}
+	if broker != nil {
+		router.broker = newBrokerTable(router, *broker)
+	}
+	router.logLevels = make(map[string]LogPriority)
+	router.loggers = make(map[*logger]bool)
+	if slogger != nil {
+		//drop records at source which slog handler will not handle
+		router.logLevels[""] = minEnabledPri(slogger.Handler())
+	}
 	router.Logger.Init(router.SysID(RouterLogId), router, router.name)
 	if consoleLogScope >= ScopeGlobal && consoleLogScope <= ScopeLocal {
 		router.LogSink.Init(router.NewSysID(RouterLogId, consoleLogScope), router)
 	}
+	if slogger != nil {
+		router.slogSink = NewSlogSink(router.NewSysID(RouterLogId, ScopeLocal), router, slogger.Handler())
+	}
 	router.FaultRaiser.Init(router.SysID(RouterFaultId), router, router.name)
 	return router
 }
@@ -7,9 +7,25 @@
 package router
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestStrId(t *testing.T) {
@@ -158,3 +174,1659 @@ func TestRemoteConn(t *testing.T) {
 	}()
 	<-srvdone
 }
+
+func TestEnvelope(t *testing.T) {
+	rout1 := New(StrID(), 32, BroadcastPolicy, "router1")
+	rout2 := New(StrID(), 32, BroadcastPolicy, "router2")
+	c1, c2 := net.Pipe()
+	go rout2.ConnectRemote(c2, GobMarshaling)
+	if _, err := rout1.ConnectRemote(c1, GobMarshaling); err != nil {
+		t.Fatal(err)
+	}
+	cho := make(chan *Envelope)
+	chi1 := make(chan string, 1)
+	chi2 := make(chan *Envelope, 1)
+	bound := make(chan *BindEvent, 1)
+	if _, err := rout2.AttachRecvChan(StrID("test"), chi1); err != nil {
+		t.Fatal("TestEnvelope failed at router.AttachRecvChan-chi1")
+	}
+	if _, err := rout2.AttachRecvChan(StrID("test"), chi2); err != nil {
+		t.Fatal("TestEnvelope failed at router.AttachRecvChan-chi2")
+	}
+	if _, err := rout1.AttachSendChan(StrID("test"), cho, bound, reflect.TypeOf(chi1)); err != nil {
+		t.Fatal("TestEnvelope failed at router.AttachSendChan")
+	}
+	<-bound
+	sent := &Envelope{CorrelationId: "c1", Data: "hello"}
+	cho <- sent
+	if v := <-chi1; v != "hello" {
+		t.Errorf("TestEnvelope failed at chi1, expected [hello], recv : %v", v)
+	}
+	env := <-chi2
+	if env.Data != "hello" || env.CorrelationId != "c1" || env.Origin != "router1" || env.Timestamp == 0 {
+		t.Errorf("TestEnvelope failed at chi2, recv : %v", env)
+	}
+	//envelopes are read only, router stamps a copy
+	if sent.Origin != "" || sent.Timestamp != 0 {
+		t.Errorf("TestEnvelope failed, sent envelope changed: %v", sent)
+	}
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+}
+
+func TestTracing(t *testing.T) {
+	tracer := NewTraceRecorder()
+	rout1 := New(StrID(), 32, BroadcastPolicy, "router1", tracer)
+	rout2 := New(StrID(), 32, BroadcastPolicy, "router2", tracer)
+	c1, c2 := net.Pipe()
+	go rout2.ConnectRemote(c2, GobMarshaling)
+	if _, err := rout1.ConnectRemote(c1, GobMarshaling); err != nil {
+		t.Fatal(err)
+	}
+	cho := make(chan string)
+	chi := make(chan string)
+	bound := make(chan *BindEvent, 1)
+	rout2.AttachRecvChan(StrID("test"), chi)
+	rout1.AttachSendChan(StrID("test"), cho, bound)
+	<-bound
+	cho <- "hello"
+	<-chi
+	close(cho)
+	//spans are ended after msg delivered, wait for them
+	var spans []*SpanRecord
+	for i := 0; i < 100 && len(spans) < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		spans = tracer.Spans()
+	}
+	rout1.Close()
+	rout2.Close()
+	if len(spans) == 0 {
+		t.Fatal("TestTracing failed, no spans recorded")
+	}
+	names := make(map[string]int)
+	for _, s := range tracer.Trace(spans[0].TraceId) {
+		names[s.Name]++
+	}
+	//"send" spans at router1's send chan and router2's proxy chan
+	if names["send"] != 2 || names["proxy.out"] != 1 || names["proxy.in"] != 1 || names["deliver"] != 1 {
+		t.Errorf("TestTracing failed, spans in trace: %v", spans)
+	}
+
+	//forwarding a recved envelope does not change the trace context seen by its recvers
+	rout := New(StrID(), 32, BroadcastPolicy, tracer)
+	ea, eb := make(chan *Envelope, 1), make(chan *Envelope, 1)
+	rout.AttachRecvChan(StrID("a"), ea, reflect.TypeOf(make(chan string)))
+	rout.AttachRecvChan(StrID("b"), eb, reflect.TypeOf(make(chan string)))
+	sa, sb := make(chan *Envelope, 1), make(chan *Envelope, 1)
+	rout.AttachSendChan(StrID("a"), sa)
+	rout.AttachSendChan(StrID("b"), sb)
+	sa <- &Envelope{Data: "hello"}
+	env := <-ea
+	trace := env.Trace
+	sb <- env
+	fwd := <-eb
+	if env.Trace != trace || fwd.Trace.TraceId != trace.TraceId || fwd.Trace.SpanId == trace.SpanId {
+		t.Errorf("TestTracing failed, trace context of forwarded envelope: %v, %v", trace, fwd.Trace)
+	}
+	close(sa)
+	close(sb)
+	rout.Close()
+}
+
+func TestStats(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	cho := make(chan string)
+	chi := make(chan string)
+	rout.AttachSendChan(StrID("test"), cho)
+	rout.AttachRecvChan(StrID("test"), chi)
+	go func() {
+		cho <- "hello"
+		cho <- "world"
+	}()
+	<-chi
+	<-chi
+	//counters are updated after msgs delivered, wait for them
+	st := rout.Stats()
+	for i := 0; i < 100 && len(st.Ids) == 1 && st.Ids[0].Delivered < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		st = rout.Stats()
+	}
+	if len(st.Ids) != 1 || st.Ids[0].Key != "test" {
+		t.Fatalf("TestStats failed, ids: %v", st.Ids)
+	}
+	is := st.Ids[0]
+	if is.Sent != 2 || is.Delivered != 2 || is.Binds != 1 || len(is.Recvers) != 1 {
+		t.Errorf("TestStats failed, stats: %+v", is)
+	}
+	w := new(bytes.Buffer)
+	writePromStats(w, []*RouterStats{st})
+	if !strings.Contains(w.String(), `router_msgs_sent_total{router="",id="test"} 2`) {
+		t.Errorf("TestStats failed, prometheus output: %s", w.String())
+	}
+	close(cho)
+	rout.Close()
+}
+
+func TestRoutes(t *testing.T) {
+	rout1 := New(PathID(), 32, BroadcastPolicy)
+	rout2 := New(PathID(), 32, BroadcastPolicy)
+	if _, _, err := rout1.Connect(rout2); err != nil {
+		t.Fatal(err)
+	}
+	cho := make(chan int)
+	chi := make(chan int)
+	bound := make(chan *BindEvent, 1)
+	rout1.AttachSendChan(PathID("/test/a"), cho, bound)
+	rout2.AttachRecvChan(PathID("/test/*"), chi)
+	<-bound
+	routes := rout1.Routes(func(id Id) bool { return id.SysIdIndex() < 0 })
+	if len(routes) != 1 || len(routes[0].Senders) != 1 || len(routes[0].Recvers) != 1 {
+		t.Fatalf("TestRoutes failed, routes: %v", routes)
+	}
+	snd := routes[0].Senders[0]
+	if snd.Dispatch != "BroadcastPolicy" || len(snd.Peers) != 1 || snd.Peers[0].Proxy != "proxy0" {
+		t.Errorf("TestRoutes failed, sender: %+v", snd)
+	}
+	if routes[0].Recvers[0].Proxy != "proxy0" || routes[0].Recvers[0].Id.Member() != MemberRemote {
+		t.Errorf("TestRoutes failed, recver: %+v", routes[0].Recvers[0])
+	}
+	close(cho)
+	rout2.Close()
+	rout1.Close()
+}
+
+func TestAdmin(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy, "admin")
+	admin := NewAdminHandler(rout)
+	cho := make(chan string)
+	chi := make(chan string)
+	rout.AttachSendChan(StrID("test"), cho)
+	rout.AttachRecvChan(StrID("test"), chi)
+	rout.(*routerImpl).Log(LOG_INFO, "hello admin")
+	//log records are collected asynchronously, wait for them
+	for i := 0; i < 100 && len(admin.logs.list()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+	var v adminView
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("TestAdmin failed, invalid json: %v", err)
+	}
+	found := false
+	for _, r := range v.Routes {
+		if r.Id == "test" && len(r.Senders) == 1 && len(r.Recvers) == 1 && r.BufSize == 32 {
+			found = true
+		}
+	}
+	if v.Router != "admin" || !found || len(v.Logs) == 0 || v.Logs[len(v.Logs)-1].Info != "hello admin" {
+		t.Errorf("TestAdmin failed, view: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "<td>hello admin</td>") {
+		t.Errorf("TestAdmin failed, html: %s", w.Body.String())
+	}
+	admin.Close()
+	close(cho)
+	rout.Close()
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) waitFor(s string) bool {
+	for i := 0; i < 100; i++ {
+		b.Lock()
+		found := strings.Contains(b.String(), s)
+		b.Unlock()
+		if found {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+type countingStringer struct{ count *int }
+
+func (c countingStringer) String() string {
+	*c.count++
+	return "counted"
+}
+
+func TestSlog(t *testing.T) {
+	buf := new(lockedBuffer)
+	rout := New(StrID(), 32, BroadcastPolicy, "slogtest", slog.New(slog.NewTextHandler(buf, nil)))
+	rt := rout.(*routerImpl)
+	rt.LogId(LOG_INFO, StrID("test"), "hello")
+	if !buf.waitFor(`msg=hello logger=slogtest id=test router=slogtest`) {
+		t.Errorf("TestSlog failed, output: %s", buf.String())
+	}
+	//debug is not enabled in handler, so dropped at source
+	if rt.LogEnabled(LOG_DEBUG) {
+		t.Errorf("TestSlog failed, debug log enabled")
+	}
+	rout.SetLogLevel("slogtest", LOG_WARN)
+	if rt.LogEnabled(LOG_INFO) || !rt.LogEnabled(LOG_ERROR) {
+		t.Errorf("TestSlog failed, log level not applied")
+	}
+	rt.Log(LOG_INFO, "dropped")
+	//msgs of disabled levels are not formatted
+	formatted := 0
+	rt.Logf(LOG_INFO, "dropped %v", countingStringer{&formatted})
+	if formatted != 0 {
+		t.Errorf("TestSlog failed, disabled log formatted")
+	}
+	rt.Logf(LOG_ERROR, "failed %d", 1)
+	if !buf.waitFor(`level=ERROR msg="failed 1"`) {
+		t.Errorf("TestSlog failed, output: %s", buf.String())
+	}
+	rout.Close()
+	if strings.Contains(buf.String(), "dropped") {
+		t.Errorf("TestSlog failed, output: %s", buf.String())
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.log")
+	f, err := NewRotatingFile(path, 300, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//unrelated siblings are never removed as backups
+	sibling := path + ".conf"
+	os.WriteFile(sibling, []byte("keep"), 0644)
+	rout := New(StrID(), 32, BroadcastPolicy, "filetest")
+	sink := NewFileLogSink(rout.NewSysID(RouterLogId, ScopeGlobal), rout, f)
+	rt := rout.(*routerImpl)
+	for i := 0; i < 20; i++ {
+		rt.Log(LOG_INFO, "msg "+strconv.Itoa(i))
+	}
+	//records are written asynchronously, wait for the last one
+	var data []byte
+	for i := 0; i < 100 && !bytes.Contains(data, []byte(`"info":"msg 19"`)); i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(path)
+	}
+	sink.Close()
+	rout.Close()
+	if _, err := os.Stat(sibling); err != nil {
+		t.Errorf("TestFileSink failed, sibling removed: %v", err)
+	}
+	os.Remove(sibling)
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 3 {
+		t.Errorf("TestFileSink failed, files: %v", files)
+	}
+	for _, fn := range files {
+		data, _ := os.ReadFile(fn)
+		if len(data) > 300 {
+			t.Errorf("TestFileSink failed, file %s not rotated: %d bytes", fn, len(data))
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil || rec["source"] != "filetest" {
+				t.Errorf("TestFileSink failed, invalid record: %s", line)
+			}
+		}
+	}
+
+	//backups rotated before maxBackupAge are removed
+	path = filepath.Join(t.TempDir(), "aged.log")
+	aged := path + "." + time.Now().Add(-2*time.Hour).Format(rotateTimeFormat)
+	os.WriteFile(aged, []byte("old"), 0644)
+	if f, err = NewRotatingFile(path, 0, 0, 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Rotate()
+	f.Close()
+	if files, _ = filepath.Glob(path + ".*"); len(files) != 1 || files[0] == aged {
+		t.Errorf("TestFileSink failed, backups: %v", files)
+	}
+
+	//a global sink aggregates records of routers connected with ExportRecords
+	path = filepath.Join(t.TempDir(), "global.log")
+	if f, err = NewRotatingFile(path, 0, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	central := New(StrID(), 32, BroadcastPolicy)
+	sink = NewFileLogSink(central.NewSysID(RouterLogId, ScopeGlobal), central, f)
+	remote := New(StrID(), 32, BroadcastPolicy, "remote")
+	connectTCP(t, central, remote, ExportRecords)
+	rt = remote.(*routerImpl)
+	data = nil
+	for i := 0; i < 100 && !bytes.Contains(data, []byte(`"info":"remote msg"`)); i++ {
+		rt.Log(LOG_INFO, "remote msg")
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(path)
+	}
+	if !bytes.Contains(data, []byte(`"source":"remote","info":"remote msg"`)) {
+		t.Errorf("TestFileSink failed, records of remote router not in file: %s", data)
+	}
+	sink.Close()
+	remote.Close()
+	central.Close()
+}
+
+func TestSupervisor(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	top := NewSupervisor(rout, "top", StrID("/fault/top"), OneForOne, 5, time.Second)
+	sup := NewSupervisor(rout, "sup", StrID("/fault/sup"), OneForOne, 2, time.Second)
+	if err := top.AddSupervisor(sup); err != nil {
+		t.Fatal(err)
+	}
+	//closed supervisors cannot be adopted
+	done := NewSupervisor(rout, "done", StrID("/fault/done"), OneForOne, 2, time.Second)
+	done.Close()
+	if err := top.AddSupervisor(done); err == nil {
+		t.Errorf("TestSupervisor failed, closed supervisor added")
+	}
+	results := make(chan int, 1)
+	started := make(chan int, 1)
+	//task fails when recving negative numbers: panic for -1, raise fault for -2
+	err := sup.AddTask(&TaskSpec{
+		Name:  "task",
+		Chans: []*ChanSpec{{StrID("/in"), reflect.RecvDir, reflect.TypeOf(make(chan int)), 0}},
+		Run: func(ctx *TaskContext) {
+			in := ctx.RecvChan(StrID("/in")).(chan int)
+			started <- ctx.Restarts
+			for {
+				select {
+				case v := <-in:
+					switch v {
+					case -1:
+						panic("bad input")
+					case -2:
+						ctx.Raise(errors.New("bad input"))
+						<-ctx.Stop
+						return
+					default:
+						results <- v*10 + ctx.Restarts
+					}
+				case <-ctx.Stop:
+					return
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan int)
+	rout.AttachSendChan(StrID("/in"), in)
+	expect := func(results chan int, v int) {
+		select {
+		case r := <-results:
+			if r != v {
+				t.Errorf("TestSupervisor failed, expect %d, got %d", v, r)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("TestSupervisor failed, timeout waiting for %d", v)
+		}
+	}
+	expect(started, 0)
+	in <- 1
+	expect(results, 10)
+	in <- -1
+	expect(started, 1)
+	in <- 2
+	expect(results, 21)
+	in <- -2
+	expect(started, 2)
+	in <- 3
+	expect(results, 32)
+	//3rd failure within window escalates to top, which restarts sub-supervisor and its task
+	in <- -1
+	expect(started, 3)
+	in <- 4
+	expect(results, 43)
+	close(in)
+	top.Close()
+	rout.Close()
+}
+
+func TestPanicIsolation(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy, "panictest", DetachOnPanic)
+	faults := make(chan *FaultRecord, 1)
+	rout.AttachRecvChan(rout.SysID(RouterFaultId), faults)
+	cho := make(chan string)
+	chi1 := make(chan string)
+	chi2 := make(chan string, 1)
+	rout.AttachSendChan(StrID("test"), cho)
+	rout.AttachRecvChan(StrID("test"), chi1)
+	rout.AttachRecvChan(StrID("test"), chi2)
+	//closed by mistake, sending to it panics
+	close(chi1)
+	cho <- "hello"
+	if v := <-chi2; v != "hello" {
+		t.Errorf("TestPanicIsolation failed, recved %v", v)
+	}
+	select {
+	case fr := <-faults:
+		pe, ok := fr.Info.(*PanicError)
+		if !ok || !strings.Contains(pe.Stack, "RoutedChan") {
+			t.Errorf("TestPanicIsolation failed, fault: %v", fr.Info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestPanicIsolation failed, no fault raised")
+	}
+	//chi1 is detached, msgs still go to chi2
+	cho <- "world"
+	if v := <-chi2; v != "world" {
+		t.Errorf("TestPanicIsolation failed, recved %v", v)
+	}
+	routes := rout.Routes(func(id Id) bool { return id.SysIdIndex() < 0 })
+	if len(routes) != 1 || len(routes[0].Recvers) != 1 {
+		t.Errorf("TestPanicIsolation failed, routes: %v", routes)
+	}
+	close(cho)
+	rout.Close()
+}
+
+func TestCloseConnected(t *testing.T) {
+	//panics not handled as faults are logged to console
+	w := new(bytes.Buffer)
+	log.SetOutput(w)
+	defer log.SetOutput(os.Stderr)
+	rout1 := New(StrID(), 32, BroadcastPolicy)
+	rout2 := New(StrID(), 32, BroadcastPolicy)
+	p1, _, err := rout1.Connect(rout2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cho := make(chan int)
+	chi := make(chan int, 1)
+	bound := make(chan *BindEvent, 1)
+	rout1.AttachSendChan(StrID("test"), cho, bound)
+	rout2.AttachRecvChan(StrID("test"), chi)
+	<-bound
+	cho <- 1
+	if v := <-chi; v != 1 {
+		t.Errorf("TestCloseConnected failed, recved %v", v)
+	}
+	//both proxies and routers close the chans they share with owners, which is not a fault
+	p1.Close()
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(w.String(), "panic in close") {
+		t.Errorf("TestCloseConnected failed, logged: %s", w.String())
+	}
+}
+
+func TestTyped(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	snd, err := AttachSend[int](rout, StrID("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv1, _ := AttachRecv[int](rout, StrID("test"), 1)
+	rcv2, _ := AttachRecv[int](rout, StrID("test"), 1)
+	//plain chans are bound with typed chans too
+	chi := make(chan int, 1)
+	rout.AttachRecvChan(StrID("test"), chi)
+	if ev := <-snd.Binds; ev.Type != PeerAttach {
+		t.Errorf("TestTyped failed, bind event: %v", ev)
+	}
+	snd.Send(1)
+	v1, _ := rcv1.Recv()
+	v2, _ := rcv2.Recv()
+	if v1 != 1 || v2 != 1 || <-chi != 1 {
+		t.Errorf("TestTyped failed, recved: %v, %v", v1, v2)
+	}
+	//msgs from plain chans are delivered to typed recvers
+	cho := make(chan int)
+	rout.AttachSendChan(StrID("test"), cho)
+	cho <- 2
+	v1, _ = rcv1.Recv()
+	v2, _ = rcv2.Recv()
+	if v1 != 2 || v2 != 2 || <-chi != 2 {
+		t.Errorf("TestTyped failed, recved: %v, %v", v1, v2)
+	}
+	snd.Close()
+	close(cho)
+	for ev := range rcv1.Binds {
+		if ev.Type == EndOfData {
+			break
+		}
+	}
+	rcv1.Close()
+	rcv2.Close()
+	//unknown args are refused
+	if _, err := AttachSend[int](rout, StrID("test"), "bad"); err == nil {
+		t.Errorf("TestTyped failed, invalid arg of AttachSend accepted")
+	}
+	if _, err := AttachRecv[int](rout, StrID("test"), 1.5); err == nil {
+		t.Errorf("TestTyped failed, invalid arg of AttachRecv accepted")
+	}
+	rout.Close()
+}
+
+func TestFastPath(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	chi1 := make(chan string, 1)
+	chi2 := make(chan string, 1)
+	rout.AttachRecvChan(StrID("test"), chi1)
+	rout.AttachRecvChan(StrID("test"), chi2)
+	cho := make(chan string)
+	rout.AttachSendChan(StrID("test"), cho)
+	for _, v := range []string{"hello", ""} {
+		cho <- v
+		if v1, v2 := <-chi1, <-chi2; v1 != v || v2 != v {
+			t.Errorf("TestFastPath failed, sent %v, recved: %v, %v", v, v1, v2)
+		}
+	}
+	close(cho)
+	rout.Close()
+
+	//chans of interface{} take the reflect based path, which keeps envelopes sent as data
+	//as they are, also with dispatch policies without typed version
+	rout = New(StrID(), 32, KeepLatestBroadcastPolicy)
+	gin := make(chan interface{}, 1)
+	rout.AttachRecvChan(StrID("test"), gin)
+	gout := make(chan interface{})
+	rout.AttachSendChan(StrID("test"), gout)
+	for _, v := range []interface{}{1, "hello", nil, &Envelope{Data: "data"}} {
+		gout <- v
+		if v1 := <-gin; v1 != v {
+			t.Errorf("TestFastPath failed, sent %v, recved: %v", v, v1)
+		}
+	}
+	close(gout)
+	rout.Close()
+}
+
+//msg type without fast path, delivered thru reflect
+type reflectInt int
+
+func benchLocalDelivery[T ~int](b *testing.B, numRecvers int) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	var wg sync.WaitGroup
+	for i := 0; i < numRecvers; i++ {
+		ch := make(chan T, 64)
+		rout.AttachRecvChan(StrID("bench"), ch)
+		wg.Add(1)
+		go func() {
+			for n := 0; n < b.N; n++ {
+				<-ch
+			}
+			wg.Done()
+		}()
+	}
+	ch := make(chan T, 64)
+	rout.AttachSendChan(StrID("bench"), ch)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ch <- T(n)
+	}
+	wg.Wait()
+	b.StopTimer()
+	close(ch)
+	rout.Close()
+}
+
+func BenchmarkLocalDelivery(b *testing.B) {
+	for _, n := range []int{1, 4, 64} {
+		b.Run("reflect/"+strconv.Itoa(n), func(b *testing.B) { benchLocalDelivery[reflectInt](b, n) })
+		b.Run("fast/"+strconv.Itoa(n), func(b *testing.B) { benchLocalDelivery[int](b, n) })
+	}
+}
+
+//countingConn counts Write calls to a conn
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+//connect 2 routers thru loopback tcp conn with optional ConnectRemote args,
+//using gob marshaling unless another MarshalingPolicy is in args
+func connectTCP(tb testing.TB, r1, r2 Router, args ...interface{}) (c1, c2 *countingConn) {
+	mar := GobMarshaling
+	var connArgs []interface{}
+	for _, a := range args {
+		switch v := a.(type) {
+		case MarshalingPolicy:
+			mar = v
+		default:
+			connArgs = append(connArgs, a)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c1, c2 = &countingConn{Conn: conn}, &countingConn{Conn: <-accepted}
+	errs := make(chan error)
+	go func() {
+		_, err := r2.ConnectRemote(c2, mar, connArgs...)
+		errs <- err
+	}()
+	if _, err = r1.ConnectRemote(c1, mar, connArgs...); err != nil {
+		tb.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		tb.Fatal(err)
+	}
+	return
+}
+
+func TestStreamBatching(t *testing.T) {
+	rout1 := New(IntID(), 32, BroadcastPolicy)
+	rout2 := New(IntID(), 32, BroadcastPolicy)
+	c1, _ := connectTCP(t, rout1, rout2, &StreamBatching{MaxBatch: 10, FlushLatency: 50 * time.Millisecond})
+	chi := make(chan int, 100)
+	rout2.AttachRecvChan(IntID(10), chi)
+	//msgs are queued before recver bound, so sent in a burst
+	cho := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		cho <- i
+	}
+	bound := make(chan *BindEvent, 1)
+	writes := atomic.LoadInt64(&c1.writes)
+	rout1.AttachSendChan(IntID(10), cho, bound)
+	for i := 0; i < 100; i++ {
+		if v := <-chi; v != i {
+			t.Fatalf("TestStreamBatching failed, expected %d, recved: %d", i, v)
+		}
+	}
+	if n := atomic.LoadInt64(&c1.writes) - writes; n > 30 {
+		t.Errorf("TestStreamBatching failed, %d writes for 100 msgs", n)
+	}
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+}
+
+func TestCreditFlow(t *testing.T) {
+	//acks are cumulative and batched
+	var acks, lastAcked int
+	fr, _ := CreditFlowController.NewFlowRecver(reflect.ValueOf(make(chan int, 16)), nil, func(acked, window int) {
+		acks++
+		lastAcked = acked
+	})
+	for i := 0; i < 100; i++ {
+		fr.Send(reflect.ValueOf(i))
+		fr.Recv()
+	}
+	if acks == 0 || acks > 100/4 || lastAcked > 100 || lastAcked < 100-16 {
+		t.Errorf("TestCreditFlow failed, %d acks for 100 msgs, last acked %d", acks, lastAcked)
+	}
+	//msgs are delivered in order thru a small recv buffer
+	rout1 := New(IntID(), 32, BroadcastPolicy)
+	rout2 := New(IntID(), 4, BroadcastPolicy)
+	connectTCP(t, rout1, rout2, CreditFlowController)
+	chi := make(chan int, 4)
+	rout2.AttachRecvChan(IntID(10), chi)
+	cho := make(chan int)
+	bound := make(chan *BindEvent, 1)
+	rout1.AttachSendChan(IntID(10), cho, bound)
+	<-bound
+	go func() {
+		for i := 0; i < 2000; i++ {
+			cho <- i
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		if v := <-chi; v != i {
+			t.Fatalf("TestCreditFlow failed, expected %d, recved: %d", i, v)
+		}
+	}
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+}
+
+func TestRateFlow(t *testing.T) {
+	policy := NewRateFlowController(200, 10)
+	rout1 := New(IntID(), 32, BroadcastPolicy)
+	rout2 := New(IntID(), 32, BroadcastPolicy)
+	connectTCP(t, rout1, rout2, policy)
+	chi := make(chan int, 32)
+	rout2.AttachRecvChan(IntID(10), chi)
+	cho := make(chan int)
+	bound := make(chan *BindEvent, 1)
+	rout1.AttachSendChan(IntID(10), cho, bound)
+	<-bound
+	go func() {
+		for i := 0; i < 560; i++ {
+			cho <- i
+		}
+	}()
+	//a burst of 10, then 200 msgs/sec
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		if v := <-chi; v != i {
+			t.Fatalf("TestRateFlow failed, expected %d, recved: %d", i, v)
+		}
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("TestRateFlow failed, 60 msgs recved in %v", d)
+	}
+	//remove limit at runtime
+	policy.SetRate(0, 1)
+	start = time.Now()
+	for i := 60; i < 560; i++ {
+		if v := <-chi; v != i {
+			t.Fatalf("TestRateFlow failed, expected %d, recved: %d", i, v)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("TestRateFlow failed, limit not removed, 500 msgs recved in %v", d)
+	}
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+	//a failed TrySend keeps its token
+	ch := make(chan int, 1)
+	ch <- 0
+	fs, _ := NewRateFlowController(1, 1).NewFlowSender(reflect.ValueOf(ch))
+	if fs.TrySend(reflect.ValueOf(1)) {
+		t.Errorf("TestRateFlow failed, TrySend to full chan succeeded")
+	}
+	<-ch
+	if !fs.TrySend(reflect.ValueOf(1)) {
+		t.Errorf("TestRateFlow failed, token lost by failed TrySend")
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	//chained async routers: A -> B -> C, B relays msgs from id 10 to id 20
+	routs := make([]Router, 3)
+	for i := range routs {
+		routs[i] = New(IntID(), -1, BroadcastPolicy, "rout"+strconv.Itoa(i), HighWaterMark(16))
+	}
+	connectTCP(t, routs[0], routs[1])
+	connectTCP(t, routs[1], routs[2])
+	faults := make(chan *FaultRecord, 8)
+	routs[2].AttachRecvChan(routs[2].SysID(RouterFaultId), faults)
+	chi := make(chan []byte)
+	routs[2].AttachRecvChan(IntID(20), chi)
+	relayIn, relayOut := make(chan []byte), make(chan []byte)
+	routs[1].AttachRecvChan(IntID(10), relayIn)
+	relayBound := make(chan *BindEvent, 1)
+	routs[1].AttachSendChan(IntID(20), relayOut, relayBound)
+	<-relayBound
+	go func() {
+		for b := range relayIn {
+			relayOut <- b
+		}
+	}()
+	cho := make(chan []byte)
+	bound := make(chan *BindEvent, 1)
+	routs[0].AttachSendChan(IntID(10), cho, bound)
+	<-bound
+	const num = 10000
+	var sent int64
+	go func() {
+		for i := 0; i < num; i++ {
+			b := make([]byte, 4096)
+			binary.BigEndian.PutUint32(b, uint32(i))
+			cho <- b
+			atomic.AddInt64(&sent, 1)
+		}
+	}()
+	//C doesnt recv, so A blocks after buffers at each hop fill up
+	select {
+	case f := <-faults:
+		if !strings.Contains(f.Info.Error(), errSlowConsumer) {
+			t.Errorf("TestBackpressure failed, unexpected fault: %v", f.Info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestBackpressure failed, no slow consumer fault")
+	}
+	last := int64(-1)
+	for n := atomic.LoadInt64(&sent); n != last; n = atomic.LoadInt64(&sent) {
+		last = n
+		time.Sleep(300 * time.Millisecond)
+	}
+	if last >= num {
+		t.Errorf("TestBackpressure failed, sender not blocked")
+	}
+	for i := 0; i < num; i++ {
+		if v := binary.BigEndian.Uint32(<-chi); v != uint32(i) {
+			t.Fatalf("TestBackpressure failed, expected %d, recved: %d", i, v)
+		}
+	}
+	close(cho)
+	for _, r := range routs {
+		r.Close()
+	}
+}
+
+func TestOverflowReaction(t *testing.T) {
+	//msg 0 is being delivered, msgs 1-3 are buffered when 4-9 overflow
+	expected := map[OverflowReaction][]int{
+		DropNewestOnOverflow: {0, 1, 2, 3},
+		DropOldestOnOverflow: {0, 7, 8, 9},
+		DetachOnOverflow:     {0, 1, 2, 3},
+	}
+	for reaction, recved := range expected {
+		rout := New(StrID(), -1, BroadcastPolicy, HighWaterMark(4), reaction)
+		chi := make(chan int)
+		rc, _ := rout.AttachRecvChan(StrID("test"), chi)
+		//sender blocks waiting for recvers after slow recver detached
+		cho := make(chan int, 10)
+		rout.AttachSendChan(StrID("test"), cho)
+		cho <- 0
+		//wait for msg 0 to be taken for delivery
+		time.Sleep(10 * time.Millisecond)
+		for i := 1; i < 10; i++ {
+			cho <- i
+		}
+		//counters are updated after msgs dispatched, wait for them
+		overflows := func() uint64 { return rout.Stats().Ids[0].Overflows }
+		for i := 0; i < 100 && (overflows() == 0 || reaction != DetachOnOverflow && overflows() < 6); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, v := range recved {
+			if r := <-chi; r != v {
+				t.Errorf("TestOverflowReaction failed for %v, expected %d, recved: %d", reaction, v, r)
+			}
+		}
+		if is := rout.Stats().Ids[0]; reaction != DetachOnOverflow && (is.Overflows != 6 || is.Dropped != 6) {
+			t.Errorf("TestOverflowReaction failed for %v, stats: %+v", reaction, is)
+		}
+		if reaction == DetachOnOverflow {
+			for i := 0; i < 100 && rc.NumPeers() > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if rc.NumPeers() > 0 {
+				t.Errorf("TestOverflowReaction failed, slow recver not detached")
+			}
+		}
+		close(cho)
+		rout.Close()
+	}
+	//without high-water mark, async recvers buffer all msgs and KeepLatestBroadcast drops none
+	rout := New(StrID(), -1, KeepLatestBroadcastPolicy)
+	chi := make(chan int)
+	rout.AttachRecvChan(StrID("test"), chi)
+	cho := make(chan int, 10)
+	rout.AttachSendChan(StrID("test"), cho)
+	for i := 0; i < 10; i++ {
+		cho <- i
+	}
+	for i := 0; i < 10; i++ {
+		if r := <-chi; r != i {
+			t.Errorf("TestOverflowReaction failed for KeepLatestBroadcast, expected %d, recved: %d", i, r)
+		}
+	}
+	close(cho)
+	rout.Close()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy, "router", SlowConsumerPolicy{Threshold: 50 * time.Millisecond, Detach: true})
+	faults := make(chan *FaultRecord, 8)
+	rout.AttachRecvChan(rout.SysID(RouterFaultId), faults)
+	fast := make(chan int)
+	rout.AttachRecvChan(StrID("test"), fast)
+	slow := make(chan int, 1)
+	slowCh, _ := rout.AttachRecvChan(StrID("test"), slow)
+	//recvers of non fast path types are delivered thru reflection
+	slowMsgs := make(chan []int)
+	slowMsgsCh, _ := rout.AttachRecvChan(StrID("msgs"), slowMsgs)
+	cho := make(chan int)
+	rout.AttachSendChan(StrID("test"), cho)
+	msgs := make(chan []int)
+	rout.AttachSendChan(StrID("msgs"), msgs)
+	go func() {
+		for i := 0; i < 20; i++ {
+			cho <- i
+		}
+	}()
+	msgs <- []int{1}
+	//fast recver keeps flowing after the slow one is detached
+	for i := 0; i < 20; i++ {
+		if v := <-fast; v != i {
+			t.Fatalf("TestSlowConsumer failed, expected %d, recved: %d", i, v)
+		}
+	}
+	for _, rc := range []*RoutedChan{slowCh, slowMsgsCh} {
+		f := <-faults
+		if se, ok := f.Info.(*SlowConsumerError); !ok || !se.Detached {
+			t.Errorf("TestSlowConsumer failed, unexpected fault: %v", f.Info)
+		}
+		for i := 0; i < 100 && rc.NumPeers() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if rc.NumPeers() > 0 {
+			t.Errorf("TestSlowConsumer failed, slow recver of %v not detached", rc.Id)
+		}
+	}
+	close(cho)
+	close(msgs)
+	rout.Close()
+}
+
+func benchRemoteThroughput(b *testing.B, batching *StreamBatching) {
+	rout1 := New(IntID(), 32, BroadcastPolicy)
+	rout2 := New(IntID(), 32, BroadcastPolicy)
+	connectTCP(b, rout1, rout2, batching)
+	chi := make(chan int, 64)
+	rout2.AttachRecvChan(IntID(10), chi)
+	cho := make(chan int, 64)
+	bound := make(chan *BindEvent, 1)
+	rout1.AttachSendChan(IntID(10), cho, bound)
+	<-bound
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < b.N; n++ {
+			<-chi
+		}
+		done <- true
+	}()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cho <- n
+	}
+	<-done
+	b.StopTimer()
+	close(cho)
+	rout1.Close()
+	rout2.Close()
+}
+
+func BenchmarkRemoteThroughput(b *testing.B) {
+	b.Run("unbatched", func(b *testing.B) { benchRemoteThroughput(b, &StreamBatching{MaxBatch: 1}) })
+	b.Run("batched", func(b *testing.B) { benchRemoteThroughput(b, &StreamBatching{}) })
+	b.Run("batched/latency=100us", func(b *testing.B) {
+		benchRemoteThroughput(b, &StreamBatching{FlushLatency: 100 * time.Microsecond})
+	})
+}
+
+func TestTTL(t *testing.T) {
+	//async router buffers msgs before recv chans
+	rout := New(StrID(), -1, BroadcastPolicy)
+	rout.SetTTL(StrID("test"), 20*time.Millisecond)
+	chi := make(chan int)
+	rout.AttachRecvChan(StrID("test"), chi)
+	cho := make(chan int)
+	rout.AttachSendChan(StrID("test"), cho)
+	for i := 1; i <= 5; i++ {
+		cho <- i
+	}
+	time.Sleep(50 * time.Millisecond)
+	cho <- 6
+	//msg 1 is being delivered when others expire
+	if v1, v2 := <-chi, <-chi; v1 != 1 || v2 != 6 {
+		t.Errorf("TestTTL failed, recved: %v, %v", v1, v2)
+	}
+	if is := rout.Stats().Ids[0]; is.Expired != 4 || is.Dropped != 4 {
+		t.Errorf("TestTTL failed, stats: %+v", is)
+	}
+	close(cho)
+	rout.Close()
+	//envelopes past deadline are dropped
+	rout = New(StrID(), 32, BroadcastPolicy)
+	chi = make(chan int, 2)
+	rout.AttachRecvChan(StrID("test"), chi)
+	envCh := make(chan *Envelope)
+	rout.AttachSendChan(StrID("test"), envCh)
+	envCh <- &Envelope{Deadline: time.Now().UnixNano(), Data: 1}
+	envCh <- &Envelope{Data: 2}
+	if v := <-chi; v != 2 {
+		t.Errorf("TestTTL failed, recved: %v", v)
+	}
+	if is := rout.Stats().Ids[0]; is.Expired != 1 {
+		t.Errorf("TestTTL failed, stats: %+v", is)
+	}
+	close(envCh)
+	rout.Close()
+	//msgs queued to peer are translated, their ttl is of the local id
+	rout = New(PathID(), -1, BroadcastPolicy)
+	rout.SetTTL(PathID("/local/test"), 20*time.Millisecond)
+	cho = make(chan int)
+	rout.AttachSendChan(PathID("/local/test"), cho)
+	p := NewProxy(rout, "", nil, &TranslatorRules{Mounts: []Mount{{"/local/*", "/*"}}}).(*proxyImpl)
+	s := &stream{proxy: p, asyncOutput: true, localIds: make(map[interface{}]Id)}
+	ch, _ := s.appMsgChanForId(PathID("/local/test"))
+	m := &genericMsg{ch.(*genericMsgChan).id, 1}
+	if m.Id.Key() != "/test" {
+		t.Fatalf("TestTTL failed, msg id not translated: %v", m.Id)
+	}
+	if !s.outputExpiry(reflect.ValueOf(m), time.Now().Add(-time.Second).UnixNano()) {
+		t.Errorf("TestTTL failed, translated msg not expired")
+	}
+	if is := rout.Stats().Ids[0]; is.Expired != 1 {
+		t.Errorf("TestTTL failed, stats: %+v", is)
+	}
+	//proxy is not connected
+	rout.(*routerImpl).delProxy(p)
+	close(cho)
+	rout.Close()
+}
+
+func TestPriorityScheduling(t *testing.T) {
+	rout := New(StrID(), 32, BroadcastPolicy)
+	rout.SetPriority(StrID("hi"), PriorityHigh)
+	rout.SetPriority(StrID("lo"), PriorityLow)
+	s := &stream{ctrlChan: make(chan *genericMsg, 1)}
+	for p := range s.outputChans {
+		s.outputChans[p] = make(chan *genericMsg, 64)
+	}
+	for i := 0; i < 50; i++ {
+		for _, id := range []Id{StrID("hi"), StrID("lo")} {
+			s.outputChans[rout.(*routerImpl).priorityOf(id)] <- &genericMsg{id, i}
+		}
+	}
+	s.ctrlChan <- &genericMsg{rout.SysID(PubId), &ChanInfoMsg{}}
+	if m := s.tryRecvOutput(); m.Id.SysIdIndex() != PubId {
+		t.Fatalf("TestPriorityScheduling failed, ctrl msg not first: %v", m.Id)
+	}
+	//low priority msgs are served after starvationLimit high priority msgs
+	for i := 0; i < 2*(starvationLimit+1); i++ {
+		m := s.tryRecvOutput()
+		if low := (i+1)%(starvationLimit+1) == 0; low != (m.Id.Key() == "lo") {
+			t.Fatalf("TestPriorityScheduling failed, msg %d: %v", i, m.Id)
+		}
+	}
+	//app msgs queued before unpub are sent before it
+	s.ctrlChan <- &genericMsg{rout.SysID(UnPubId), &ChanInfoMsg{}}
+	for i := 0; i < 100-2*(starvationLimit+1); i++ {
+		if m := s.tryRecvOutput(); m.Id.SysIdIndex() >= 0 {
+			t.Fatalf("TestPriorityScheduling failed, unpub sent before app msg %d", i)
+		}
+	}
+	if m := s.tryRecvOutput(); m.Id.SysIdIndex() != UnPubId {
+		t.Errorf("TestPriorityScheduling failed, expect unpub: %v", m.Id)
+	}
+	rout.Close()
+}
+
+func TestUnPubOrdering(t *testing.T) {
+	//async routers buffer msgs to peer in stream, unpub must not overtake them
+	rout1 := New(IntID(), -1, BroadcastPolicy)
+	rout2 := New(IntID(), -1, BroadcastPolicy)
+	connectTCP(t, rout1, rout2)
+	chi := make(chan int, 32)
+	rout2.AttachRecvChan(IntID(10), chi)
+	cho := make(chan int, 2000)
+	for i := 0; i < 2000; i++ {
+		cho <- i
+	}
+	close(cho)
+	rout1.AttachSendChan(IntID(10), cho)
+	for i := 0; i < 2000; i++ {
+		select {
+		case v := <-chi:
+			if v != i {
+				t.Fatalf("TestUnPubOrdering failed, expected %d, recved: %d", i, v)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("TestUnPubOrdering failed, msgs after %d lost", i)
+		}
+	}
+	rout1.Close()
+	rout2.Close()
+}
+
+func TestMesh(t *testing.T) {
+	//ring of routers: A - B - C - D - A, A publishes, C and D subscribe;
+	//B relays msgs to C without local chans, routes thru D are not taken (D > B)
+	mesh := MeshRouting{Types: []reflect.Type{reflect.TypeOf(make(chan int))}}
+	names := []string{"A", "B", "C", "D"}
+	routs := make([]Router, len(names))
+	for i, name := range names {
+		routs[i] = New(IntID(), 32, BroadcastPolicy, name, mesh)
+	}
+	conns := make([]*countingConn, len(routs))
+	for i := range routs {
+		conns[i], _ = connectTCP(t, routs[i], routs[(i+1)%len(routs)])
+	}
+	chC, chD := make(chan int, 200), make(chan int, 200)
+	routs[2].AttachRecvChan(IntID(10), chC)
+	routs[3].AttachRecvChan(IntID(10), chD)
+	cho := make(chan int)
+	routs[0].AttachSendChan(IntID(10), cho)
+	//send msgs thru mesh after routes are set up, each subscriber gets each msg once
+	check := func(from, to int) {
+		probing := make(chan bool)
+		go func() {
+			for {
+				select {
+				case cho <- -1:
+				case <-probing:
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		for _, ch := range []chan int{chC, chD} {
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatal("TestMesh failed, no route to subscriber")
+			}
+		}
+		close(probing)
+		time.Sleep(100 * time.Millisecond)
+		for len(chC) > 0 || len(chD) > 0 {
+			select {
+			case <-chC:
+			case <-chD:
+			}
+		}
+		for i := from; i < to; i++ {
+			cho <- i
+		}
+		for _, ch := range []chan int{chC, chD} {
+			for i := from; i < to; i++ {
+				if v := <-ch; v != i {
+					t.Fatalf("TestMesh failed, expected %d, recved: %d", i, v)
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		if len(chC) > 0 || len(chD) > 0 {
+			t.Errorf("TestMesh failed, duplicated msgs: %d, %d", len(chC), len(chD))
+		}
+	}
+	check(0, 100)
+	//B - C conn fails, msgs to C are rerouted thru D
+	conns[1].Close()
+	check(100, 200)
+	close(cho)
+	for _, r := range routs {
+		r.Close()
+	}
+	//both routers must be in mesh mode with different ids
+	r1 := New(IntID(), 32, BroadcastPolicy, "A", mesh)
+	if _, _, err := r1.Connect(New(IntID(), 32, BroadcastPolicy)); err == nil {
+		t.Errorf("TestMesh failed, connected to router not in mesh mode")
+	}
+	if _, _, err := r1.Connect(New(IntID(), 32, BroadcastPolicy, "A", mesh)); err == nil {
+		t.Errorf("TestMesh failed, connected to router with same id")
+	}
+	r1.Close()
+	//pub/sub info carries Path only between routers in mesh mode
+	buf := new(bytes.Buffer)
+	info := &ChanInfoMsg{[]*ChanInfo{{Id: IntID(10), ChanType: reflect.TypeOf(make(chan int)), Path: []string{"A"}}}}
+	if err := marshalIdChanInfoMsg(JsonMarshaling.NewMarshaler(buf), info, false); err != nil || strings.Contains(buf.String(), `["A"]`) {
+		t.Errorf("TestMesh failed, path sent to router not in mesh mode: %v, %v", buf.String(), err)
+	}
+	buf.Reset()
+	cm := &ChanInfoMsg{}
+	if err := marshalIdChanInfoMsg(JsonMarshaling.NewMarshaler(buf), info, true); err != nil {
+		t.Errorf("TestMesh failed, marshal pub info: %v", err)
+	} else if err = demarshalIdChanInfoMsg(JsonMarshaling.NewDemarshaler(buf), IntID(0), cm, true); err != nil || len(cm.Info) != 1 || !reflect.DeepEqual(cm.Info[0].Path, []string{"A"}) {
+		t.Errorf("TestMesh failed, path not recved: %v, %v", cm.Info, err)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	//clients A, B, C connect to hub, A publishes, all subscribe
+	limits := ClientLimits{MaxPubs: 1, Rate: 200, Burst: 1}
+	hub := New(IntID(), 32, BroadcastPolicy, "hub", BrokerMode{MaxClients: 3, Limits: limits, Types: []reflect.Type{reflect.TypeOf(make(chan int))}})
+	faults := make(chan *FaultRecord, 8)
+	hub.AttachRecvChan(hub.SysID(RouterFaultId), faults)
+	clients := make([]Router, 3)
+	for i := range clients {
+		clients[i] = New(IntID(), 32, BroadcastPolicy)
+		connectTCP(t, clients[i], hub)
+	}
+	chs := make([]chan int, len(clients))
+	for i, c := range clients {
+		chs[i] = make(chan int, 200)
+		c.AttachRecvChan(IntID(10), chs[i])
+	}
+	cho := make(chan int)
+	clients[0].AttachSendChan(IntID(10), cho)
+	//wait till msgs reach B and C thru hub
+	probing := make(chan bool)
+	go func() {
+		for {
+			select {
+			case cho <- -1:
+			case <-probing:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	for _, ch := range chs[1:] {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("TestBroker failed, msgs not forwarded between clients")
+		}
+	}
+	close(probing)
+	time.Sleep(100 * time.Millisecond)
+	for _, ch := range chs {
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+	//each client gets each msg once, A's msgs are not forwarded back to A;
+	//msgs from A are bound by its rate
+	const num = 100
+	start := time.Now()
+	for i := 0; i < num; i++ {
+		cho <- i
+	}
+	for _, ch := range chs {
+		for i := 0; i < num; i++ {
+			if v := <-ch; v != i {
+				t.Fatalf("TestBroker failed, expected %d, recved: %d", i, v)
+			}
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("TestBroker failed, client rate not limited: %d msgs in %v", num, d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, ch := range chs {
+		if len(ch) > 0 {
+			t.Errorf("TestBroker failed, client %d recved duplicated msgs: %d", i, len(ch))
+		}
+	}
+	//A can publish only one id thru hub
+	clients[0].AttachSendChan(IntID(20), make(chan int))
+	select {
+	case f := <-faults:
+		if !strings.Contains(f.Info.Error(), errClientLimit) {
+			t.Errorf("TestBroker failed, unexpected fault: %v", f.Info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TestBroker failed, client limit not reported")
+	}
+	//no more clients
+	if _, _, err := hub.Connect(New(IntID(), 32, BroadcastPolicy)); err == nil {
+		t.Errorf("TestBroker failed, connected more than max clients")
+	}
+	//closed clients are not counted
+	clients[2].Close()
+	late := New(IntID(), 32, BroadcastPolicy)
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, _, err = hub.Connect(late); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("TestBroker failed, client refused after another left: %v", err)
+	}
+	close(cho)
+	for _, c := range clients {
+		c.Close()
+	}
+	late.Close()
+	hub.Close()
+}
+
+func TestRemoteRecords(t *testing.T) {
+	//records of named r1 show up at global recvers of r2
+	r1 := New(IntID(), 32, BroadcastPolicy, "r1")
+	r2 := New(IntID(), 32, BroadcastPolicy)
+	logs := make(chan *LogRecord, 1024)
+	faults := make(chan *FaultRecord, 8)
+	r2.AttachRecvChan(r2.NewSysID(RouterLogId, ScopeGlobal), logs)
+	r2.AttachRecvChan(r2.NewSysID(RouterFaultId, ScopeGlobal), faults)
+	connectTCP(t, r1, r2, ExportRecords)
+	rt := r1.(*routerImpl)
+	deadline := time.After(5 * time.Second)
+	for probed := false; !probed; {
+		rt.LogError(errors.New("probe"))
+		select {
+		case lr := <-logs:
+			probed = lr.Source == "r1" && lr.Info == "probe"
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("TestRemoteRecords failed, log records not forwarded")
+		}
+	}
+	rt.Raise(errors.New("remote fault"))
+	select {
+	case fr := <-faults:
+		if fr.Source != "r1" || fr.Info == nil || fr.Info.Error() != "remote fault" {
+			t.Errorf("TestRemoteRecords failed, unexpected fault: %v %v", fr.Source, fr.Info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TestRemoteRecords failed, fault records not forwarded")
+	}
+
+	//chans of interface{} match chans of other types only with MatchAnyType
+	ict := reflect.TypeOf(make(chan int))
+	strict, generic := &proxyImpl{}, &proxyImpl{matchAnyType: true}
+	if strict.chanTypeMatch(&ChanInfo{ChanType: anyChanType}, &ChanInfo{ChanType: ict}) ||
+		elemTypeMatch(anyElemType, getMsgTypeEncoding(ict.Elem()), false) {
+		t.Errorf("TestRemoteRecords failed, chan of interface{} matches chan of int")
+	}
+	if !generic.chanTypeMatch(&ChanInfo{ChanType: anyChanType}, &ChanInfo{ChanType: ict}) {
+		t.Errorf("TestRemoteRecords failed, chan of interface{} does not match with MatchAnyType")
+	}
+	//chans of interface{} at r3 exchange generic values with typed chans at r1
+	r3 := New(IntID(), 32, BroadcastPolicy)
+	connectTCP(t, r1, r3, JsonMarshaling, MatchAnyType)
+	gin := make(chan interface{}, 8)
+	r3.AttachRecvChan(IntID(5), gin)
+	ich := make(chan int)
+	ibound := make(chan *BindEvent, 1)
+	r1.AttachSendChan(IntID(5), ich, ibound)
+	sch := make(chan string, 8)
+	r1.AttachRecvChan(IntID(6), sch)
+	gout := make(chan interface{})
+	gbound := make(chan *BindEvent, 1)
+	r3.AttachSendChan(IntID(6), gout, gbound)
+	for _, bc := range []chan *BindEvent{ibound, gbound} {
+		select {
+		case <-bc:
+		case <-time.After(5 * time.Second):
+			t.Fatal("TestRemoteRecords failed, generic chans not bound")
+		}
+	}
+	ich <- 7
+	gout <- "hi"
+	if v := <-gin; v != float64(7) {
+		t.Errorf("TestRemoteRecords failed, expected 7, recved: %v", v)
+	}
+	if v := <-sch; v != "hi" {
+		t.Errorf("TestRemoteRecords failed, expected hi, recved: %v", v)
+	}
+	//MatchAnyType at one side only is not applied
+	r4 := New(IntID(), 32, BroadcastPolicy)
+	c1, c2 := net.Pipe()
+	go r1.ConnectRemote(c1, JsonMarshaling)
+	if p4, err := r4.ConnectRemote(c2, JsonMarshaling, MatchAnyType); err != nil || p4.(*proxyImpl).matchAnyType {
+		t.Errorf("TestRemoteRecords failed, MatchAnyType applied by one side: %v", err)
+	}
+	close(ich)
+	close(gout)
+	r4.Close()
+	r3.Close()
+	r2.Close()
+	r1.Close()
+}
+
+func TestRules(t *testing.T) {
+	//filter blocks ids the same way in both directions, plus directional rules
+	f := &FilterRules{
+		Allow:   []string{"/sport/*", "/weather/?/today", "/news/**/live", "re:/stock/[A-Z]+"},
+		Deny:    []string{"/sport/private*"},
+		Outward: &AccessRules{Deny: []string{"/weather/**"}},
+	}
+	if err := f.Check(); err != nil {
+		t.Fatal("TestRules failed at FilterRules.Check(): ", err)
+	}
+	for val, block := range map[string]bool{
+		"/sport/news/today": false,
+		"/sport/private/a":  true,
+		"/news/a/b/live":    false,
+		"/news/a/b/archive": true,
+		"/stock/GOOG":       false,
+		"/stock/goog":       true,
+		"/stock/GOOG/x":     true,
+		"/weather/a/today":  false,
+		"/weather/ab/today": true,
+		"/unknown":          true,
+	} {
+		id := PathID(val)
+		if f.BlockInward(id) != block {
+			t.Errorf("TestRules failed, BlockInward(%s) != %v", val, block)
+		}
+		outBlock := block || strings.HasPrefix(val, "/weather/")
+		if f.BlockOutward(id) != outBlock {
+			t.Errorf("TestRules failed, BlockOutward(%s) != %v", val, outBlock)
+		}
+	}
+	bad := &FilterRules{Deny: []string{"re:/a/("}}
+	if bad.Check() == nil || !bad.BlockInward(PathID("/b")) {
+		t.Errorf("TestRules failed, invalid pattern should block all ids")
+	}
+
+	//translators map ids back and forth symmetrically, alone and composed
+	site := &TranslatorRules{Mounts: []Mount{{"/remote/siteA/*", "/*"}}}
+	local := &TranslatorRules{Mounts: []Mount{{"/remote/site/*", "/remote/*"}, {"/local/mine/*", "/local/*"}}}
+	for _, tr := range []IdTranslator{site, local, Translators(site, local)} {
+		for _, val := range []string{"/x", "/remote/y/z", "/local/w", "/other", "/remote/site/a", "/remote/siteA/b"} {
+			id := PathID(val)
+			in := tr.TranslateInward(id)
+			if back := tr.TranslateOutward(in); !back.Match(id) {
+				t.Errorf("TestRules failed, %s inward to %v, back to %v", val, in.Key(), back.Key())
+			}
+			//local ids not blocked come back as they are
+			out := tr.TranslateOutward(id)
+			if back := tr.TranslateInward(out); !RoundTripFilter(tr).BlockOutward(id) && !back.Match(id) {
+				t.Errorf("TestRules failed, %s outward to %v, back to %v", val, out.Key(), back.Key())
+			}
+		}
+	}
+	//local ids outside local mounts but in remote prefixes cannot round trip
+	if f := RoundTripFilter(site); !f.BlockOutward(PathID("/y")) || !f.BlockInward(PathID("/y")) ||
+		f.BlockOutward(PathID("/remote/siteA/y")) {
+		t.Errorf("TestRules failed, ids not round tripping should be blocked")
+	}
+	if f := RoundTripFilter(local); !f.BlockOutward(PathID("/remote/y")) || f.BlockOutward(PathID("/other")) {
+		t.Errorf("TestRules failed, ids not round tripping should be blocked")
+	}
+	if err := (&TranslatorRules{Mounts: []Mount{{"/site/*", "/remote/*"}}}).Check(); err == nil {
+		t.Errorf("TestRules failed, local prefix outside remote prefixes not detected")
+	}
+	if id := site.TranslateInward(StrID("/x", ScopeRemote)); id.Key() != "/remote/siteA/x" || id.Scope() != ScopeRemote {
+		t.Errorf("TestRules failed, unexpected inward translation: %v", id.Key())
+	}
+	if id := Translators(site, local).TranslateInward(PathID("/x")); id.Key() != "/remote/site/siteA/x" {
+		t.Errorf("TestRules failed, unexpected composed translation: %v", id.Key())
+	}
+	if id := local.TranslateOutward(PathID("/other/x")); id.Key() != "/other/x" {
+		t.Errorf("TestRules failed, ids outside mounts should pass: %v", id.Key())
+	}
+	if err := (&TranslatorRules{Mounts: []Mount{{"/a/*", "/*"}, {"/a/b/*", "/c/*"}}}).Check(); err == nil {
+		t.Errorf("TestRules failed, overlapped mounts not detected")
+	}
+
+	//yaml and json of same rules
+	yml := `
+# rules of site A
+filters:
+  - allow: [/sport/*, "re:/news/[0-9]+"]
+    inward:
+      deny:
+        - /sport/private/**   # no private ids from peer
+translators:
+- mounts:
+    - local: /remote/siteA/*
+      remote: /*
+`
+	jsn := `{"Filters": [{"Allow": ["/sport/*", "re:/news/[0-9]+"], "Inward": {"Deny": ["/sport/private/**"]}}],
+		"Translators": [{"Mounts": [{"Local": "/remote/siteA/*", "Remote": "/*"}]}]}`
+	ry, err := ParseRules([]byte(yml))
+	if err != nil {
+		t.Fatal("TestRules failed at ParseRules(yaml): ", err)
+	}
+	rj, err := ParseRules([]byte(jsn))
+	if err != nil {
+		t.Fatal("TestRules failed at ParseRules(json): ", err)
+	}
+	if !reflect.DeepEqual(ry.Filters[0].Allow, rj.Filters[0].Allow) ||
+		!reflect.DeepEqual(ry.Filters[0].Inward, rj.Filters[0].Inward) ||
+		!reflect.DeepEqual(ry.Translators[0].Mounts, rj.Translators[0].Mounts) {
+		t.Errorf("TestRules failed, yaml and json rules differ")
+	}
+	filter, trans := ry.Filters[0], ry.IdTranslator()
+	if filter.BlockOutward(PathID("/sport/private/a")) || !filter.BlockInward(PathID("/sport/private/a")) ||
+		filter.BlockInward(PathID("/news/12")) || !filter.BlockInward(PathID("/news/x")) {
+		t.Errorf("TestRules failed, unexpected filtering of parsed rules")
+	}
+	if id := trans.TranslateOutward(PathID("/remote/siteA/sport")); id.Key() != "/sport" {
+		t.Errorf("TestRules failed, unexpected translation of parsed rules: %v", id.Key())
+	}
+	if !ry.IdFilter().BlockOutward(PathID("/sport/x")) {
+		t.Errorf("TestRules failed, filter of parsed rules should block ids not round tripping")
+	}
+	for _, s := range []string{"filters: [{allow: a}]", "filters:\n  - allow: [a]\n  - allw: [b]", "filters:\n\t- allow: [a]",
+		"translators:\n  - mounts:\n      - local: /a/*\n        remote: /b"} {
+		if _, err := ParseRules([]byte(s)); err == nil || !strings.HasPrefix(err.Error(), errInvalidRule) {
+			t.Errorf("TestRules failed, invalid rules not detected: %q, %v", s, err)
+		}
+	}
+}
+
+func TestProxyUpdate(t *testing.T) {
+	r1 := New(PathID(), 32, BroadcastPolicy)
+	r2 := New(PathID(), 32, BroadcastPolicy)
+	ax, by := make(chan int), make(chan int)
+	axBound, byBound := make(chan *BindEvent, 8), make(chan *BindEvent, 8)
+	r1.AttachSendChan(PathID("/a/x"), ax, axBound)
+	r1.AttachSendChan(PathID("/b/y"), by, byBound)
+	ra, rb, rm := make(chan int, 8), make(chan int, 8), make(chan int, 8)
+	//with bind chans, recvers stay open when their senders leave
+	r2.AttachRecvChan(PathID("/a/x"), ra, make(chan *BindEvent, 1))
+	r2.AttachRecvChan(PathID("/b/y"), rb, make(chan *BindEvent, 1))
+	r2.AttachRecvChan(PathID("/remote/a/x"), rm, make(chan *BindEvent, 1))
+	p1 := NewProxy(r1, "", nil, nil)
+	p2 := NewProxy(r2, "", &FilterRules{Allow: []string{"/a/*"}}, nil)
+	c1, c2 := net.Pipe()
+	errs := make(chan error)
+	go func() { errs <- p2.ConnectRemote(c2, GobMarshaling) }()
+	if err := p1.ConnectRemote(c1, GobMarshaling); err != nil {
+		t.Fatal("TestProxyUpdate failed at ConnectRemote(): ", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal("TestProxyUpdate failed at ConnectRemote(): ", err)
+	}
+	bound := func(bc chan *BindEvent, count int) {
+		t.Helper()
+		for {
+			select {
+			case ev := <-bc:
+				if ev.Count == count {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("TestProxyUpdate failed, send chan not bound to %d recvers", count)
+			}
+		}
+	}
+	deliver := func(send, recv chan int, v int, want bool) {
+		t.Helper()
+		wait := 100 * time.Millisecond
+		if want {
+			wait = 5 * time.Second
+		}
+		//send chans without recvers are not drained
+		select {
+		case send <- v:
+		case <-time.After(wait):
+		}
+		select {
+		case got := <-recv:
+			if !want || got != v {
+				t.Errorf("TestProxyUpdate failed, unexpected msg %d", got)
+			}
+		case <-time.After(wait):
+			if want {
+				t.Errorf("TestProxyUpdate failed, msg %d not delivered", v)
+			}
+		}
+	}
+	bound(axBound, 1)
+	deliver(ax, ra, 1, true)
+	deliver(by, rb, 2, false)
+
+	//new filter passes /b/y and blocks /a/x, on the same connection
+	peerPubs := make(chan *ChanInfoMsg, 8)
+	r2.AttachRecvChan(r2.SysID(PubId), peerPubs)
+	if err := p2.SetFilter(&FilterRules{Allow: []string{"/b/*"}}); err != nil {
+		t.Fatal("TestProxyUpdate failed at SetFilter(): ", err)
+	}
+	bound(axBound, 0)
+	bound(byBound, 1)
+	//pubs of peer are imported again, without notifying them to local subscribers again
+	select {
+	case m := <-peerPubs:
+		t.Errorf("TestProxyUpdate failed, peer pubs notified again: %v", m.Info)
+	case <-time.After(100 * time.Millisecond):
+	}
+	r2.DetachChan(r2.SysID(PubId), peerPubs)
+	deliver(ax, ra, 3, false)
+	deliver(by, rb, 4, true)
+
+	//mount ids of r1 under /remote/ of r2
+	p2.SetFilter(&FilterRules{Allow: []string{"/remote/*"}})
+	bound(byBound, 0)
+	if err := p2.SetTranslator(&TranslatorRules{Mounts: []Mount{{"/remote/*", "/*"}}}); err != nil {
+		t.Fatal("TestProxyUpdate failed at SetTranslator(): ", err)
+	}
+	bound(axBound, 1)
+	deliver(ax, rm, 5, true)
+	deliver(by, rb, 6, false)
+	var ids []string
+	for _, ci := range p2.PeerPubInfo() {
+		ids = append(ids, fmt.Sprint(ci.Id.Key()))
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "/remote/a/x,/remote/b/y" {
+		t.Errorf("TestProxyUpdate failed, unexpected peer pubs: %v", ids)
+	}
+
+	//unmount
+	p2.SetTranslator(nil)
+	bound(axBound, 0)
+	deliver(ax, rm, 7, false)
+	if n := len(p2.PeerPubInfo()); n != 0 {
+		t.Errorf("TestProxyUpdate failed, %d peer pubs pass filter", n)
+	}
+
+	p1.Close()
+	if err := p1.SetFilter(nil); err == nil {
+		t.Errorf("TestProxyUpdate failed, SetFilter() of closed proxy")
+	}
+	r2.Close()
+
+	//pubs exported at connecting are translated too
+	r3 := New(PathID(), 32, BroadcastPolicy)
+	rc := make(chan int, 8)
+	r3.AttachRecvChan(PathID("/x"), rc, make(chan *BindEvent, 1))
+	p3 := NewProxy(r1, "", nil, &TranslatorRules{Mounts: []Mount{{"/a/*", "/*"}}})
+	p4 := NewProxy(r3, "", nil, nil)
+	c3, c4 := net.Pipe()
+	go func() { errs <- p4.ConnectRemote(c4, GobMarshaling) }()
+	if err := p3.ConnectRemote(c3, GobMarshaling); err != nil {
+		t.Fatal("TestProxyUpdate failed at ConnectRemote(): ", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal("TestProxyUpdate failed at ConnectRemote(): ", err)
+	}
+	ids = ids[:0]
+	for _, ci := range p4.PeerPubInfo() {
+		ids = append(ids, fmt.Sprint(ci.Id.Key()))
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "/b/y,/x" {
+		t.Errorf("TestProxyUpdate failed, initial peer pubs not translated: %v", ids)
+	}
+	deliver(ax, rc, 8, true)
+	p3.Close()
+	r3.Close()
+	r1.Close()
+}
@@ -0,0 +1,455 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+ FilterRules is an IdFilter driven by allow/deny lists of patterns on id values,
+ i.e. fmt.Sprint(id.Key()), such as "/sport/news" of PathId or "2_5" of MsgId:
+ 1. globs: * and ? match inside a path segment, ** matches across segments;
+    like PathId, a trailing * matches the rest of id, e.g. /sport/* matches /sport/news/today
+ 2. regexes: patterns prefixed with "re:" are regular expressions matching the whole
+    id value, e.g. re:/news/[0-9]+
+ An id is blocked if it matches a Deny pattern, or if Allow patterns are set and it
+ matches none of them. Allow/Deny apply in both directions, Inward/Outward add the
+ rules of one direction. Invalid patterns block all ids, Check() reports them.
+*/
+type FilterRules struct {
+	Allow   []string
+	Deny    []string
+	Inward  *AccessRules
+	Outward *AccessRules
+	once    sync.Once
+	all     *accessMatcher
+	in, out *accessMatcher
+	err     error
+}
+
+//AccessRules are the allow/deny patterns of ids in one direction
+type AccessRules struct {
+	Allow []string
+	Deny  []string
+}
+
+type accessMatcher struct {
+	allow, deny []*regexp.Regexp
+}
+
+func (f *FilterRules) compile() error {
+	f.once.Do(func() {
+		if f.all, f.err = newAccessMatcher(&AccessRules{f.Allow, f.Deny}); f.err != nil {
+			return
+		}
+		if f.in, f.err = newAccessMatcher(f.Inward); f.err != nil {
+			return
+		}
+		f.out, f.err = newAccessMatcher(f.Outward)
+	})
+	return f.err
+}
+
+//Check compiles the patterns and returns the first error
+func (f *FilterRules) Check() error {
+	return f.compile()
+}
+
+func (f *FilterRules) BlockInward(id Id) bool {
+	if f.compile() != nil {
+		return true
+	}
+	val := fmt.Sprint(id.Key())
+	return f.all.block(val) || f.in.block(val)
+}
+
+func (f *FilterRules) BlockOutward(id Id) bool {
+	if f.compile() != nil {
+		return true
+	}
+	val := fmt.Sprint(id.Key())
+	return f.all.block(val) || f.out.block(val)
+}
+
+func newAccessMatcher(r *AccessRules) (m *accessMatcher, err error) {
+	if r == nil {
+		return
+	}
+	m = new(accessMatcher)
+	if m.allow, err = compilePatterns(r.Allow); err != nil {
+		return
+	}
+	m.deny, err = compilePatterns(r.Deny)
+	return
+}
+
+func (m *accessMatcher) block(val string) bool {
+	if m == nil {
+		return false
+	}
+	if matchAny(m.deny, val) {
+		return true
+	}
+	return len(m.allow) > 0 && !matchAny(m.allow, val)
+}
+
+func matchAny(res []*regexp.Regexp, val string) bool {
+	for _, re := range res {
+		if re.MatchString(val) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(pats []string) (res []*regexp.Regexp, err error) {
+	for _, pat := range pats {
+		var re *regexp.Regexp
+		if re, err = compilePattern(pat); err != nil {
+			return
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+//compilePattern turns a glob or "re:" pattern into an anchored regexp
+func compilePattern(pat string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pat, "re:") {
+		re, err := regexp.Compile("^(?:" + pat[3:] + ")$")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s %s: %v", errInvalidRule, pat, err))
+		}
+		return re, nil
+	}
+	if len(pat) == 0 {
+		return nil, errors.New(errInvalidRule + ": empty pattern")
+	}
+	var b bytes.Buffer
+	b.WriteString("^")
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; {
+		case c == '*' && i+1 < len(pat) && pat[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*' && i == len(pat)-1:
+			b.WriteString(".*")
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+/*
+ TranslatorRules is an IdTranslator mounting ids of peer router under prefixes of
+ local namespace. With Mount{Local: "/remote/siteA/*", Remote: "/*"}, id /x from peer
+ is /remote/siteA/x here, and /remote/siteA/x is sent to peer as /x.
+ 1. both sides of a mount are a prefix followed by a trailing *
+ 2. prefixes of different mounts must not overlap at either side, so ids are translated
+    back and forth symmetrically
+ 3. local prefixes must be inside remote prefixes, e.g. /remote/siteA/ inside /, so ids
+    from peer never pass untranslated into the local prefixes
+ 4. ids outside all mounts pass untranslated; local ones falling in remote prefixes,
+    such as local /y in the mount above, would come back translated (as /remote/siteA/y),
+    they are blocked by RoundTripFilter, which Rules.IdFilter() includes
+ 5. only ids of StrId and PathId are translated
+ Invalid mounts translate no ids, Check() reports them.
+*/
+type TranslatorRules struct {
+	Mounts []Mount
+	once   sync.Once
+	err    error
+}
+
+type Mount struct {
+	Local  string
+	Remote string
+}
+
+func (t *TranslatorRules) compile() error {
+	t.once.Do(func() {
+		var locals, remotes []string
+		for _, m := range t.Mounts {
+			l, lok := mountPrefix(m.Local)
+			r, rok := mountPrefix(m.Remote)
+			if !lok || !rok {
+				t.err = errors.New(fmt.Sprintf("%s: mount %s <-> %s", errInvalidRule, m.Local, m.Remote))
+				return
+			}
+			if overlap(locals, l) || overlap(remotes, r) {
+				t.err = errors.New(fmt.Sprintf("%s: mount %s <-> %s overlaps others", errInvalidRule, m.Local, m.Remote))
+				return
+			}
+			locals = append(locals, l)
+			remotes = append(remotes, r)
+		}
+		for i, l := range locals {
+			if !inside(remotes, l) {
+				m := t.Mounts[i]
+				t.err = errors.New(fmt.Sprintf("%s: mount %s <-> %s, local prefix outside remote prefixes", errInvalidRule, m.Local, m.Remote))
+				return
+			}
+		}
+	})
+	return t.err
+}
+
+//Check validates the mounts
+func (t *TranslatorRules) Check() error {
+	return t.compile()
+}
+
+func (t *TranslatorRules) TranslateInward(id Id) Id {
+	if t.compile() != nil {
+		return id
+	}
+	for _, m := range t.Mounts {
+		if id1, ok := remount(id, m.Remote, m.Local); ok {
+			return id1
+		}
+	}
+	return id
+}
+
+func (t *TranslatorRules) TranslateOutward(id Id) Id {
+	if t.compile() != nil {
+		return id
+	}
+	for _, m := range t.Mounts {
+		if id1, ok := remount(id, m.Local, m.Remote); ok {
+			return id1
+		}
+	}
+	return id
+}
+
+//mountPrefix returns the prefix of mount pattern such as /remote/siteA/*
+func mountPrefix(pat string) (string, bool) {
+	if !strings.HasSuffix(pat, "*") {
+		return "", false
+	}
+	prefix := pat[:len(pat)-1]
+	return prefix, !strings.ContainsAny(prefix, "*?")
+}
+
+func overlap(prefixes []string, p string) bool {
+	for _, q := range prefixes {
+		if strings.HasPrefix(p, q) || strings.HasPrefix(q, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func inside(prefixes []string, p string) bool {
+	for _, q := range prefixes {
+		if strings.HasPrefix(p, q) {
+			return true
+		}
+	}
+	return false
+}
+
+//remount moves id from under pattern from to under pattern to
+func remount(id Id, from, to string) (Id, bool) {
+	from, to = from[:len(from)-1], to[:len(to)-1]
+	switch v := id.(type) {
+	case *StrId:
+		if strings.HasPrefix(v.Val, from) && len(v.Val) > len(from) {
+			return StrID(to+v.Val[len(from):], v.ScopeVal, v.MemberVal), true
+		}
+	case *PathId:
+		if strings.HasPrefix(v.Val, from) && len(v.Val) > len(from) {
+			if id1 := PathID(to+v.Val[len(from):], v.ScopeVal, v.MemberVal); id1 != nil {
+				return id1, true
+			}
+		}
+	}
+	return id, false
+}
+
+type filterChain []IdFilter
+
+//Filters composes filters, an id is blocked if any of them blocks it
+func Filters(f ...IdFilter) IdFilter {
+	return filterChain(f)
+}
+
+func (c filterChain) BlockInward(id Id) bool {
+	for _, f := range c {
+		if f.BlockInward(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c filterChain) BlockOutward(id Id) bool {
+	for _, f := range c {
+		if f.BlockOutward(id) {
+			return true
+		}
+	}
+	return false
+}
+
+//RoundTripFilter blocks local ids which translator t does not translate back to themselves,
+//i.e. t.TranslateInward(t.TranslateOutward(id)) != id, so peer never sees them
+func RoundTripFilter(t IdTranslator) IdFilter {
+	return roundTripFilter{t}
+}
+
+type roundTripFilter struct {
+	t IdTranslator
+}
+
+func (f roundTripFilter) BlockInward(id Id) bool { return f.BlockOutward(id) }
+
+func (f roundTripFilter) BlockOutward(id Id) bool {
+	return f.t.TranslateInward(f.t.TranslateOutward(id)).Key() != id.Key()
+}
+
+type translatorChain []IdTranslator
+
+//Translators composes translators, ids from peer are translated inward in order and
+//ids to peer translated outward in reverse order, so later translators work on ids
+//translated by earlier ones
+func Translators(t ...IdTranslator) IdTranslator {
+	return translatorChain(t)
+}
+
+func (c translatorChain) TranslateInward(id Id) Id {
+	for _, t := range c {
+		id = t.TranslateInward(id)
+	}
+	return id
+}
+
+func (c translatorChain) TranslateOutward(id Id) Id {
+	for i := len(c) - 1; i >= 0; i-- {
+		id = c[i].TranslateOutward(id)
+	}
+	return id
+}
+
+/*
+ Rules are the filter and translator rules of proxies, loaded from json or yaml:
+
+    filters:
+      - allow: [/sport/*, "re:/news/[0-9]+"]
+      - outward:
+          deny: [/sport/private/**]
+    translators:
+      - mounts:
+          - local: /remote/siteA/*
+            remote: /*
+
+ filters and translators are composed in order, as by Filters() and Translators();
+ with translators, the composed filter includes their RoundTripFilter.
+ Only a subset of yaml is supported: block mappings and sequences, flow sequences
+ of scalars, quoted and plain scalars, and comments.
+*/
+type Rules struct {
+	Filters     []*FilterRules
+	Translators []*TranslatorRules
+}
+
+//Check validates all rules
+func (r *Rules) Check() error {
+	for _, f := range r.Filters {
+		if err := f.Check(); err != nil {
+			return err
+		}
+	}
+	for _, t := range r.Translators {
+		if err := t.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//IdFilter returns the composed filter of rules, nil if none; with translators,
+//ids not translated back to themselves are blocked too
+func (r *Rules) IdFilter() IdFilter {
+	var fs []IdFilter
+	for _, f := range r.Filters {
+		fs = append(fs, f)
+	}
+	if t := r.IdTranslator(); t != nil {
+		fs = append(fs, RoundTripFilter(t))
+	}
+	switch len(fs) {
+	case 0:
+		return nil
+	case 1:
+		return fs[0]
+	}
+	return Filters(fs...)
+}
+
+//IdTranslator returns the composed translator of rules, nil if none
+func (r *Rules) IdTranslator() IdTranslator {
+	switch len(r.Translators) {
+	case 0:
+		return nil
+	case 1:
+		return r.Translators[0]
+	}
+	var ts []IdTranslator
+	for _, t := range r.Translators {
+		ts = append(ts, t)
+	}
+	return Translators(ts...)
+}
+
+//ParseRules parses rules in json (starting with '{') or yaml, and checks them
+func ParseRules(data []byte) (*Rules, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		v, err := parseYaml(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	r := new(Rules)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(r); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %v", errInvalidRule, err))
+	}
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//LoadRules loads rules from a json or yaml file
+func LoadRules(file string) (*Rules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+/*
+ SlogSink is a log sink which passes LogRecords to a slog.Handler, e.g.
+
+    sink := router.NewSlogSink(rot.SysID(router.RouterLogId), rot, slog.NewJSONHandler(os.Stderr, nil))
+
+ log priorities are mapped to slog levels: LOG_DEBUG to Debug, LOG_INFO to Info,
+ LOG_WARN to Warn and LOG_ERROR to Error. LogRecord's source is added as attribute
+ "logger", followed by its structured attributes (router, proxy, id ...).
+ To have router internal log sent to a *slog.Logger, pass it to router.New().
+*/
+type SlogSink struct {
+	sinkChan chan *LogRecord
+	sinkExit chan bool
+	handler  slog.Handler
+	id       Id
+	r        Router
+}
+
+//create a new slog sink, which receives log messages from id in router "r"
+func NewSlogSink(id Id, r Router, h slog.Handler) *SlogSink {
+	return new(SlogSink).Init(id, r, h)
+}
+
+func (l *SlogSink) Init(id Id, r Router, h slog.Handler) *SlogSink {
+	l.sinkExit = make(chan bool)
+	l.sinkChan = make(chan *LogRecord, DefLogBufSize)
+	l.handler = h
+	l.id = id
+	l.r = r
+	_, err := l.r.AttachRecvChan(l.id, l.sinkChan)
+	if err != nil {
+		log.Println("*** failed to enable router's slog sink ***")
+		l.sinkChan = nil
+		return l
+	}
+	go func() {
+		for lr := range l.sinkChan {
+			l.handle(lr)
+		}
+		l.sinkExit <- true
+	}()
+	return l
+}
+
+func (l *SlogSink) Close() {
+	if l.sinkChan != nil {
+		l.r.DetachChan(l.id, l.sinkChan)
+		//wait for sink gorutine to exit
+		<-l.sinkExit
+	}
+}
+
+func slogLevel(p LogPriority) slog.Level {
+	switch p {
+	case LOG_DEBUG:
+		return slog.LevelDebug
+	case LOG_WARN:
+		return slog.LevelWarn
+	case LOG_ERROR:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+//minEnabledPri find the least severe priority enabled in handler
+func minEnabledPri(h slog.Handler) LogPriority {
+	for _, p := range []LogPriority{LOG_DEBUG, LOG_INFO, LOG_WARN} {
+		if h.Enabled(context.Background(), slogLevel(p)) {
+			return p
+		}
+	}
+	return LOG_ERROR
+}
+
+func (l *SlogSink) handle(lr *LogRecord) {
+	ctx := context.Background()
+	level := slogLevel(lr.Pri)
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	var msg string
+	switch info := lr.Info.(type) {
+	case error:
+		msg = info.Error()
+	case string:
+		msg = info
+	default:
+		msg = slog.AnyValue(info).String()
+	}
+	rec := slog.NewRecord(time.Unix(0, lr.Timestamp), level, msg, 0)
+	rec.AddAttrs(slog.String("logger", lr.Source))
+	keys := make([]string, 0, len(lr.Attrs))
+	for k := range lr.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rec.AddAttrs(slog.String(k, lr.Attrs[k]))
+	}
+	l.handler.Handle(ctx, rec)
+}
@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ SlowConsumerPolicy: detect recv chans whose queue stays full, which block delivery
+ (under BroadcastPolicy, to all recvers of the same id). When delivery to a recver
+ is blocked longer than Threshold, a SlowConsumerError is logged and raised as a
+ fault on RouterFaultId, once till the recver catches up. If Detach is set, the slow
+ recver is detached from router and the blocked msg dropped, so the other recvers
+ keep flowing. Blocked delivery to custom Channel implementations can not be
+ abandoned, they are detached after the blocked msg is delivered.
+ It is passed as an optional argument to router.New(); by default there is no detection.
+*/
+type SlowConsumerPolicy struct {
+	Threshold time.Duration
+	Detach    bool
+}
+
+//SlowConsumerError identifies a slow recver, as Info of FaultRecords
+type SlowConsumerError struct {
+	Id       Id
+	Blocked  time.Duration
+	Detached bool
+}
+
+func (e *SlowConsumerError) Error() string {
+	s := fmt.Sprintf("slow consumer: recver of %v blocked for %v", e.Id, e.Blocked)
+	if e.Detached {
+		s += ", detached"
+	}
+	return s
+}
+
+//channels which can abandon a blocked send when evicted is closed
+type evictableChan interface {
+	sendOrEvict(v reflect.Value, evicted <-chan struct{}) bool
+}
+
+//deliver msg to recver, detecting slow consumer if it blocks; return false if recver is evicted
+func (e *RoutedChan) sendOrEvict(v reflect.Value) bool {
+	if e.Channel.TrySend(v) {
+		atomic.StoreInt32(&e.slow, 0)
+		return true
+	}
+	timer := e.watchSlow()
+	defer timer.Stop()
+	switch ch := e.Channel.(type) {
+	case reflect.Value:
+		chosen, _, _ := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: ch, Send: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(e.evicted)},
+		})
+		return chosen == 0
+	case evictableChan:
+		return ch.sendOrEvict(v, e.evicted)
+	}
+	e.Channel.Send(v)
+	return true
+}
+
+//start timing a blocked delivery
+func (e *RoutedChan) watchSlow() *time.Timer {
+	since := time.Now()
+	return time.AfterFunc(e.router.slowPolicy.Threshold, func() { e.router.slowRecver(e, since) })
+}
+
+//report slow recver e, blocked since "since", and evict it if required
+func (s *routerImpl) slowRecver(e *RoutedChan, since time.Time) {
+	if !atomic.CompareAndSwapInt32(&e.slow, 0, 1) {
+		return
+	}
+	err := &SlowConsumerError{e.Id, time.Since(since), s.slowPolicy.Detach}
+	s.LogError(err)
+	s.tryRaise(err)
+	if s.slowPolicy.Detach {
+		e.evictOnce.Do(func() {
+			close(e.evicted)
+			go e.Detach()
+		})
+	}
+}
@@ -7,41 +7,101 @@
 package router
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+//Default settings of stream batching
+const (
+	DefStreamMaxBatch = 64
+	DefStreamBufSize  = 16 << 10
+)
+
+/*
+ StreamBatching configures write coalescing and batched reads at remote connections;
+ it is passed as an optional argument to Proxy.ConnectRemote().
+ Outgoing msgs are marshaled into a buffered writer, which is flushed to the connection
+ when MaxBatch msgs are buffered, or when there is no more msgs to send and FlushLatency
+ has passed since the first buffered msg. Ctrl msgs (pub/sub, ready, disconn...) are
+ flushed at once. Incoming data is read thru a buffered reader of BufSize bytes.
+ Zero fields use defaults: DefStreamMaxBatch, no flush latency and DefStreamBufSize.
+ MaxBatch = 1 flushes every msg.
+*/
+type StreamBatching struct {
+	MaxBatch     int
+	FlushLatency time.Duration
+	BufSize      int
+}
+
 type stream struct {
-	peer            peerIntf
-	outputChan      chan *genericMsg //outputMainLoop serve this chan
-	outputAsyncChan *asyncChan       //wrap outputChan to give it unlimited buffering
+	peer peerIntf
+	//outputMainLoop serve these chans: ctrl msgs first, then app msgs by priority
+	ctrlChan         chan *genericMsg
+	outputChans      [NumPriorities]chan *genericMsg
+	outputAsyncChans [NumPriorities]*asyncChan //wrap outputChans to give them unlimited buffering
+	asyncOutput      bool                      //app msgs are queued in outputAsyncChans before outputChans
+	//scheduling state, only accessed in outputMainLoop
+	skipped    [NumPriorities]int //times a class with queued msgs is passed over
+	barrier    *genericMsg        //ctrl msg waiting for app msgs queued before it
+	drainCount [NumPriorities]int //app msgs to send before barrier, or 1 till drainMarker recved from asyncChan
 	//
 	rwc   io.ReadWriteCloser
 	mar   Marshaler
 	demar Demarshaler
+	//write coalescing, only accessed in outputMainLoop
+	batching      StreamBatching
+	writer        *bufio.Writer
+	numBuffered   int       //msgs buffered in writer
+	firstBuffered time.Time //when the first of them buffered
 	//
 	proxy *proxyImpl
+	//local ids of app msgs translated outward, to look up ttl of their queued msgs
+	localIds  map[interface{}]Id
+	localLock sync.Mutex
+	//both sides in mesh mode, set when peer's ConnInfoMsg is recved
+	meshPath bool
 	//others
 	Logger
 	FaultRaiser
 	Closed    bool
 	numSender int
 	sync.Mutex
+	//envelope header recved before next app msg, only accessed in inputMainLoop
+	pendingEnv *Envelope
 }
 
-func newStream(rwc io.ReadWriteCloser, mp MarshalingPolicy, p *proxyImpl) *stream {
+func newStream(rwc io.ReadWriteCloser, mp MarshalingPolicy, p *proxyImpl, b *StreamBatching) *stream {
 	s := new(stream)
 	s.proxy = p
 	//
-	s.outputChan = make(chan *genericMsg, s.proxy.router.defChanBufSize+DefCmdChanBufSize)
-	s.outputAsyncChan = &asyncChan{Channel: reflect.ValueOf(s.outputChan)}
+	s.ctrlChan = make(chan *genericMsg, s.proxy.router.defChanBufSize+DefCmdChanBufSize)
+	for p := range s.outputChans {
+		s.outputChans[p] = make(chan *genericMsg, s.proxy.router.defChanBufSize+DefCmdChanBufSize)
+		s.outputAsyncChans[p] = &asyncChan{Channel: reflect.ValueOf(s.outputChans[p]), expired: s.outputExpiry,
+			limit: s.proxy.router.highWater, full: s.proxy.router.slowConsumer("stream output of proxy " + s.proxy.name)}
+	}
+	s.asyncOutput = s.proxy.router.async || s.proxy.flowController != nil
+	s.localIds = make(map[interface{}]Id)
 	s.rwc = rwc
+	if b != nil {
+		s.batching = *b
+	}
+	if s.batching.MaxBatch <= 0 {
+		s.batching.MaxBatch = DefStreamMaxBatch
+	}
+	if s.batching.BufSize <= 0 {
+		s.batching.BufSize = DefStreamBufSize
+	}
+	s.writer = bufio.NewWriterSize(&countingWriter{rwc, &p.stats.bytesOut}, s.batching.BufSize)
 	mp.Register(s.proxy.router.seedId)
-	s.mar = mp.NewMarshaler(rwc)
-	s.demar = mp.NewDemarshaler(rwc)
+	s.mar = mp.NewMarshaler(s.writer)
+	s.demar = mp.NewDemarshaler(bufio.NewReaderSize(&countingReader{rwc, &p.stats.bytesIn}, s.batching.BufSize))
 	//
 	ln := ""
 	if len(p.router.name) > 0 {
@@ -52,7 +112,7 @@ func newStream(rwc io.ReadWriteCloser, mp MarshalingPolicy, p *proxyImpl) *strea
 		}
 		ln += "_stream"
 	}
-	s.Logger.Init(p.router.SysID(RouterLogId), p.router, ln)
+	s.Logger.Init(p.router.SysID(RouterLogId), p.router, ln, "proxy", p.name)
 	s.FaultRaiser.Init(p.router.SysID(RouterFaultId), p.router, ln)
 	return s
 }
@@ -79,22 +139,22 @@ func (s *stream) Close() {
 }
 
 //when concating channel adpaters: asyncChan, genMsgChan, attach asyncChan first
-//so all outgoing channels share the same asyncChan (its buffer and forwarder)
-//there will only 1 forwarder for each stream connection
+//so all outgoing channels of the same priority share the same asyncChan (its buffer and forwarder)
+//there will only 1 forwarder for each priority class of stream connection
 func (s *stream) appMsgChanForId(id Id) (Channel, int) {
 	var appCh Channel
-	if s.proxy.translator != nil {
-		if s.proxy.router.async || s.proxy.flowController != nil {
-			appCh = newGenMsgChan(s.proxy.translator.TranslateOutward(id), s.outputAsyncChan)
-		} else {
-			appCh = newGenericMsgChan(s.proxy.translator.TranslateOutward(id), s.outputChan)
-		}
+	p := s.proxy.router.priorityOf(id)
+	localId := id
+	id = s.proxy.translator.TranslateOutward(id)
+	if s.asyncOutput && id.Key() != localId.Key() {
+		s.localLock.Lock()
+		s.localIds[id.Key()] = localId
+		s.localLock.Unlock()
+	}
+	if s.asyncOutput {
+		appCh = newGenMsgChan(id, s.outputAsyncChans[p])
 	} else {
-		if s.proxy.router.async || s.proxy.flowController != nil {
-			appCh = newGenMsgChan(id, s.outputAsyncChan)
-		} else {
-			appCh = newGenericMsgChan(id, s.outputChan)
-		}
+		appCh = newGenericMsgChan(id, s.outputChans[p])
 	}
 	s.Lock()
 	s.numSender++
@@ -104,7 +164,7 @@ func (s *stream) appMsgChanForId(id Id) (Channel, int) {
 
 //send ctrl data to io.Writer
 func (s *stream) sendCtrlMsg(m *genericMsg) (err error) {
-	s.outputChan <- m
+	s.ctrlChan <- m
 	if m.Id.SysIdIndex() == DisconnId {
 		s.Close()
 	}
@@ -117,53 +177,87 @@ func (s *stream) outputMainLoop() {
 	var err error
 	cont := true
 	for cont {
-		m, oOpen := <-s.outputChan
-		if !oOpen {
+		var m *genericMsg
+		if m, err = s.nextOutput(); err != nil {
+			s.LogError(err)
+			break
+		}
+		if m.Id.Scope() == NumScope && m.Id.Member() == NumMembership {
+			s.Lock()
+			s.numSender--
+			if s.numSender == 0 && s.Closed {
+				cont = false
+			}
+			s.Unlock()
+			if !cont {
+				break
+			}
+		}
+		//send envelope header before app msg, and send the bare msg after it
+		var span Span
+		if env, ok := m.Data.(*Envelope); ok && m.Id.SysIdIndex() < 0 {
+			hdr := env.header()
+			if s.proxy.router.tracing {
+				span = s.proxy.router.startSpan("proxy.out", m.Id, env.Trace)
+				span.SetAttribute("proxy", s.proxy.name)
+				hdr.Trace = span.Context()
+			}
+			if err = s.marshalEnvelope(hdr); err != nil {
+				s.LogError(err)
+				break
+			}
+			m = &genericMsg{m.Id, env.Data}
+		}
+		//send id
+		if err = s.mar.Marshal(m.Id); err != nil {
+			s.LogError(err)
 			cont = false
-		} else {
-			if m.Id.Scope() == NumScope && m.Id.Member() == NumMembership {
-				s.Lock()
-				s.numSender--
-				if s.numSender == 0 && s.Closed {
+		} else if !(m.Id.Scope() == NumScope && m.Id.Member() == NumMembership) {
+			//for json encoding, we need pre-create id structs saved as interface
+			//in messages; so send length of message first; so we can reconstruct
+			//the array at recv side
+			switch m.Id.SysIdIndex() {
+			case PubId, UnPubId, SubId, UnSubId:
+				ici := m.Data.(*ChanInfoMsg)
+				if err = marshalIdChanInfoMsg(s.mar, ici, s.withPath()); err != nil {
+					s.LogError(err)
 					cont = false
 				}
-				s.Unlock()
-				if !cont {
-					break
+			case ReadyId:
+				ici := m.Data.(*ConnReadyMsg)
+				if err = marshalConnReadyMsg(s.mar, ici); err != nil {
+					s.LogError(err)
+					cont = false
+				}
+			case RouterLogId, RouterFaultId:
+				if err = marshalRecord(s.mar, m.Data); err != nil {
+					s.LogError(err)
+					cont = false
+				}
+			default:
+				//send data
+				if err = s.mar.Marshal(m.Data); err != nil {
+					s.LogError(err)
+					cont = false
 				}
 			}
-			//send id
-			if err = s.mar.Marshal(m.Id); err != nil {
+		}
+		if span != nil {
+			span.End()
+		}
+		if cont {
+			if err = s.buffered(m.Id); err != nil {
 				s.LogError(err)
 				cont = false
-			} else if !(m.Id.Scope() == NumScope && m.Id.Member() == NumMembership) {
-				//for json encoding, we need pre-create id structs saved as interface
-				//in messages; so send length of message first; so we can reconstruct
-				//the array at recv side
-				switch m.Id.SysIdIndex() {
-				case PubId, UnPubId, SubId, UnSubId:
-					ici := m.Data.(*ChanInfoMsg)
-					if err = marshalIdChanInfoMsg(s.mar, ici); err != nil {
-						s.LogError(err)
-						cont = false
-					}
-				case ReadyId:
-					ici := m.Data.(*ConnReadyMsg)
-					if err = marshalConnReadyMsg(s.mar, ici); err != nil {
-						s.LogError(err)
-						cont = false
-					}
-				default:
-					//send data
-					if err = s.mar.Marshal(m.Data); err != nil {
-						s.LogError(err)
-						cont = false
-					}
-				}
 			}
 		}
 	}
+	if err == nil && s.numBuffered > 0 {
+		//best effort to send out msgs left in buffer, conn may be closed already
+		s.flush()
+	}
 	if err != nil {
+		atomic.AddUint64(&s.proxy.stats.marshalErrs, 1)
 		//must be io conn fail or marshal fail
 		//notify proxy disconn
 		s.peer.sendCtrlMsg(&genericMsg{s.proxy.router.SysID(DisconnId), &ConnInfoMsg{}})
@@ -172,12 +266,174 @@ func (s *stream) outputMainLoop() {
 	s.Close()
 }
 
+//recv next msg to send; when output queues drain, flush buffered msgs after flush latency
+func (s *stream) nextOutput() (m *genericMsg, err error) {
+	if m = s.tryRecvOutput(); m != nil {
+		return
+	}
+	if s.numBuffered > 0 {
+		if wait := time.Until(s.firstBuffered.Add(s.batching.FlushLatency)); wait > 0 {
+			timer := time.NewTimer(wait)
+			m = s.recvOutput(timer.C)
+			timer.Stop()
+			if m != nil {
+				return
+			}
+		}
+		if err = s.flush(); err != nil {
+			return
+		}
+	}
+	m = s.recvOutput(nil)
+	return
+}
+
+//recv next msg from output queues in order of priority, or nil if all empty
+func (s *stream) tryRecvOutput() *genericMsg {
+	if s.barrier != nil {
+		for p := NumPriorities - 1; p >= PriorityLow; p-- {
+			for s.drainCount[p] > 0 {
+				m := <-s.outputChans[p]
+				if _, ok := m.Data.(drainMarker); ok {
+					//all msgs queued in asyncChan before barrier are sent
+					s.drainCount[p] = 0
+					continue
+				}
+				if !s.asyncOutput {
+					s.drainCount[p]--
+				}
+				return m
+			}
+		}
+		m := s.barrier
+		s.barrier = nil
+		return m
+	}
+	select {
+	case m := <-s.ctrlChan:
+		return s.ctrlOutput(m)
+	default:
+	}
+	//serve starving classes first
+	for p := PriorityLow; p < PriorityHigh; p++ {
+		if s.skipped[p] >= starvationLimit {
+			select {
+			case m := <-s.outputChans[p]:
+				s.served(p)
+				return m
+			default:
+				s.skipped[p] = 0
+			}
+		}
+	}
+	for p := NumPriorities - 1; p >= PriorityLow; p-- {
+		select {
+		case m := <-s.outputChans[p]:
+			s.served(p)
+			return m
+		default:
+		}
+	}
+	return nil
+}
+
+//wait for next msg from output queues, or nil if timeout
+func (s *stream) recvOutput(timeout <-chan time.Time) *genericMsg {
+	select {
+	case m := <-s.ctrlChan:
+		return s.ctrlOutput(m)
+	case m := <-s.outputChans[PriorityHigh]:
+		return m
+	case m := <-s.outputChans[PriorityNormal]:
+		return m
+	case m := <-s.outputChans[PriorityLow]:
+		return m
+	case <-timeout:
+	}
+	return nil
+}
+
+//drainMarker is queued in output asyncChans behind the app msgs which must be sent before a barrier
+type drainMarker struct{}
+
+//ctrl msgs removing ids at peer are barriers: app msgs queued before them are sent first,
+//so peer will not recv msgs of ids it has removed
+func (s *stream) ctrlOutput(m *genericMsg) *genericMsg {
+	switch m.Id.SysIdIndex() {
+	case UnPubId, UnSubId, DisconnId:
+		if s.asyncOutput {
+			//msgs buffered in asyncChans are not in outputChans yet, so wait for markers behind them;
+			//markers are queued by another goroutine, since asyncChans could block till we recv
+			for p := range s.drainCount {
+				s.drainCount[p] = 1
+			}
+			marker := &genericMsg{m.Id, drainMarker{}}
+			go func() {
+				for _, ac := range s.outputAsyncChans {
+					ac.Send(reflect.ValueOf(marker))
+				}
+			}()
+			s.barrier = m
+			return s.tryRecvOutput()
+		}
+		queued := false
+		for p, ch := range s.outputChans {
+			s.drainCount[p] = len(ch)
+			queued = queued || len(ch) > 0
+		}
+		if queued {
+			s.barrier = m
+			return s.tryRecvOutput()
+		}
+	}
+	return m
+}
+
+//a msg of priority p is served, lower classes with queued msgs are passed over
+func (s *stream) served(p Priority) {
+	s.skipped[p] = 0
+	for q := PriorityLow; q < p; q++ {
+		if len(s.outputChans[q]) > 0 {
+			s.skipped[q]++
+		}
+	}
+}
+
+//a msg is marshaled into writer, flush if batch is full or it is a ctrl msg
+func (s *stream) buffered(id Id) error {
+	if s.numBuffered == 0 {
+		s.firstBuffered = time.Now()
+	}
+	s.numBuffered++
+	if s.numBuffered >= s.batching.MaxBatch || id.SysIdIndex() >= 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *stream) flush() error {
+	s.numBuffered = 0
+	return s.writer.Flush()
+}
+
+func (s *stream) marshalEnvelope(hdr *Envelope) (err error) {
+	if err = s.mar.Marshal(s.proxy.router.SysID(EnvelopeId)); err != nil {
+		return
+	}
+	return s.mar.Marshal(hdr)
+}
+
 //read data from io.Reader, pass ctrlMsg to exportCtrlChan and dataMsg to peer
 func (s *stream) inputMainLoop() {
 	s.Log(LOG_INFO, "stream inputMainLoop start")
 	cont := true
 	for cont {
 		if err := s.recv(); err != nil {
+			s.Lock()
+			if err != io.EOF && !s.Closed {
+				atomic.AddUint64(&s.proxy.stats.demarshalErrs, 1)
+			}
+			s.Unlock()
 			cont = false
 		}
 	}
@@ -186,6 +442,13 @@ func (s *stream) inputMainLoop() {
 	s.Close()
 }
 
+//Path of pub/sub info is exchanged when both sides are in mesh mode
+func (s *stream) withPath() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.meshPath
+}
+
 func (s *stream) recv() (err error) {
 	r := s.proxy.router
 	id, _ := r.seedId.Clone()
@@ -202,6 +465,11 @@ func (s *stream) recv() (err error) {
 			s.LogError(err)
 			return
 		} else {
+			if id.SysIdIndex() == ConnId {
+				s.Lock()
+				s.meshPath = r.mesh != nil && len(cm.MeshId) > 0
+				s.Unlock()
+			}
 			s.peer.sendCtrlMsg(&genericMsg{id, cm})
 		}
 	case ReadyId:
@@ -213,9 +481,17 @@ func (s *stream) recv() (err error) {
 		} else {
 			s.peer.sendCtrlMsg(&genericMsg{id, cm})
 		}
+	case EnvelopeId:
+		env := &Envelope{}
+		if err = s.demar.Demarshal(env); err != nil {
+			s.LogError(err)
+			return
+		}
+		//keep it for the following app msg
+		s.pendingEnv = env
 	case PubId, UnPubId, SubId, UnSubId:
 		cm := &ChanInfoMsg{}
-		err = demarshalIdChanInfoMsg(s.demar, id, cm)
+		err = demarshalIdChanInfoMsg(s.demar, id, cm, s.withPath())
 		if err != nil {
 			s.LogError(err)
 			return
@@ -224,14 +500,31 @@ func (s *stream) recv() (err error) {
 		}
 	default: //appMsg
 		peerChan, num := s.peer.appMsgChanForId(id)
+		closed := id.Scope() == NumScope && id.Member() == NumMembership
 		if peerChan == nil {
-			err = errors.New(fmt.Sprintf("Stream fail to find sendChan for id %v", id))
-			s.LogError(err)
+			//forwarding chan can be removed while msgs are in flight, such as after
+			//proxy's filter or translator changed; drop them and keep the stream in sync
+			if closed {
+				return
+			}
+			s.pendingEnv = nil
+			if err = skipMsg(s.demar); err != nil {
+				err = errors.New(fmt.Sprintf("Stream fail to find sendChan for id %v", id))
+				s.LogError(err)
+				return
+			}
+			s.Logf(LOG_WARN, "drop msg of id %v without sendChan", id)
 			return
 		}
-		if id.Scope() == NumScope && id.Member() == NumMembership { //chan is closed
-			peerChan.Close()
-			s.Log(LOG_INFO, fmt.Sprintf("close proxy forwarding chan for %v", id))
+		if closed { //chan is closed
+			func() {
+				//proxy could be closing the same chan when peer unpubs it
+				defer func() {
+					_ = recover()
+				}()
+				peerChan.Close()
+			}()
+			s.Logf(LOG_INFO, "close proxy forwarding chan for %v", id)
 			return
 		}
 		chanType := peerChan.Type()
@@ -239,14 +532,36 @@ func (s *stream) recv() (err error) {
 			err = errors.New(fmt.Sprintf("failed to find chanType for id %v", id))
 			return
 		}
-		appMsg := reflect.New(chanType.Elem())
-		err = s.demar.Demarshal(appMsg.Interface())
+		var appMsg reflect.Value
+		if idx := id.SysIdIndex(); exportedSysId(idx) {
+			appMsg, err = demarshalRecord(s.demar, idx)
+		} else {
+			appMsg = reflect.New(chanType.Elem())
+			err = s.demar.Demarshal(appMsg.Interface())
+			appMsg = appMsg.Elem()
+		}
+		env := s.pendingEnv
+		s.pendingEnv = nil
 		if err != nil {
 			s.LogError(err)
 			return
 		} else {
 			if num > 0 {
-				peerChan.Send(appMsg.Elem())
+				if env != nil {
+					env.Data = appMsg.Interface()
+					var span Span
+					if r.tracing {
+						span = r.startSpan("proxy.in", id, env.Trace)
+						span.SetAttribute("proxy", s.proxy.name)
+						env.Trace = span.Context()
+					}
+					peerChan.Send(reflect.ValueOf(env))
+					if span != nil {
+						span.End()
+					}
+				} else {
+					peerChan.Send(appMsg)
+				}
 			}
 		}
 	}
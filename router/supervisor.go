@@ -0,0 +1,439 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+ Supervisor runs tasks in goroutines and restarts them when they fail, in the
+ style of Erlang supervisors. A task fails when it panics or raises a fault
+ with the FaultRaiser in its TaskContext (which sends a FaultRecord to the
+ supervisor's fault id). Before a task is (re)started, supervisor creates
+ the chans listed in its TaskSpec and attaches them to their ids; when a task
+ is stopped, its chans are detached and TaskContext.Stop is closed, so the old
+ task goroutine should exit when Stop is closed; msgs left in its recv chans are
+ dropped. e.g.
+
+    sup := router.NewSupervisor(rot, "sup", router.StrID("/Fault/Sup"), router.OneForOne, 5, time.Minute)
+    sup.AddTask(&router.TaskSpec{
+        Name:  "echo",
+        Chans: []*router.ChanSpec{{router.StrID("/echo"), reflect.RecvDir, reflect.TypeOf(make(chan string)), 0}},
+        Run: func(ctx *router.TaskContext) {
+            ch := ctx.RecvChan(router.StrID("/echo")).(chan string)
+            for {
+                select {
+                case s := <-ch:
+                    ...
+                case <-ctx.Stop:
+                    return
+                }
+            }
+        },
+    })
+
+ When tasks fail more than maxRestarts times within window, supervisor stops
+ all its tasks and raises a fault to its parent supervisor (see AddSupervisor),
+ or to router's RouterFaultId if it has no parent.
+ A task which returns normally is finished and will not be restarted.
+*/
+type Supervisor struct {
+	router      Router
+	name        string
+	faultId     Id
+	strategy    RestartStrategy
+	maxRestarts int
+	window      time.Duration
+	children    []supervised
+	restarts    []time.Time
+	faultChan   chan *FaultRecord
+	exitChan    chan *taskExit
+	closeChan   chan bool
+	closed      bool
+	lock        sync.Mutex
+	Logger
+	FaultRaiser //raise escalated faults
+}
+
+type RestartStrategy int
+
+const (
+	OneForOne RestartStrategy = iota //restart only the failed task
+	OneForAll                        //restart all tasks when one fails
+)
+
+//ChanSpec describes a chan which supervisor creates for a task and attaches to Id
+type ChanSpec struct {
+	Id       Id
+	Dir      reflect.ChanDir //reflect.SendDir for send chans, reflect.RecvDir for recv chans
+	ChanType reflect.Type
+	BufSize  int
+}
+
+//TaskSpec describes a task run by supervisor
+type TaskSpec struct {
+	Name  string
+	Chans []*ChanSpec
+	Run   func(ctx *TaskContext)
+}
+
+//TaskContext gives a running task its chans; a new one is created each time the task starts
+type TaskContext struct {
+	Name     string
+	Restarts int         //number of times the task has been restarted
+	Stop     <-chan bool //closed when supervisor stops the task
+	*FaultRaiser
+	router    Router
+	stop      chan bool
+	sendChans map[interface{}]reflect.Value
+	recvChans map[interface{}]reflect.Value
+	attached  []*ChanSpec
+	started   int64
+	stopped   bool
+}
+
+//return the send chan created for id
+func (ctx *TaskContext) SendChan(id Id) interface{} {
+	if ch, ok := ctx.sendChans[id.Key()]; ok {
+		return ch.Interface()
+	}
+	return nil
+}
+
+//return the recv chan created for id
+func (ctx *TaskContext) RecvChan(id Id) interface{} {
+	if ch, ok := ctx.recvChans[id.Key()]; ok {
+		return ch.Interface()
+	}
+	return nil
+}
+
+//children of supervisor: tasks or sub-supervisors
+type supervised interface {
+	childName() string
+	start() error
+	stop()
+	running() bool
+}
+
+type taskExit struct {
+	task *taskChild
+	ctx  *TaskContext
+	err  error
+}
+
+func NewSupervisor(r Router, name string, faultId Id, strategy RestartStrategy, maxRestarts int, window time.Duration) *Supervisor {
+	s := &Supervisor{router: r, name: name, faultId: faultId, strategy: strategy, maxRestarts: maxRestarts, window: window}
+	if len(s.name) == 0 {
+		s.name = "supervisor"
+	}
+	s.Logger.Init(r.SysID(RouterLogId), r, s.name)
+	s.FaultRaiser.Init(r.SysID(RouterFaultId), r, s.name)
+	s.faultChan = make(chan *FaultRecord, DefCmdChanBufSize)
+	s.exitChan = make(chan *taskExit, DefCmdChanBufSize)
+	s.closeChan = make(chan bool)
+	//keep faultChan open when tasks detach their fault raisers
+	bc := make(chan *BindEvent, 1)
+	if _, err := r.AttachRecvChan(faultId, s.faultChan, bc); err != nil {
+		s.LogError(err)
+		return nil
+	}
+	go s.mainLoop()
+	return s
+}
+
+func (s *Supervisor) mainLoop() {
+	for {
+		select {
+		case fr, ok := <-s.faultChan:
+			if !ok {
+				return
+			}
+			s.handleFault(fr)
+		case ex := <-s.exitChan:
+			s.handleExit(ex)
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+//add a task to supervisor and start it
+func (s *Supervisor) AddTask(spec *TaskSpec) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errors.New(errSupervisorClosed)
+	}
+	t := &taskChild{sup: s, spec: spec}
+	if err := t.start(); err != nil {
+		return err
+	}
+	s.children = append(s.children, t)
+	return nil
+}
+
+//add a running supervisor as a child; sub-supervisor escalates its failures to this supervisor
+func (s *Supervisor) AddSupervisor(sub *Supervisor) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errors.New(errSupervisorClosed)
+	}
+	//sub's faults may be raised from its own goroutine, swap its raiser under its lock
+	sub.lock.Lock()
+	if sub.closed {
+		sub.lock.Unlock()
+		return errors.New(errSupervisorClosed)
+	}
+	sub.FaultRaiser.Close()
+	sub.FaultRaiser.Init(s.faultId, s.router, sub.name)
+	sub.lock.Unlock()
+	s.children = append(s.children, sub)
+	return nil
+}
+
+//stop all tasks and detach from router
+func (s *Supervisor) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.stopAll()
+	var subs []*Supervisor
+	for _, c := range s.children {
+		if sub, ok := c.(*Supervisor); ok {
+			subs = append(subs, sub)
+		}
+	}
+	s.lock.Unlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+	close(s.closeChan)
+	s.router.DetachChan(s.faultId, s.faultChan)
+	s.FaultRaiser.Close()
+	s.Logger.Close()
+}
+
+func (s *Supervisor) findChild(name string) supervised {
+	for _, c := range s.children {
+		if c.childName() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) handleFault(fr *FaultRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.findChild(fr.Source)
+	if s.closed || c == nil || !c.running() {
+		return
+	}
+	//ignore faults raised before the task was restarted
+	if t, ok := c.(*taskChild); ok && fr.Timestamp < t.ctx.started {
+		return
+	}
+	s.restart(c, fr.Info)
+}
+
+func (s *Supervisor) handleExit(ex *taskExit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || ex.task.ctx != ex.ctx || ex.ctx.stopped {
+		return
+	}
+	if ex.err == nil {
+		s.Logf(LOG_INFO, "task %s finished", ex.task.spec.Name)
+		ex.task.stop()
+		ex.task.finished = true
+		return
+	}
+	s.restart(ex.task, ex.err)
+}
+
+//restart children according to strategy; escalate if restarting too often
+func (s *Supervisor) restart(c supervised, cause error) {
+	s.LogError(errors.New(fmt.Sprintf("%s %s failed: %v", errTaskFailed, c.childName(), cause)))
+	if !s.allowRestart() {
+		s.stopAll()
+		s.restarts = nil
+		s.Raise(errors.New(fmt.Sprintf("%s: %s, last failure at %s: %v", errMaxRestarts, s.name, c.childName(), cause)))
+		return
+	}
+	switch s.strategy {
+	case OneForOne:
+		c.stop()
+		if err := c.start(); err != nil {
+			s.LogError(err)
+		}
+	case OneForAll:
+		s.stopAll()
+		s.startAll()
+	}
+}
+
+func (s *Supervisor) allowRestart() bool {
+	now := time.Now()
+	i := 0
+	for s.window > 0 && i < len(s.restarts) && now.Sub(s.restarts[i]) > s.window {
+		i++
+	}
+	s.restarts = append(s.restarts[i:], now)
+	return len(s.restarts) <= s.maxRestarts
+}
+
+//stop children in reverse order
+func (s *Supervisor) stopAll() {
+	for i := len(s.children) - 1; i >= 0; i-- {
+		if s.children[i].running() {
+			s.children[i].stop()
+		}
+	}
+}
+
+func (s *Supervisor) startAll() {
+	for _, c := range s.children {
+		if t, ok := c.(*taskChild); ok && t.finished {
+			continue
+		}
+		if err := c.start(); err != nil {
+			s.LogError(err)
+		}
+	}
+}
+
+//Supervisor as child of another supervisor
+func (s *Supervisor) childName() string { return s.name }
+
+func (s *Supervisor) start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restarts = nil
+	s.startAll()
+	return nil
+}
+
+func (s *Supervisor) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopAll()
+}
+
+func (s *Supervisor) running() bool { return true }
+
+//a task run by supervisor
+type taskChild struct {
+	sup      *Supervisor
+	spec     *TaskSpec
+	ctx      *TaskContext
+	restarts int
+	finished bool
+}
+
+func (t *taskChild) childName() string { return t.spec.Name }
+
+func (t *taskChild) running() bool { return t.ctx != nil && !t.ctx.stopped }
+
+func (t *taskChild) start() (err error) {
+	r := t.sup.router
+	ctx := &TaskContext{Name: t.spec.Name, router: r}
+	if t.ctx != nil {
+		t.restarts++
+	}
+	ctx.Restarts = t.restarts
+	ctx.stop = make(chan bool)
+	ctx.Stop = ctx.stop
+	ctx.sendChans = make(map[interface{}]reflect.Value)
+	ctx.recvChans = make(map[interface{}]reflect.Value)
+	ctx.started = time.Now().UnixNano()
+	t.ctx = ctx
+	t.finished = false
+	for _, cs := range t.spec.Chans {
+		ch := reflect.MakeChan(cs.ChanType, cs.BufSize)
+		if cs.Dir == reflect.SendDir {
+			_, err = r.AttachSendChan(cs.Id, ch.Interface())
+			ctx.sendChans[cs.Id.Key()] = ch
+		} else {
+			//keep recv chans open when peer tasks are restarted
+			_, err = r.AttachRecvChan(cs.Id, ch.Interface(), make(chan *BindEvent, 1))
+			ctx.recvChans[cs.Id.Key()] = ch
+		}
+		if err != nil {
+			t.stop()
+			return
+		}
+		ctx.attached = append(ctx.attached, cs)
+	}
+	ctx.FaultRaiser = NewFaultRaiser(t.sup.faultId, r, t.spec.Name)
+	go t.run(ctx)
+	return
+}
+
+func (t *taskChild) run(ctx *TaskContext) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s: %v", errTaskPanic, r))
+		}
+		select {
+		case t.sup.exitChan <- &taskExit{t, ctx, err}:
+		case <-t.sup.closeChan:
+		}
+	}()
+	t.spec.Run(ctx)
+}
+
+//stop task: signal it and detach (and close) its chans
+func (t *taskChild) stop() {
+	ctx := t.ctx
+	if ctx == nil || ctx.stopped {
+		return
+	}
+	ctx.stopped = true
+	close(ctx.stop)
+	for _, cs := range ctx.attached {
+		if cs.Dir == reflect.SendDir {
+			ctx.router.DetachChan(cs.Id, ctx.sendChans[cs.Id.Key()].Interface())
+		} else {
+			ch := ctx.recvChans[cs.Id.Key()]
+			ctx.router.DetachChan(cs.Id, ch.Interface())
+			go drainChan(ch)
+		}
+	}
+	if ctx.FaultRaiser != nil {
+		ctx.FaultRaiser.Close()
+	}
+}
+
+//time to wait for msgs in flight to a detached recv chan
+const drainTimeout = time.Second
+
+//drop msgs left in a detached recv chan, so senders in the middle of
+//dispatching to it will not block
+func drainChan(ch reflect.Value) {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv},
+	}
+	for {
+		cases[1].Chan = reflect.ValueOf(time.After(drainTimeout))
+		i, _, ok := reflect.Select(cases)
+		if i == 1 || !ok {
+			return
+		}
+	}
+}
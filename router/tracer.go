@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+ Tracer: hooks to trace msgs thru routers, modeled after OpenTelemetry.
+ When a tracer is installed (passed as an optional argument to router.New()),
+ router will create the following spans:
+    1. "send": when a msg leaves a send chan and is dispatched to recvers
+    2. "proxy.out" / "proxy.in": when a msg is forwarded thru a stream to / from a remote router
+    3. "deliver": when a msg is delivered into a recv chan
+ msgs are wrapped in envelopes so that trace context (Envelope.Trace) is propagated
+ to connected routers and the spans in all hops belong to the same trace.
+ By default, NoopTracer is used and there is no tracing overhead.
+*/
+type Tracer interface {
+	//start a span; if parent is invalid, start a new trace
+	StartSpan(name string, parent TraceContext) Span
+}
+
+//Span represents one traced operation
+type Span interface {
+	Context() TraceContext
+	SetAttribute(key string, val interface{})
+	End()
+}
+
+//NoopTracer does nothing
+var NoopTracer Tracer = noopTracer{}
+
+type noopTracer struct{}
+
+func (t noopTracer) StartSpan(name string, parent TraceContext) Span { return noopSpan{parent} }
+
+type noopSpan struct {
+	ctx TraceContext
+}
+
+func (s noopSpan) Context() TraceContext                    { return s.ctx }
+func (s noopSpan) SetAttribute(key string, val interface{}) {}
+func (s noopSpan) End()                                     {}
+
+//SpanRecord stores the information of an ended span
+type SpanRecord struct {
+	Name     string
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Start    int64
+	End      int64
+	Attrs    map[string]interface{}
+}
+
+func (sr *SpanRecord) String() string {
+	return fmt.Sprintf("[%s %s/%s<-%s %vns] %v", sr.Name, sr.TraceId, sr.SpanId, sr.ParentId, sr.End-sr.Start, sr.Attrs)
+}
+
+/*
+ TraceRecorder is a simple Tracer which keeps ended spans in memory,
+ mostly for tests and debugging. The same recorder can be installed
+ in several routers to collect the spans of a msg across all hops.
+*/
+type TraceRecorder struct {
+	sync.Mutex
+	spans []*SpanRecord
+	rand  *rand.Rand
+}
+
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (tr *TraceRecorder) newId(n int) string {
+	tr.Lock()
+	defer tr.Unlock()
+	b := make([]byte, n)
+	tr.rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (tr *TraceRecorder) StartSpan(name string, parent TraceContext) Span {
+	s := &recordedSpan{recorder: tr}
+	s.Name = name
+	s.ParentId = parent.SpanId
+	s.TraceId = parent.TraceId
+	if !parent.IsValid() {
+		s.TraceId = tr.newId(16)
+	}
+	s.SpanId = tr.newId(8)
+	s.Attrs = make(map[string]interface{})
+	s.Start = time.Now().UnixNano()
+	return s
+}
+
+//return a copy of all ended spans
+func (tr *TraceRecorder) Spans() []*SpanRecord {
+	tr.Lock()
+	defer tr.Unlock()
+	spans := make([]*SpanRecord, len(tr.spans))
+	copy(spans, tr.spans)
+	return spans
+}
+
+//return ended spans of a trace
+func (tr *TraceRecorder) Trace(traceId string) (spans []*SpanRecord) {
+	tr.Lock()
+	defer tr.Unlock()
+	for _, s := range tr.spans {
+		if s.TraceId == traceId {
+			spans = append(spans, s)
+		}
+	}
+	return
+}
+
+func (tr *TraceRecorder) Reset() {
+	tr.Lock()
+	defer tr.Unlock()
+	tr.spans = nil
+}
+
+type recordedSpan struct {
+	SpanRecord
+	recorder *TraceRecorder
+	lock     sync.Mutex
+	ended    bool
+}
+
+func (s *recordedSpan) Context() TraceContext {
+	return TraceContext{s.TraceId, s.SpanId}
+}
+
+func (s *recordedSpan) SetAttribute(key string, val interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Attrs[key] = val
+}
+
+func (s *recordedSpan) End() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.SpanRecord.End = time.Now().UnixNano()
+	s.lock.Unlock()
+	s.recorder.Lock()
+	s.recorder.spans = append(s.recorder.spans, &s.SpanRecord)
+	s.recorder.Unlock()
+}
+
+//start a span for router, with common attributes
+func (s *routerImpl) startSpan(name string, id Id, parent TraceContext) Span {
+	span := s.tracer.StartSpan(name, parent)
+	span.SetAttribute("router", s.name)
+	span.SetAttribute("id", id.String())
+	return span
+}
@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ Msgs can expire before delivery in two ways:
+    1. per id: Router.SetTTL(id, ttl) limits how long msgs of id can be queued in
+       router's buffers (async recv chans, flow controlled chans from peers, and
+       stream output to remote routers). Msgs wrapped in envelopes at send chans
+       of id also get their Deadline set to send time + ttl.
+    2. per msg: Envelope.Deadline, checked before envelopes are buffered or delivered.
+ Expired msgs are dropped and counted in both Dropped and Expired of IdStats
+ (and Expired of ProxyStats for msgs expired in stream output).
+*/
+
+//SetTTL sets time-to-live of msgs of id; ttl <= 0 removes it
+func (s *routerImpl) SetTTL(id Id, ttl time.Duration) {
+	s.ttlLock.Lock()
+	defer s.ttlLock.Unlock()
+	if ttl <= 0 {
+		delete(s.ttls, id.Key())
+		return
+	}
+	s.ttls[id.Key()] = ttl
+}
+
+func (s *routerImpl) ttlOf(id Id) time.Duration {
+	s.ttlLock.RLock()
+	defer s.ttlLock.RUnlock()
+	return s.ttls[id.Key()]
+}
+
+//check if msg v of id queued at time "queued" (UnixNano, 0 if unknown) has expired
+func (s *routerImpl) expired(id Id, v reflect.Value, queued int64) bool {
+	now := time.Now().UnixNano()
+	if isEnvelope(v) && v.Interface().(*Envelope).expired(now) {
+		return true
+	}
+	if queued == 0 {
+		return false
+	}
+	ttl := s.ttlOf(id)
+	return ttl > 0 && now-queued > int64(ttl)
+}
+
+//count expired msg of id as dropped at its entry in routing table
+func (s *routerImpl) countExpired(id Id) {
+	s.tblLock.Lock()
+	defer s.tblLock.Unlock()
+	if ent, ok := s.routingTable[id.Key()]; ok {
+		atomic.AddUint64(&ent.stats.dropped, 1)
+		atomic.AddUint64(&ent.stats.expired, 1)
+	}
+}
+
+//expired hook for asyncChan buffering msgs of id
+func (s *routerImpl) queueExpiry(id Id) func(reflect.Value, int64) bool {
+	return func(v reflect.Value, queued int64) bool {
+		if s.expired(id, v, queued) {
+			s.countExpired(id)
+			return true
+		}
+		return false
+	}
+}
+
+//expired hook for stream output buffer, msgs are *genericMsg of remote ids;
+//ttl is looked up by the local id they are translated from
+func (s *stream) outputExpiry(v reflect.Value, queued int64) bool {
+	m := v.Interface().(*genericMsg)
+	if m.Id.SysIdIndex() >= 0 {
+		return false
+	}
+	id := m.Id
+	s.localLock.Lock()
+	if lid, ok := s.localIds[id.Key()]; ok {
+		id = lid
+	}
+	s.localLock.Unlock()
+	r := s.proxy.router
+	if !r.expired(id, reflect.ValueOf(m.Data), queued) {
+		return false
+	}
+	atomic.AddUint64(&s.proxy.stats.expired, 1)
+	r.countExpired(id)
+	return true
+}
+
+//count expired msg dropped at this chan
+func (e *RoutedChan) countExpired() {
+	if e.stats != nil {
+		atomic.AddUint64(&e.stats.dropped, 1)
+		atomic.AddUint64(&e.stats.expired, 1)
+	}
+}
+
+//drop expired envelope before delivery
+func (e *RoutedChan) expiredEnvelope(v reflect.Value) bool {
+	if isEnvelope(v) && v.Interface().(*Envelope).expired(time.Now().UnixNano()) {
+		e.countExpired()
+		return true
+	}
+	return false
+}
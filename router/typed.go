@@ -0,0 +1,434 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ Typed api: generic wrappers over the reflect based Channel api, e.g.
+
+    snd, _ := router.AttachSend[*Quote](rot, router.StrID("/quotes"))
+    rcv, _ := router.AttachRecv[*Quote](rot, router.StrID("/quotes"))
+    snd.Send(&Quote{...})
+    q, ok := rcv.Recv()
+
+ Msgs from a typed sender to typed recvers of the same type in local router are
+ dispatched and delivered without reflection. Typed chans interoperate with
+ plain chans and remote routers: their chan types are exported in ChanInfo
+ as usual, and msgs to/from them go thru the reflect based path.
+
+ Plain chans are delivered without reflection too, if their types are enabled by
+ EnableFastPath[T](); chans of common builtin types (int, string, []byte ...) are
+ enabled by default. Custom Channel implementations always use the reflect based path.
+ Chans of interface types should not be enabled: *Envelope values sent on them as
+ data would be taken as envelopes and unwrapped at recvers.
+*/
+
+//TypedDispatcher dispatches typed msgs; SendTo() and TrySendTo() deliver msgs to recvers
+type TypedDispatcher[T any] interface {
+	Dispatch(v T, recvers []*RoutedChan)
+}
+
+//TypedDispatchFunc is a wrapper to convert a plain function into a typed dispatcher
+type TypedDispatchFunc[T any] func(v T, recvers []*RoutedChan)
+
+func (f TypedDispatchFunc[T]) Dispatch(v T, recvers []*RoutedChan) {
+	f(v, recvers)
+}
+
+//TypedBroadcast is the typed version of Broadcast
+func TypedBroadcast[T any](v T, recvers []*RoutedChan) {
+	for _, rc := range recvers {
+		SendTo(rc, v)
+	}
+}
+
+//TypedRoundrobin is the typed version of Roundrobin
+type TypedRoundrobin[T any] int
+
+func (r *TypedRoundrobin[T]) Dispatch(v T, recvers []*RoutedChan) {
+	start := *r
+	for {
+		rc := recvers[*r]
+		*r = (*r + 1) % TypedRoundrobin[T](len(recvers))
+		if TrySendTo(rc, v) {
+			break
+		}
+		if *r == start {
+			//all recvers busy
+			rc.countDrop()
+			break
+		}
+	}
+}
+
+//typed dispatcher for dispatch policy, or nil if there is no typed version
+func typedDispatcherFor[T any](p DispatchPolicy) TypedDispatcher[T] {
+	switch p {
+	case BroadcastPolicy:
+		return TypedDispatchFunc[T](TypedBroadcast[T])
+	case RoundRobinPolicy:
+		return new(TypedRoundrobin[T])
+	}
+	return nil
+}
+
+//SendTo delivers a typed msg to recver, without reflection if recver is a typed chan of T
+func SendTo[T any](rc *RoutedChan, v T) {
+	if tc, ok := rc.Channel.(*typedChan[T]); ok && !rc.router.tracing {
+		tc.deliver(rc, v)
+		return
+	}
+	rc.Send(valueOf(v))
+}
+
+//TrySendTo is the non-blocking version of SendTo
+func TrySendTo[T any](rc *RoutedChan, v T) bool {
+	if tc, ok := rc.Channel.(*typedChan[T]); ok && !rc.router.tracing {
+		return tc.tryDeliver(rc, v)
+	}
+	return rc.TrySend(valueOf(v))
+}
+
+//reflect value of msg, typed as chan elem for nil interfaces, same as reflect.Value.Recv()
+func valueOf[T any](v T) reflect.Value {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		rv = reflect.ValueOf(&v).Elem()
+	}
+	return rv
+}
+
+//chan types whose plain chans are attached as typedChans
+var fastChanTypes = struct {
+	sync.RWMutex
+	wrappers map[reflect.Type]func(interface{}) Channel
+}{wrappers: make(map[reflect.Type]func(interface{}) Channel)}
+
+/*
+ EnableFastPath enables reflection-free local delivery for plain chans of type "chan T":
+ when attached, they are wrapped as typed chans. It should be called before chans of
+ type "chan T" are attached, usually in init(). Directional chans are not affected.
+*/
+func EnableFastPath[T any]() {
+	fastChanTypes.Lock()
+	fastChanTypes.wrappers[reflect.TypeOf((chan T)(nil))] = func(v interface{}) Channel {
+		return newTypedChan(v.(chan T), nil)
+	}
+	fastChanTypes.Unlock()
+}
+
+func init() {
+	EnableFastPath[bool]()
+	EnableFastPath[int]()
+	EnableFastPath[int32]()
+	EnableFastPath[int64]()
+	EnableFastPath[uint]()
+	EnableFastPath[uint32]()
+	EnableFastPath[uint64]()
+	EnableFastPath[float32]()
+	EnableFastPath[float64]()
+	EnableFastPath[string]()
+	EnableFastPath[[]byte]()
+}
+
+//wrap plain chan v as typed chan if fast path is enabled for its type, or return nil
+func fastChan(v reflect.Value) Channel {
+	fastChanTypes.RLock()
+	wrap, ok := fastChanTypes.wrappers[v.Type()]
+	fastChanTypes.RUnlock()
+	if !ok {
+		return nil
+	}
+	return wrap(v.Interface())
+}
+
+/*
+ typedChan adapts a "chan T" to Channel interface, so it can be attached to router
+ and bound with other chans; when used as send chan, it forwards msgs without
+ reflection to recvers which are typedChans of T.
+ Interface() returns the "chan T", so it can be detached by it.
+*/
+type typedChan[T any] struct {
+	ch       chan T
+	chanType reflect.Type
+	disp     TypedDispatcher[T]
+	dispInit bool //disp is set by user or from sender's dispatch policy
+}
+
+//a nil disp is replaced by the typed version of sender's dispatch policy if there is one
+func newTypedChan[T any](ch chan T, disp TypedDispatcher[T]) *typedChan[T] {
+	return &typedChan[T]{ch, reflect.TypeOf(ch), disp, disp != nil}
+}
+
+func (c *typedChan[T]) Type() reflect.Type     { return c.chanType }
+func (c *typedChan[T]) Interface() interface{} { return c.ch }
+func (c *typedChan[T]) IsNil() bool            { return c.ch == nil }
+func (c *typedChan[T]) Cap() int               { return cap(c.ch) }
+func (c *typedChan[T]) Len() int               { return len(c.ch) }
+func (c *typedChan[T]) Close()                 { close(c.ch) }
+
+//msg of T in v; msgs of other types panic, so they are dropped and reported
+//as faults by the routed chan delivering them
+func (c *typedChan[T]) elem(v reflect.Value) (t T) {
+	if !v.IsValid() {
+		return
+	}
+	i := v.Interface()
+	t, ok := i.(T)
+	if !ok && i != nil {
+		panic(errors.New(fmt.Sprintf("%s: msg of %v for chan of %v", errChanTypeMismatch, v.Type(), c.chanType)))
+	}
+	return
+}
+
+func (c *typedChan[T]) Send(v reflect.Value) {
+	c.ch <- c.elem(v)
+}
+
+func (c *typedChan[T]) TrySend(v reflect.Value) bool {
+	t := c.elem(v)
+	select {
+	case c.ch <- t:
+		return true
+	default:
+	}
+	return false
+}
+
+func (c *typedChan[T]) Recv() (reflect.Value, bool) {
+	v, ok := <-c.ch
+	return valueOf(v), ok
+}
+
+func (c *typedChan[T]) TryRecv() (reflect.Value, bool) {
+	select {
+	case v, ok := <-c.ch:
+		return valueOf(v), ok
+	default:
+	}
+	return reflect.Value{}, false
+}
+
+//deliver msg from typed dispatcher to recver rc, recovering panics as RoutedChan.Send
+func (c *typedChan[T]) deliver(rc *RoutedChan, v T) {
+	defer func() {
+		if r := recover(); r != nil {
+			rc.countDrop()
+			rc.router.chanPanic(rc, "delivery to", r)
+		}
+	}()
+	if rc.router.slowPolicy != nil {
+		if !c.deliverOrEvict(rc, v) {
+			rc.countDrop()
+			return
+		}
+	} else {
+		c.ch <- v
+	}
+	atomic.AddUint64(&rc.stats.delivered, 1)
+}
+
+//typed version of RoutedChan.sendOrEvict
+func (c *typedChan[T]) deliverOrEvict(rc *RoutedChan, v T) bool {
+	select {
+	case c.ch <- v:
+		atomic.StoreInt32(&rc.slow, 0)
+		return true
+	default:
+	}
+	timer := rc.watchSlow()
+	defer timer.Stop()
+	select {
+	case c.ch <- v:
+		return true
+	case <-rc.evicted:
+	}
+	return false
+}
+
+func (c *typedChan[T]) sendOrEvict(v reflect.Value, evicted <-chan struct{}) bool {
+	t := c.elem(v)
+	select {
+	case c.ch <- t:
+		return true
+	case <-evicted:
+	}
+	return false
+}
+
+func (c *typedChan[T]) tryDeliver(rc *RoutedChan, v T) (sent bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			rc.countDrop()
+			rc.router.chanPanic(rc, "delivery to", r)
+			sent = true //drop it
+		}
+	}()
+	select {
+	case c.ch <- v:
+		atomic.AddUint64(&rc.stats.delivered, 1)
+		return true
+	default:
+	}
+	return false
+}
+
+func (c *typedChan[T]) forward(e *RoutedChan) bool {
+	if !c.dispInit {
+		c.disp = typedDispatcherFor[T](e.dispPolicy)
+		c.dispInit = true
+	}
+	v, ok := <-c.ch
+	if !ok {
+		e.router.detach(e, true)
+		return false
+	}
+	wrap := e.beginDispatch()
+	switch {
+	case !e.inDisp:
+		//all recvers detached while waiting for msg
+		e.countDrop()
+	case wrap || c.disp == nil:
+		//envelopes, tracing and custom dispatch policies need reflect based dispatching
+		e.dispatch(valueOf(v), wrap)
+	default:
+		c.dispatch(e, v)
+	}
+	e.endDispatch()
+	return true
+}
+
+//dispatch typed msg from sender e, recovering panics as RoutedChan.dispatch
+func (c *typedChan[T]) dispatch(e *RoutedChan, v T) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.countDrop()
+			e.router.chanPanic(e, "dispatch from", r)
+		}
+	}()
+	atomic.AddUint64(&e.stats.sent, 1)
+	c.disp.Dispatch(v, e.bindings)
+}
+
+//TypedSender is a typed send chan attached to router
+type TypedSender[T any] struct {
+	Id     Id
+	C      chan<- T
+	Binds  <-chan *BindEvent //events of recvers attaching / detaching
+	router Router
+	ch     chan T
+	routCh *RoutedChan
+}
+
+/*
+ AttachSend creates a "chan T" and attaches it to id as send chan. Optional arguments:
+    int: buffer size of the chan
+    TypedDispatcher[T]: dispatcher for msgs from this chan, by default
+       router's dispatch policy is used
+*/
+func AttachSend[T any](r Router, id Id, args ...interface{}) (*TypedSender[T], error) {
+	bufSize := 0
+	var disp TypedDispatcher[T]
+	for _, arg := range args {
+		switch av := arg.(type) {
+		case int:
+			bufSize = av
+		case TypedDispatcher[T]:
+			disp = av
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid arguments to attach typed send chan: %v", arg))
+		}
+	}
+	s := &TypedSender[T]{Id: id, router: r, ch: make(chan T, bufSize)}
+	s.C = s.ch
+	bc := make(chan *BindEvent, DefCmdChanBufSize)
+	s.Binds = bc
+	var err error
+	if s.routCh, err = r.AttachSendChan(id, newTypedChan(s.ch, disp), bc); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TypedSender[T]) Send(v T) { s.ch <- v }
+
+func (s *TypedSender[T]) TrySend(v T) bool {
+	select {
+	case s.ch <- v:
+		return true
+	default:
+	}
+	return false
+}
+
+func (s *TypedSender[T]) NumPeers() int { return s.routCh.NumPeers() }
+
+//detach from router, the chan is closed
+func (s *TypedSender[T]) Close() { s.router.DetachChan(s.Id, s.ch) }
+
+/*
+ TypedRecver is a typed recv chan attached to router. Since it monitors bind events,
+ its chan stays open when all senders detach, which is reported as EndOfData in Binds.
+*/
+type TypedRecver[T any] struct {
+	Id     Id
+	C      <-chan T
+	Binds  <-chan *BindEvent //events of senders attaching / detaching
+	router Router
+	ch     chan T
+	routCh *RoutedChan
+}
+
+/*
+ AttachRecv creates a "chan T" and attaches it to id as recv chan. Optional arguments:
+    int: buffer size of the chan
+*/
+func AttachRecv[T any](r Router, id Id, args ...interface{}) (*TypedRecver[T], error) {
+	bufSize := 0
+	for _, arg := range args {
+		switch av := arg.(type) {
+		case int:
+			bufSize = av
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid arguments to attach typed recv chan: %v", arg))
+		}
+	}
+	rv := &TypedRecver[T]{Id: id, router: r, ch: make(chan T, bufSize)}
+	rv.C = rv.ch
+	bc := make(chan *BindEvent, DefCmdChanBufSize)
+	rv.Binds = bc
+	var err error
+	if rv.routCh, err = r.AttachRecvChan(id, newTypedChan[T](rv.ch, nil), bc); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (rv *TypedRecver[T]) Recv() (T, bool) {
+	v, ok := <-rv.ch
+	return v, ok
+}
+
+func (rv *TypedRecver[T]) TryRecv() (v T, ok bool) {
+	select {
+	case v, ok = <-rv.ch:
+	default:
+	}
+	return
+}
+
+func (rv *TypedRecver[T]) NumPeers() int { return rv.routCh.NumPeers() }
+
+//detach from router
+func (rv *TypedRecver[T]) Close() { rv.router.DetachChan(rv.Id, rv.ch) }
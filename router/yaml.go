@@ -0,0 +1,273 @@
+//
+// Copyright (c) 2010 - 2012 Yigong Liu
+//
+// Distributed under New BSD License
+//
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//a minimal parser of the yaml subset used by rules files: block mappings and sequences,
+//flow sequences of scalars, quoted and plain scalars, and comments. scalars are strings,
+//the result is made of map[string]interface{}, []interface{} and string, ready to be
+//marshaled into json
+
+type yamlLine struct {
+	num    int //line number in file
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []*yamlLine
+	pos   int
+}
+
+func parseYaml(data []byte) (interface{}, error) {
+	p := new(yamlParser)
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(stripYamlComment(l), " \t\r")
+		text := strings.TrimLeft(l, " ")
+		if len(text) == 0 || text == "---" {
+			continue
+		}
+		if text[0] == '\t' {
+			return nil, yamlError(i+1, "tabs are not allowed for indentation")
+		}
+		p.lines = append(p.lines, &yamlLine{i + 1, len(l) - len(text), text})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.block(p.lines[0].indent)
+	if err == nil && p.pos < len(p.lines) {
+		err = yamlError(p.lines[p.pos].num, "bad indentation")
+	}
+	return v, err
+}
+
+func yamlError(num int, msg string) error {
+	return errors.New(fmt.Sprintf("%s: yaml line %d: %s", errInvalidRule, num, msg))
+}
+
+//stripYamlComment removes comment starting with # outside quotes
+func stripYamlComment(l string) string {
+	var quote byte
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && quoteStart(l, i):
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+//quotes only start at the beginning of tokens, not inside plain scalars such as don't
+func quoteStart(text string, i int) bool {
+	return i == 0 || strings.IndexByte(" \t[,:", text[i-1]) >= 0
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+//block parses the mapping or sequence at indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.seq(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) seq(indent int) (interface{}, error) {
+	var items []interface{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isSeqItem(l.text) {
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if len(rest) == 0 {
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		if _, _, ok := splitYamlKey(rest); ok {
+			//mapping starting at item, continued by lines aligned with its first key
+			p.lines[p.pos] = &yamlLine{l.num, indent + len(l.text) - len(rest), rest}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		v, err := yamlValue(l.num, rest)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		p.pos++
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || isSeqItem(l.text) {
+			break
+		}
+		key, rest, ok := splitYamlKey(l.text)
+		if !ok {
+			return nil, yamlError(l.num, "expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, yamlError(l.num, "duplicated key "+key)
+		}
+		p.pos++
+		var v interface{}
+		var err error
+		if len(rest) == 0 {
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = yamlValue(l.num, rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+//nested parses the block under a key or "-", nil if there is none;
+//sequences under keys may start at the same indent as keys
+func (p *yamlParser) nested(indent int, underKey bool) (interface{}, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	l := p.lines[p.pos]
+	if l.indent > indent || (underKey && l.indent == indent && isSeqItem(l.text)) {
+		return p.block(l.indent)
+	}
+	return nil, nil
+}
+
+//splitYamlKey splits "key: value" at the first ": " outside quotes
+func splitYamlKey(text string) (key, rest string, ok bool) {
+	if len(text) == 0 || text[0] == '[' || text[0] == '{' {
+		return
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && quoteStart(text, i):
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			k, err := yamlScalar(strings.TrimSpace(text[:i]))
+			if err != nil || len(k) == 0 {
+				return
+			}
+			return k, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return
+}
+
+//yamlValue parses a scalar or a flow sequence of scalars
+func yamlValue(num int, text string) (interface{}, error) {
+	switch text[0] {
+	case '{':
+		return nil, yamlError(num, "flow mappings are not supported")
+	case '[':
+		if text[len(text)-1] != ']' {
+			return nil, yamlError(num, "unterminated flow sequence")
+		}
+		items := []interface{}{}
+		for _, s := range splitYamlFlow(text[1 : len(text)-1]) {
+			s = strings.TrimSpace(s)
+			if len(s) == 0 {
+				continue
+			}
+			if s[0] == '[' || s[0] == '{' {
+				return nil, yamlError(num, "nested flow collections are not supported")
+			}
+			v, err := yamlScalar(s)
+			if err != nil {
+				return nil, yamlError(num, err.Error())
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	}
+	v, err := yamlScalar(text)
+	if err != nil {
+		return nil, yamlError(num, err.Error())
+	}
+	return v, nil
+}
+
+//splitYamlFlow splits items of flow sequence at commas outside quotes
+func splitYamlFlow(text string) (items []string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && quoteStart(text, i):
+			quote = c
+		case c == ',':
+			items = append(items, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, text[start:])
+}
+
+func yamlScalar(text string) (string, error) {
+	if len(text) == 0 {
+		return text, nil
+	}
+	switch text[0] {
+	case '"':
+		return strconv.Unquote(text)
+	case '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return "", errors.New("unterminated quoted string " + text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	return text, nil
+}